@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
 	"strings"
 	"syscall"
 
@@ -10,9 +11,25 @@ import (
 )
 
 func main() {
-	basePath := flag.String("base", "", "base path to check for .bz2 files")
+	if len(os.Args) > 1 && os.Args[1] == "split" {
+		runSplit(os.Args[2:])
+		return
+	}
+
+	basePath := flag.String("base", "", "base path to check for compressed files (.bz2, .gz, .xz, .zst) and .zip archives")
 	overlayPaths := flag.String("overlays", "", "comma-separated overlay paths to check (e.g., /mnt/overlays/maps,/mnt/overlays/custom)")
 	outputDir := flag.String("output", "", "output directory for decompressed files (preserves structure from source paths). If empty, decompresses in-place.")
+	verify := flag.Bool("verify", false, "re-hash cached outputs against the manifest instead of trusting size and mtime")
+	hashSources := flag.Bool("hash-sources", false, "compare the SHA-256 of compressed sources, not just size and mtime, before reusing outputs")
+	workers := flag.Int("workers", 4, "number of files decompressed concurrently")
+	maxMBPerSecond := flag.Float64("max-mbps", 0, "cap on decompressed output in MiB/s across all workers (0 for unlimited)")
+	nice := flag.Int("nice", 0, "nice value for decompression threads (1-19, 0 keeps the default)")
+	ioClass := flag.String("ionice-class", "", "I/O scheduling class for decompression threads: best-effort, idle or realtime")
+	ioLevel := flag.Int("ionice-level", 4, "level within the best-effort or realtime I/O class, 0 (highest) to 7")
+	maxFileMB := flag.Float64("max-file-mb", 0, "abort outputs larger than this many MiB (0 for unlimited)")
+	maxRatio := flag.Float64("max-ratio", 0, "abort outputs more than this many times larger than their compressed source (0 for unlimited)")
+	maxTotalMB := flag.Float64("max-total-mb", 0, "abort once a run has written this many MiB (0 for unlimited)")
+	minFreeMB := flag.Float64("min-free-mb", 0, "abort outputs that would leave less than this many MiB free on the output filesystem")
 	flag.Parse()
 
 	// Increase file descriptor limit to handle large directories
@@ -20,7 +37,7 @@ func main() {
 		log.Printf("warning: failed to increase file descriptor limit: %v", err)
 	}
 
-	log.Println("bz2 decompressor starting")
+	log.Println("decompressor starting")
 
 	// Collect all paths to scan
 	var pathsToScan []string
@@ -59,7 +76,20 @@ func main() {
 	}
 
 	// Create and run decompressor
-	decompressor := decompress.NewWithOutputDir(pathsToScan, *outputDir)
+	decompressor := decompress.NewWithOptions(pathsToScan, decompress.Options{
+		OutputDir:         *outputDir,
+		VerifyContent:     *verify,
+		HashSources:       *hashSources,
+		Workers:           *workers,
+		MaxBytesPerSecond: int64(*maxMBPerSecond * (1 << 20)),
+		Priority:          decompress.Priority{Nice: *nice, IOClass: *ioClass, IOLevel: *ioLevel},
+		Limits: decompress.Limits{
+			MaxFileBytes:  int64(*maxFileMB * (1 << 20)),
+			MaxRatio:      *maxRatio,
+			MaxTotalBytes: int64(*maxTotalMB * (1 << 20)),
+			MinFreeBytes:  int64(*minFreeMB * (1 << 20)),
+		},
+	})
 	if err := decompressor.Run(); err != nil {
 		log.Fatalf("decompression failed: %v", err)
 	}
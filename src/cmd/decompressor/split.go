@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/UDL-TF/TF2Chart/src/internal/decompress"
+)
+
+// runSplit implements "decompressor split", which turns maps into the split
+// map folders the decompressor reassembles.
+func runSplit(args []string) {
+	fs := flag.NewFlagSet("split", flag.ExitOnError)
+	partMB := fs.Float64("part-mb", decompress.DefaultPartSize>>20, "largest part in MiB")
+	level := fs.Int("level", 9, "bzip2 compression level, 1 (fastest) to 9 (smallest)")
+	outputDir := fs.String("output", "", "directory receiving the <map>.bsp.bz2.parts folders. If empty, each folder is created next to its map.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s split [flags] map.bsp...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *partMB <= 0 {
+		log.Fatal("-part-mb must be positive")
+	}
+
+	opts := decompress.SplitOptions{
+		OutputDir: *outputDir,
+		PartSize:  int64(*partMB * (1 << 20)),
+		Level:     *level,
+	}
+	for _, bspPath := range fs.Args() {
+		if _, err := decompress.SplitMap(bspPath, opts); err != nil {
+			log.Fatalf("split failed: %v", err)
+		}
+	}
+}
@@ -34,6 +34,9 @@ func main() {
 	if err := merger.Run(context.Background()); err != nil {
 		log.Fatalf("merge failed: %v", err)
 	}
+	if err := merger.Wait(); err != nil {
+		log.Fatalf("fastdl sync failed: %v", err)
+	}
 	log.Printf("merge complete in %s", time.Since(start))
 }
 
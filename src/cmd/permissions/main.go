@@ -2,80 +2,164 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
-	"io/fs"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/UDL-TF/TF2Chart/src/internal/config"
+	"github.com/UDL-TF/TF2Chart/src/internal/permissions"
 )
 
+// jobResult is the audit output for a single job.
+type jobResult struct {
+	Path   string             `json:"path"`
+	Report permissions.Report `json:"report"`
+}
+
 func main() {
 	env := flag.String("config-env", "PERMISSIONS_CONFIG", "env var containing permission JSON")
+	audit := flag.Bool("audit", false, "report mismatched ownership/mode as JSON without changing anything; exits 1 on mismatches")
+	maxMismatches := flag.Int("audit-limit", 1000, "maximum mismatches listed per job in the audit report (-1 for all)")
 	flag.Parse()
 
-	log.Printf("permissions job starting (configEnv=%s)", *env)
-	cfg, err := config.FromEnv[config.PermissionJob](*env)
+	log.Printf("permissions job starting (configEnv=%s audit=%t)", *env, *audit)
+	cfg, err := config.FromEnv[config.PermissionConfig](*env)
 	if err != nil {
 		log.Fatalf("load permission config: %v", err)
 	}
-	log.Printf("permissions config: path=%s uid=%d gid=%d mode=%s", cfg.Path, cfg.User, cfg.Group, cfg.Mode)
+	jobs := cfg.AllJobs()
+	if len(jobs) == 0 {
+		log.Fatalf("permission config has no jobs")
+	}
 
-	mode, err := parseMode(cfg.Mode)
-	if err != nil {
-		log.Fatalf("parse mode: %v", err)
+	base := permissions.Options{Audit: *audit, Parallelism: 8, Progress: 10 * time.Second}
+	if *audit {
+		base.MaxMismatches = *maxMismatches
+	}
+	if cfg.Parallelism > 0 {
+		base.Parallelism = cfg.Parallelism
+	}
+	if cfg.ProgressSeconds != 0 {
+		base.Progress = time.Duration(max(cfg.ProgressSeconds, 0)) * time.Second
 	}
 
-	if err := applyPermissions(context.Background(), cfg.Path, cfg.User, cfg.Group, mode); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	results, err := runJobs(ctx, jobs, base)
+	if err != nil {
 		log.Fatalf("apply permissions: %v", err)
 	}
-	log.Printf("permissions fixed for %s", cfg.Path)
+	if *audit {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			log.Fatalf("write audit report: %v", err)
+		}
+		mismatched := 0
+		for _, res := range results {
+			mismatched += res.Report.Changed
+		}
+		if mismatched > 0 {
+			log.Printf("audit: %d entries differ from their rules", mismatched)
+			os.Exit(1)
+		}
+		log.Printf("audit: all entries match their rules")
+		return
+	}
+	for _, res := range results {
+		log.Printf("permissions fixed for %s (%d scanned, %d changed)", res.Path, res.Report.Scanned, res.Report.Changed)
+	}
 }
 
-func applyPermissions(ctx context.Context, root string, uid, gid int, mode fs.FileMode) error {
-	if err := contextErr(ctx); err != nil {
-		return err
+// runJobs runs jobs whose paths do not overlap concurrently. Jobs sharing a
+// subtree run one after another in configured order, so later jobs win. All
+// jobs share the parallelism of base, however many run at once.
+func runJobs(ctx context.Context, jobs []config.PermissionJob, base permissions.Options) ([]jobResult, error) {
+	results := make([]jobResult, len(jobs))
+	errs := make([]error, len(jobs))
+	groups := overlapGroups(jobs)
+	if len(groups) > 1 && base.Budget == nil {
+		base.Budget = permissions.NewBudget(base.Parallelism)
 	}
-	return filepath.WalkDir(root, func(path string, d fs.DirEntry, walkErr error) error {
-		if walkErr != nil {
-			return walkErr
-		}
-		// Use Lchown to change symlink ownership itself, not the target
-		if err := os.Lchown(path, uid, gid); err != nil && !shouldIgnorePermissionError(err) {
-			return err
-		}
-		// Only chmod non-symlinks (chmod follows symlinks)
-		if d.Type()&os.ModeSymlink == 0 {
-			if err := os.Chmod(path, mode); err != nil && !shouldIgnorePermissionError(err) {
-				return err
+	var wg sync.WaitGroup
+	for _, group := range groups {
+		wg.Add(1)
+		go func(group []int) {
+			defer wg.Done()
+			for _, i := range group {
+				job := jobs[i]
+				log.Printf("permissions config: path=%s rules=%d exclude=%v followSymlinks=%t", job.Path, len(job.Rules), job.Exclude, job.FollowSymlinks)
+				results[i].Path = job.Path
+				rules, err := permissions.Compile(job.Rules)
+				if err != nil {
+					errs[i] = fmt.Errorf("%s: %w", job.Path, err)
+					continue
+				}
+				opts := base
+				opts.Exclude = job.Exclude
+				opts.FollowSymlinks = job.FollowSymlinks
+				results[i].Report, err = permissions.Apply(ctx, job.Path, rules, opts)
+				if err != nil {
+					errs[i] = fmt.Errorf("%s: %w", job.Path, err)
+				}
 			}
-		}
-		return nil
-	})
+		}(group)
+	}
+	wg.Wait()
+	return results, errors.Join(errs...)
 }
 
-func parseMode(val string) (fs.FileMode, error) {
-	if val == "" {
-		return 0o755, nil
+// overlapGroups partitions job indexes so that jobs whose paths contain one
+// another share a group. A job following symlinks may reach any path, so it
+// shares a group with every other job. Groups keep the configured job order.
+func overlapGroups(jobs []config.PermissionJob) [][]int {
+	group := make([]int, len(jobs))
+	for i := range jobs {
+		group[i] = i
+		for j := 0; j < i; j++ {
+			if jobs[i].FollowSymlinks || jobs[j].FollowSymlinks || overlaps(jobs[i].Path, jobs[j].Path) {
+				merge(group, group[j], group[i])
+			}
+		}
 	}
-	n, err := strconv.ParseUint(val, 8, 32)
-	if err != nil {
-		return 0, err
+	byGroup := make(map[int][]int)
+	var order []int
+	for i, g := range group {
+		if _, ok := byGroup[g]; !ok {
+			order = append(order, g)
+		}
+		byGroup[g] = append(byGroup[g], i)
+	}
+	out := make([][]int, 0, len(order))
+	for _, g := range order {
+		out = append(out, byGroup[g])
 	}
-	return fs.FileMode(n), nil
+	return out
 }
 
-func contextErr(ctx context.Context) error {
-	if ctx == nil {
-		return nil
+// merge relabels every member of group from to group into.
+func merge(group []int, into, from int) {
+	for i := range group {
+		if group[i] == from {
+			group[i] = into
+		}
 	}
-	return ctx.Err()
 }
 
-func shouldIgnorePermissionError(err error) bool {
-	return errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EROFS) || errors.Is(err, os.ErrPermission) || errors.Is(err, os.ErrNotExist)
+func overlaps(a, b string) bool {
+	a, b = filepath.Clean(a), filepath.Clean(b)
+	return a == b || within(a, b) || within(b, a)
+}
+
+func within(path, dir string) bool {
+	return dir == string(filepath.Separator) || strings.HasPrefix(path, dir+string(filepath.Separator))
 }
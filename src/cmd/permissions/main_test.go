@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/UDL-TF/TF2Chart/src/internal/config"
+)
+
+func TestOverlapGroups(t *testing.T) {
+	for name, tc := range map[string]struct {
+		jobs []config.PermissionJob
+		want [][]int
+	}{
+		"disjoint": {
+			jobs: []config.PermissionJob{{Path: "/mnt/base/maps"}, {Path: "/mnt/base/cfg"}},
+			want: [][]int{{0}, {1}},
+		},
+		"nested": {
+			jobs: []config.PermissionJob{{Path: "/mnt/base"}, {Path: "/mnt/base/cfg"}},
+			want: [][]int{{0, 1}},
+		},
+		"same path": {
+			jobs: []config.PermissionJob{{Path: "/mnt/base/cfg/"}, {Path: "/mnt/base/cfg"}},
+			want: [][]int{{0, 1}},
+		},
+		"shared prefix only": {
+			jobs: []config.PermissionJob{{Path: "/mnt/base/cfg"}, {Path: "/mnt/base/cfg2"}},
+			want: [][]int{{0}, {1}},
+		},
+		"root": {
+			jobs: []config.PermissionJob{{Path: "/mnt/a"}, {Path: "/"}, {Path: "/mnt/b"}},
+			want: [][]int{{0, 1, 2}},
+		},
+		"chained groups keep order": {
+			jobs: []config.PermissionJob{{Path: "/mnt/a/x"}, {Path: "/mnt/b"}, {Path: "/mnt/a/y"}, {Path: "/mnt/a"}},
+			want: [][]int{{0, 2, 3}, {1}},
+		},
+		"follow symlinks": {
+			jobs: []config.PermissionJob{{Path: "/mnt/a"}, {Path: "/mnt/b", FollowSymlinks: true}, {Path: "/mnt/c"}},
+			want: [][]int{{0, 1, 2}},
+		},
+		"follow symlinks alone": {
+			jobs: []config.PermissionJob{{Path: "/mnt/a", FollowSymlinks: true}},
+			want: [][]int{{0}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if got := overlapGroups(tc.jobs); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
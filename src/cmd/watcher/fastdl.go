@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/UDL-TF/TF2Chart/src/internal/config"
+	"github.com/UDL-TF/TF2Chart/src/internal/fastdl"
+)
+
+// serveFastDL runs the FastDL HTTP server for the merged view until ctx is
+// cancelled.
+func serveFastDL(ctx context.Context, cfg *config.MergeConfig) error {
+	fd := cfg.FastDL
+	handler, err := fastdl.NewServer(cfg.TargetContent, fd.OutputDir, fastdl.ServerOptions{
+		Dirs:              fd.Dirs,
+		Prefix:            fd.Server.Prefix,
+		BytesPerSecond:    int64(fd.Server.MaxKBPerSecond * (1 << 10)),
+		MaxConnsPerIP:     fd.Server.MaxConnsPerIP,
+		TrustForwardedFor: fd.Server.TrustForwardedFor,
+	})
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Addr:              fd.Server.Listen,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       time.Minute,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("fastdl: serving %s and %s on %s", cfg.TargetContent, fd.OutputDir, fd.Server.Listen)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
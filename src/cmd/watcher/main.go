@@ -52,6 +52,14 @@ func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
 	defer cancel()
 
+	if fd := mergeCfg.FastDL; fd != nil && fd.Server != nil && fd.Server.Listen != "" {
+		go func() {
+			if err := serveFastDL(ctx, mergeCfg); err != nil {
+				log.Fatalf("fastdl server: %v", err)
+			}
+		}()
+	}
+
 	if err := manager.Run(ctx); err != nil {
 		if errors.Is(err, context.Canceled) {
 			log.Printf("watcher stopped: %v", err)
@@ -0,0 +1,386 @@
+package bzip2
+
+const (
+	runA = 0
+	runB = 1
+
+	groupSize  = 50
+	maxGroups  = 6
+	maxCodeLen = 17
+	// tableIterations refines the Huffman tables as the reference encoder does.
+	tableIterations = 4
+)
+
+// sortRotations returns the start offsets of the rotations of data in sorted
+// order, by prefix doubling with counting sorts.
+func sortRotations(data []byte) []int32 {
+	n := len(data)
+	p := make([]int32, n)
+	c := make([]int32, n)
+
+	// Start from the order of the first two bytes of each rotation.
+	key := func(i int) int {
+		j := i + 1
+		if j == n {
+			j = 0
+		}
+		return int(data[i])<<8 | int(data[j])
+	}
+	count := make([]int32, 1<<16)
+	for i := 0; i < n; i++ {
+		count[key(i)]++
+	}
+	for i := 1; i < len(count); i++ {
+		count[i] += count[i-1]
+	}
+	for i := n - 1; i >= 0; i-- {
+		k := key(i)
+		count[k]--
+		p[count[k]] = int32(i)
+	}
+	classes := int32(1)
+	for i := 1; i < n; i++ {
+		if key(int(p[i])) != key(int(p[i-1])) {
+			classes++
+		}
+		c[p[i]] = classes - 1
+	}
+
+	pn := make([]int32, n)
+	cn := make([]int32, n)
+	cnt := make([]int32, n)
+	for k := 2; k < n && int(classes) < n; k <<= 1 {
+		// Rotations sorted by their second half, then stably by the first.
+		for i, start := range p {
+			s := int(start) - k
+			if s < 0 {
+				s += n
+			}
+			pn[i] = int32(s)
+		}
+		clear(cnt[:classes])
+		for _, s := range pn {
+			cnt[c[s]]++
+		}
+		for i := int32(1); i < classes; i++ {
+			cnt[i] += cnt[i-1]
+		}
+		for i := n - 1; i >= 0; i-- {
+			s := pn[i]
+			cnt[c[s]]--
+			p[cnt[c[s]]] = s
+		}
+		cn[p[0]] = 0
+		classes = 1
+		for i := 1; i < n; i++ {
+			cur, prev := int(p[i]), int(p[i-1])
+			curNext, prevNext := cur+k, prev+k
+			if curNext >= n {
+				curNext -= n
+			}
+			if prevNext >= n {
+				prevNext -= n
+			}
+			if c[cur] != c[prev] || c[curNext] != c[prevNext] {
+				classes++
+			}
+			cn[cur] = classes - 1
+		}
+		c, cn = cn, c
+	}
+	return p
+}
+
+// encodeBlock writes the symbol map, Huffman tables and symbols for the
+// Burrows-Wheeler transformed block last.
+func encodeBlock(bw *bitWriter, last []byte) {
+	// Map the bytes in use onto a dense alphabet.
+	var inUse [256]bool
+	for _, b := range last {
+		inUse[b] = true
+	}
+	var seq [256]byte
+	numInUse := 0
+	for i, used := range inUse {
+		if used {
+			seq[i] = byte(numInUse)
+			numInUse++
+		}
+	}
+	alphaSize := numInUse + 2
+	eob := uint16(numInUse + 1)
+
+	// Move-to-front, with runs of zeros written as RUNA/RUNB digits.
+	var mtf [256]byte
+	for i := range mtf {
+		mtf[i] = byte(i)
+	}
+	symbols := make([]uint16, 0, len(last)+1)
+	freq := make([]int32, alphaSize)
+	zeros := 0
+	flushZeros := func() {
+		if zeros == 0 {
+			return
+		}
+		for z := zeros - 1; ; z = (z - 2) / 2 {
+			sym := uint16(runA)
+			if z&1 != 0 {
+				sym = runB
+			}
+			symbols = append(symbols, sym)
+			freq[sym]++
+			if z < 2 {
+				break
+			}
+		}
+		zeros = 0
+	}
+	for _, b := range last {
+		s := seq[b]
+		if mtf[0] == s {
+			zeros++
+			continue
+		}
+		flushZeros()
+		j := 1
+		for mtf[j] != s {
+			j++
+		}
+		copy(mtf[1:j+1], mtf[:j])
+		mtf[0] = s
+		symbols = append(symbols, uint16(j+1))
+		freq[j+1]++
+	}
+	flushZeros()
+	symbols = append(symbols, eob)
+	freq[eob]++
+
+	lengths, selectors := buildTables(symbols, freq, alphaSize)
+
+	// Symbol map: which 16-byte ranges are used, then the bytes in each.
+	var ranges uint64
+	for i := 0; i < 16; i++ {
+		for j := 0; j < 16; j++ {
+			if inUse[i*16+j] {
+				ranges |= 1 << (15 - i)
+				break
+			}
+		}
+	}
+	bw.write(16, ranges)
+	for i := 0; i < 16; i++ {
+		if ranges&(1<<(15-i)) == 0 {
+			continue
+		}
+		var bits uint64
+		for j := 0; j < 16; j++ {
+			if inUse[i*16+j] {
+				bits |= 1 << (15 - j)
+			}
+		}
+		bw.write(16, bits)
+	}
+
+	// Selectors, move-to-front coded in unary.
+	bw.write(3, uint64(len(lengths)))
+	bw.write(15, uint64(len(selectors)))
+	var order [maxGroups]byte
+	for i := range order {
+		order[i] = byte(i)
+	}
+	for _, sel := range selectors {
+		j := 0
+		for order[j] != sel {
+			j++
+		}
+		copy(order[1:j+1], order[:j])
+		order[0] = sel
+		for ; j > 0; j-- {
+			bw.write(1, 1)
+		}
+		bw.write(1, 0)
+	}
+
+	// Code lengths, delta coded.
+	codes := make([][]uint32, len(lengths))
+	for t, lens := range lengths {
+		cur := lens[0]
+		bw.write(5, uint64(cur))
+		for _, l := range lens {
+			for cur < l {
+				bw.write(2, 2)
+				cur++
+			}
+			for cur > l {
+				bw.write(2, 3)
+				cur--
+			}
+			bw.write(1, 0)
+		}
+		codes[t] = canonicalCodes(lens)
+	}
+
+	for g, sel := range selectors {
+		lens, code := lengths[sel], codes[sel]
+		end := min((g+1)*groupSize, len(symbols))
+		for _, sym := range symbols[g*groupSize : end] {
+			bw.write(uint(lens[sym]), uint64(code[sym]))
+		}
+	}
+}
+
+// buildTables picks Huffman tables and assigns one to each group of 50
+// symbols, refining both a few times as the reference encoder does.
+func buildTables(symbols []uint16, freq []int32, alphaSize int) ([][]uint8, []byte) {
+	nGroups := 6
+	switch n := len(symbols); {
+	case n < 200:
+		nGroups = 2
+	case n < 600:
+		nGroups = 3
+	case n < 1200:
+		nGroups = 4
+	case n < 2400:
+		nGroups = 5
+	}
+
+	// Start with tables that favour disjoint slices of the alphabet holding
+	// about equal shares of the symbols.
+	lengths := make([][]uint8, nGroups)
+	remaining := int32(len(symbols))
+	start := 0
+	for part := nGroups; part > 0; part-- {
+		target := remaining / int32(part)
+		end := start - 1
+		var acc int32
+		for acc < target && end < alphaSize-1 {
+			end++
+			acc += freq[end]
+		}
+		if end > start && part != nGroups && part != 1 && (nGroups-part)%2 == 1 {
+			acc -= freq[end]
+			end--
+		}
+		lens := make([]uint8, alphaSize)
+		for v := range lens {
+			if v < start || v > end {
+				lens[v] = 15
+			}
+		}
+		lengths[part-1] = lens
+		start = end + 1
+		remaining -= acc
+	}
+
+	nSelectors := (len(symbols) + groupSize - 1) / groupSize
+	selectors := make([]byte, nSelectors)
+	groupFreq := make([][]int32, nGroups)
+	for t := range groupFreq {
+		groupFreq[t] = make([]int32, alphaSize)
+	}
+	for iter := 0; iter < tableIterations; iter++ {
+		for t := range groupFreq {
+			clear(groupFreq[t])
+		}
+		for g := range selectors {
+			group := symbols[g*groupSize : min((g+1)*groupSize, len(symbols))]
+			best, bestCost := 0, -1
+			for t, lens := range lengths {
+				cost := 0
+				for _, sym := range group {
+					cost += int(lens[sym])
+				}
+				if bestCost < 0 || cost < bestCost {
+					best, bestCost = t, cost
+				}
+			}
+			selectors[g] = byte(best)
+			for _, sym := range group {
+				groupFreq[best][sym]++
+			}
+		}
+		for t := range lengths {
+			lengths[t] = codeLengths(groupFreq[t], maxCodeLen)
+		}
+	}
+	return lengths, selectors
+}
+
+// codeLengths returns Huffman code lengths of at most maxLen bits for freq.
+// Every symbol gets a code, as the format requires; when the tree is too deep
+// the weights are flattened and the tree rebuilt.
+func codeLengths(freq []int32, maxLen int) []uint8 {
+	n := len(freq)
+	weight := make([]int64, 2*n)
+	for i, f := range freq {
+		weight[i] = int64(max(f, 1)) << 8
+	}
+	parent := make([]int, 2*n)
+	lens := make([]uint8, n)
+	for {
+		// Repeatedly join the two lightest roots; n is at most 258.
+		alive := make([]int, n, 2*n)
+		for i := range alive {
+			alive[i] = i
+		}
+		next := n
+		for len(alive) > 1 {
+			a, b := lightestTwo(alive, weight)
+			ia, ib := alive[a], alive[b]
+			weight[next] = weight[ia] + weight[ib]
+			parent[ia], parent[ib] = next, next
+			// Replace a with the new node and drop b.
+			alive[a] = next
+			alive[b] = alive[len(alive)-1]
+			alive = alive[:len(alive)-1]
+			next++
+		}
+		root := alive[0]
+		tooLong := false
+		for i := 0; i < n; i++ {
+			depth := 0
+			for j := i; j != root; j = parent[j] {
+				depth++
+			}
+			lens[i] = uint8(depth)
+			if depth > maxLen {
+				tooLong = true
+			}
+		}
+		if !tooLong {
+			return lens
+		}
+		for i := 0; i < n; i++ {
+			weight[i] = (1 + weight[i]>>8/2) << 8
+		}
+	}
+}
+
+func lightestTwo(alive []int, weight []int64) (int, int) {
+	a, b := -1, -1
+	for i, node := range alive {
+		switch {
+		case a < 0 || weight[node] < weight[alive[a]]:
+			a, b = i, a
+		case b < 0 || weight[node] < weight[alive[b]]:
+			b = i
+		}
+	}
+	return a, b
+}
+
+// canonicalCodes assigns codes in order of length, then symbol.
+func canonicalCodes(lens []uint8) []uint32 {
+	codes := make([]uint32, len(lens))
+	code := uint32(0)
+	for l := uint8(1); l <= maxCodeLen; l++ {
+		for sym, sl := range lens {
+			if sl == l {
+				codes[sym] = code
+				code++
+			}
+		}
+		code <<= 1
+	}
+	return codes
+}
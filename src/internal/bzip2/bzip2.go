@@ -0,0 +1,217 @@
+// Package bzip2 compresses data into the bzip2 format read by compress/bzip2
+// and the reference bzip2 tool.
+package bzip2
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// BestSpeed and BestCompression bound the level, which selects the block
+	// size in units of 100 kB.
+	BestSpeed          = 1
+	BestCompression    = 9
+	DefaultCompression = BestCompression
+
+	blockMagic = 0x314159265359
+	endMagic   = 0x177245385090
+
+	// blockSlack mirrors the reference encoder, which stops a block 19 bytes
+	// short of its nominal size.
+	blockSlack = 19
+	maxRun     = 255
+)
+
+var errClosed = errors.New("bzip2: write to closed writer")
+
+// Writer compresses everything written to it. Close must be called to flush
+// the last block and the stream trailer.
+type Writer struct {
+	bw       *bitWriter
+	level    int
+	maxBlock int
+
+	block    []byte // run-length encoded input of the current block
+	blockCRC uint32
+	combined uint32
+	header   bool
+
+	last int // byte of the pending run, or -1
+	run  int // length of the pending run
+
+	closed bool
+	err    error
+}
+
+// NewWriter returns a Writer compressing at DefaultCompression.
+func NewWriter(w io.Writer) *Writer {
+	z, _ := NewWriterLevel(w, DefaultCompression)
+	return z
+}
+
+// NewWriterLevel returns a Writer compressing with blocks of level*100 kB.
+func NewWriterLevel(w io.Writer, level int) (*Writer, error) {
+	if level < BestSpeed || level > BestCompression {
+		return nil, fmt.Errorf("bzip2: invalid compression level %d", level)
+	}
+	maxBlock := level*100000 - blockSlack
+	return &Writer{
+		bw:       newBitWriter(w),
+		level:    level,
+		maxBlock: maxBlock,
+		block:    make([]byte, 0, maxBlock),
+		blockCRC: crcInit,
+		last:     -1,
+	}, nil
+}
+
+func (z *Writer) Write(p []byte) (int, error) {
+	if z.closed {
+		return 0, errClosed
+	}
+	if z.err != nil {
+		return 0, z.err
+	}
+	for _, b := range p {
+		if int(b) == z.last && z.run < maxRun {
+			z.run++
+			continue
+		}
+		if z.run > 0 {
+			z.flushRun()
+			if z.err != nil {
+				return 0, z.err
+			}
+		}
+		z.last = int(b)
+		z.run = 1
+	}
+	return len(p), nil
+}
+
+// flushRun adds the pending run to the block: runs of four or more bytes
+// become four bytes and a count of the rest.
+func (z *Writer) flushRun() {
+	b := byte(z.last)
+	for i := 0; i < z.run; i++ {
+		z.blockCRC = updateCRC(z.blockCRC, b)
+	}
+	if z.run < 4 {
+		for i := 0; i < z.run; i++ {
+			z.block = append(z.block, b)
+		}
+	} else {
+		z.block = append(z.block, b, b, b, b, byte(z.run-4))
+	}
+	z.last, z.run = -1, 0
+	// A run adds at most five bytes, so keep that much room in the block.
+	if len(z.block)+5 > z.maxBlock {
+		z.err = z.writeBlock()
+	}
+}
+
+// Close flushes buffered data and writes the stream trailer. It does not
+// close the underlying writer.
+func (z *Writer) Close() error {
+	if z.closed {
+		return z.err
+	}
+	z.closed = true
+	if z.err != nil {
+		return z.err
+	}
+	if z.run > 0 {
+		z.flushRun()
+		if z.err != nil {
+			return z.err
+		}
+	}
+	if len(z.block) > 0 {
+		if z.err = z.writeBlock(); z.err != nil {
+			return z.err
+		}
+	}
+	z.writeHeader()
+	z.bw.write(48, endMagic)
+	z.bw.write(32, uint64(z.combined))
+	z.err = z.bw.flush()
+	return z.err
+}
+
+func (z *Writer) writeHeader() {
+	if z.header {
+		return
+	}
+	z.header = true
+	z.bw.write(8, 'B')
+	z.bw.write(8, 'Z')
+	z.bw.write(8, 'h')
+	z.bw.write(8, uint64('0'+z.level))
+}
+
+// writeBlock compresses and emits the current block.
+func (z *Writer) writeBlock() error {
+	z.writeHeader()
+	crc := ^z.blockCRC
+	z.combined = (z.combined<<1 | z.combined>>31) ^ crc
+
+	data := z.block
+	n := len(data)
+	order := sortRotations(data)
+	last := make([]byte, n)
+	origPtr := 0
+	for i, start := range order {
+		if start == 0 {
+			origPtr = i
+		}
+		last[i] = data[(int(start)+n-1)%n]
+	}
+
+	z.bw.write(48, blockMagic)
+	z.bw.write(32, uint64(crc))
+	z.bw.write(1, 0) // not randomized
+	z.bw.write(24, uint64(origPtr))
+	encodeBlock(z.bw, last)
+
+	z.block = z.block[:0]
+	z.blockCRC = crcInit
+	return z.bw.err
+}
+
+// bitWriter writes bits most significant first.
+type bitWriter struct {
+	w     *bufio.Writer
+	bits  uint64
+	nbits uint
+	err   error
+}
+
+func newBitWriter(w io.Writer) *bitWriter {
+	return &bitWriter{w: bufio.NewWriterSize(w, 64<<10)}
+}
+
+// write appends the low n bits of v, n at most 48.
+func (b *bitWriter) write(n uint, v uint64) {
+	b.bits = b.bits<<n | v&(1<<n-1)
+	b.nbits += n
+	for b.nbits >= 8 {
+		b.nbits -= 8
+		if err := b.w.WriteByte(byte(b.bits >> b.nbits)); err != nil && b.err == nil {
+			b.err = err
+		}
+	}
+}
+
+// flush pads the last byte with zero bits and flushes the buffer.
+func (b *bitWriter) flush() error {
+	if b.nbits > 0 {
+		b.write(8-b.nbits, 0)
+	}
+	if err := b.w.Flush(); err != nil && b.err == nil {
+		b.err = err
+	}
+	return b.err
+}
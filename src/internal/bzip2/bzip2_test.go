@@ -0,0 +1,79 @@
+package bzip2
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"io"
+	"testing"
+
+	"github.com/UDL-TF/TF2Chart/src/internal/testutil"
+)
+
+func compress(t *testing.T, data []byte, level int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriterLevel(&buf, level)
+	if err != nil {
+		t.Fatalf("new writer: %v", err)
+	}
+	// Uneven writes exercise runs that span calls.
+	for len(data) > 0 {
+		n := min(len(data), 1+len(data)%7919)
+		if _, err := w.Write(data[:n]); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		data = data[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	for name, tc := range map[string]struct {
+		data  []byte
+		level int
+	}{
+		"empty":          {nil, 9},
+		"one byte":       {[]byte{'x'}, 9},
+		"text":           {testutil.Sample(2000, 0), 9},
+		"mixed":          {testutil.Sample(1000, 66000), 9},
+		"several blocks": {testutil.Sample(12000, 0), 1},
+		"long runs":      {bytes.Repeat([]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaab"), 1000), 2},
+		"zeros":          {make([]byte, 250000), 1},
+		"periodic":       {bytes.Repeat([]byte("ab"), 150000), 1},
+		"all byte values": {func() []byte {
+			b := make([]byte, 256*40)
+			for i := range b {
+				b[i] = byte(i * 7)
+			}
+			return b
+		}(), 9},
+	} {
+		compressed := compress(t, tc.data, tc.level)
+		got, err := io.ReadAll(bzip2.NewReader(bytes.NewReader(compressed)))
+		if err != nil {
+			t.Errorf("%s: decompress: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(got, tc.data) {
+			t.Errorf("%s: round trip produced %d bytes that differ from the %d written", name, len(got), len(tc.data))
+		}
+	}
+}
+
+func TestWriterCompresses(t *testing.T) {
+	data := testutil.Sample(2000, 0)
+	if compressed := compress(t, data, 9); len(compressed) > len(data)/3 {
+		t.Errorf("compressed %d bytes of text to %d", len(data), len(compressed))
+	}
+}
+
+func TestNewWriterLevelRejectsInvalidLevels(t *testing.T) {
+	for _, level := range []int{0, 10} {
+		if _, err := NewWriterLevel(io.Discard, level); err == nil {
+			t.Errorf("level %d: expected an error", level)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package bzip2
+
+// bzip2 uses the big-endian (unreflected) CRC-32 with polynomial 0x04c11db7.
+const crcInit = 0xffffffff
+
+var crcTable = func() [256]uint32 {
+	var t [256]uint32
+	for i := range t {
+		c := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if c&0x80000000 != 0 {
+				c = c<<1 ^ 0x04c11db7
+			} else {
+				c <<= 1
+			}
+		}
+		t[i] = c
+	}
+	return t
+}()
+
+func updateCRC(crc uint32, b byte) uint32 {
+	return crc<<8 ^ crcTable[byte(crc>>24)^b]
+}
@@ -21,8 +21,55 @@ type MergeConfig struct {
 	CopyTemplates          []CopyTemplate  `json:"copyTemplates"`
 	Permissions            PermissionPhase `json:"permissions"`
 	ExcludePaths           []string        `json:"excludePaths,omitempty"`           // Paths to exclude from overlay merge
-	DecompressPaths        []string        `json:"decompressPaths,omitempty"`        // Paths to scan for .bz2 files and decompress
+	DecompressPaths        []string        `json:"decompressPaths,omitempty"`        // Paths to scan for compressed files and archives to decompress
 	DecompressionOutputDir string          `json:"decompressionOutputDir,omitempty"` // Output directory for decompressed files (preserves structure)
+	Decompression          Decompression   `json:"decompression,omitempty"`          // Worker count, throughput and priority of runtime decompression
+	BackupRoot             string          `json:"backupRoot,omitempty"`             // Directory receiving snapshots taken before clean template copies
+	SecretDirs             []string        `json:"secretDirs,omitempty"`             // Mounted secret directories exposed to rendered template files
+	FileMerges             []FileMerge     `json:"fileMerges,omitempty"`             // Files combined from every layer instead of the last layer winning
+	Transforms             []TransformRule `json:"transforms,omitempty"`             // Content transformers applied while merging layers
+	FastDL                 *FastDL         `json:"fastdl,omitempty"`                 // bzip2 mirror of downloadable content kept after every merge
+}
+
+// FastDL configures the mirror of the merged content tree that clients
+// download through sv_downloadurl.
+type FastDL struct {
+	OutputDir string   `json:"outputDir"`         // Directory receiving the .bz2 copies
+	Dirs      []string `json:"dirs,omitempty"`    // Content directories mirrored (defaults to maps, materials, models, sound, particles and resource)
+	Level     int      `json:"level,omitempty"`   // bzip2 compression level, 1 to 9 (default 9)
+	Workers   int      `json:"workers,omitempty"` // Files compressed concurrently (default 1)
+
+	Server *FastDLServer `json:"server,omitempty"` // HTTP server run by the watcher
+}
+
+// FastDLServer configures the built-in HTTP server for sv_downloadurl, which
+// serves the mirror and the merged content tree from the watcher sidecar.
+type FastDLServer struct {
+	Listen            string  `json:"listen"`                      // Listen address, e.g. :27020
+	Prefix            string  `json:"prefix,omitempty"`            // URL path prefix in front of the content paths
+	MaxKBPerSecond    float64 `json:"maxKBPerSecond,omitempty"`    // Download rate per client IP in KiB/s; 0 is unlimited
+	MaxConnsPerIP     int     `json:"maxConnsPerIP,omitempty"`     // Concurrent downloads per client IP; 0 is unlimited
+	TrustForwardedFor bool    `json:"trustForwardedFor,omitempty"` // Identify clients by X-Forwarded-For when behind a proxy
+}
+
+// Decompression tunes how DecompressPaths are processed, mainly so that runtime
+// decompression in the watcher does not starve the game server or fill its disk.
+type Decompression struct {
+	Workers        int     `json:"workers,omitempty"`        // Concurrent decompressions (default 1)
+	MaxMBPerSecond float64 `json:"maxMBPerSecond,omitempty"` // Cap on decompressed output across workers; 0 is unlimited
+	Nice           int     `json:"nice,omitempty"`           // Nice value of decompression threads (1-19)
+	IOClass        string  `json:"ioClass,omitempty"`        // I/O scheduling class of decompression threads: best-effort, idle or realtime
+	IOLevel        int     `json:"ioLevel,omitempty"`        // Level within the I/O class, 0 (highest) to 7
+	MaxFileMB      float64 `json:"maxFileMB,omitempty"`      // Largest single output; 0 is unlimited
+	MaxRatio       float64 `json:"maxRatio,omitempty"`       // Largest output to compressed size ratio; 0 is unlimited
+	MaxTotalMB     float64 `json:"maxTotalMB,omitempty"`     // Total output of one pass; 0 is unlimited
+	MinFreeMB      float64 `json:"minFreeMB,omitempty"`      // Free space to leave on the output filesystem
+}
+
+// TransformRule enables a content transformer for layer files matching its globs.
+type TransformRule struct {
+	Name  string   `json:"name"`            // crlf, bom, gunzip, bunzip2 or a registered transformer
+	Paths []string `json:"paths,omitempty"` // Globs relative to the layer root (defaults depend on the transformer)
 }
 
 // Overlay represents a stitched layer sourced from a mounted volume.
@@ -31,6 +78,16 @@ type Overlay struct {
 	SourcePath string `json:"sourcePath"`
 }
 
+// FileMerge selects content files that are generated from the base and every
+// overlay in precedence order instead of symlinking the highest layer's copy.
+type FileMerge struct {
+	Path          string `json:"path"`                    // Glob relative to the content root (e.g. cfg/server.cfg)
+	Strategy      string `json:"strategy"`                // "lines" or "keyvalues"
+	Dedupe        bool   `json:"dedupe,omitempty"`        // Drop lines already contributed by an earlier layer
+	Headers       bool   `json:"headers,omitempty"`       // Prefix each layer's contribution with a comment naming it
+	CommentPrefix string `json:"commentPrefix,omitempty"` // Comment marker used for headers (defaults to "//")
+}
+
 // WritablePath configures passthrough directories that should stay writable.
 type WritablePath struct {
 	Path      string            `json:"path"`
@@ -40,28 +97,76 @@ type WritablePath struct {
 
 // WritableTemplate describes how to seed a writable path from another source.
 type WritableTemplate struct {
-	SourceMount string `json:"sourceMount"`
-	SourcePath  string `json:"sourcePath"`
-	Clean       bool   `json:"clean"`
+	SourceMount string        `json:"sourceMount"`
+	SourcePath  string        `json:"sourcePath"`
+	Clean       bool          `json:"clean"`
+	Preserve    []string      `json:"preserve,omitempty"` // Globs (relative to the destination) never removed or overwritten
+	Exclude     []string      `json:"exclude,omitempty"`  // Globs (relative to the source) that the template does not own
+	Backup      *BackupPolicy `json:"backup,omitempty"`   // Snapshot the destination before clean mode removes it
+	Render      []string      `json:"render,omitempty"`   // Globs (relative to the source) rendered as Go text/template files
+	Mode        string        `json:"mode,omitempty"`     // Octal or symbolic (u+rwX) mode for copied files (defaults to the source mode)
+	User        *int          `json:"user,omitempty"`     // Owner uid for copied files
+	Group       *int          `json:"group,omitempty"`    // Owner gid for copied files
+
+	PreserveAttributes *AttributePolicy `json:"preserveAttributes,omitempty"` // Source metadata carried over to copied files
 }
 
 // CopyTemplate mirrors the behaviour of copy-only overlays defined in values.yaml.
 type CopyTemplate struct {
-	SourceMount string `json:"sourceMount"`
-	SourcePath  string `json:"sourcePath"`
-	TargetPath  string `json:"targetPath"`
-	Clean       bool   `json:"clean"`
-	TargetMode  string `json:"targetMode,omitempty"`
-	OnlyOnInit  bool   `json:"onlyOnInit,omitempty"` // Skip this copy during watcher re-merges
+	SourceMount string        `json:"sourceMount"`
+	SourcePath  string        `json:"sourcePath"`
+	TargetPath  string        `json:"targetPath"`
+	Clean       bool          `json:"clean"`
+	TargetMode  string        `json:"targetMode,omitempty"`
+	OnlyOnInit  bool          `json:"onlyOnInit,omitempty"` // Skip this copy during watcher re-merges
+	Preserve    []string      `json:"preserve,omitempty"`   // Globs (relative to the destination) never removed or overwritten
+	Exclude     []string      `json:"exclude,omitempty"`    // Globs (relative to the source) that the template does not own
+	Backup      *BackupPolicy `json:"backup,omitempty"`     // Snapshot the destination before clean mode removes it
+	Render      []string      `json:"render,omitempty"`     // Globs (relative to the source) rendered as Go text/template files
+	Sources     []string      `json:"sources,omitempty"`    // Additional source files, directories or globs relative to SourceMount
+	Rename      string        `json:"rename,omitempty"`     // File name for a single-file source inside TargetPath
+	Mode        string        `json:"mode,omitempty"`       // Octal or symbolic (u+rwX) mode for copied files (defaults to the source mode)
+	User        *int          `json:"user,omitempty"`       // Owner uid for copied files
+	Group       *int          `json:"group,omitempty"`      // Owner gid for copied files
+
+	PreserveAttributes *AttributePolicy `json:"preserveAttributes,omitempty"` // Source metadata carried over to copied files
+}
+
+// AttributePolicy selects source metadata carried over to copied template files.
+// Explicit Mode/User/Group settings take precedence over preserved values.
+type AttributePolicy struct {
+	Ownership  bool `json:"ownership,omitempty"`  // Copy the source uid/gid
+	Timestamps bool `json:"timestamps,omitempty"` // Copy the source atime/mtime
+	Xattrs     bool `json:"xattrs,omitempty"`     // Copy extended attributes (privileged namespaces need root)
+}
+
+// BackupPolicy controls snapshots of template destinations taken under MergeConfig.BackupRoot.
+type BackupPolicy struct {
+	Format string `json:"format,omitempty"` // "tar.gz" (default) or "dir"
+	Retain int    `json:"retain,omitempty"` // Snapshots kept per template (defaults to 5)
 }
 
 // PermissionPhase mirrors the subset of permissionsInit options that run during merges.
 type PermissionPhase struct {
-	ApplyDuringMerge bool     `json:"applyDuringMerge"`
-	ApplyPaths       []string `json:"applyPaths"`
-	User             int      `json:"user"`
-	Group            int      `json:"group"`
-	Mode             string   `json:"mode"`
+	ApplyDuringMerge bool             `json:"applyDuringMerge"`
+	ApplyPaths       []string         `json:"applyPaths"`
+	Rules            []PermissionRule `json:"rules"`                     // Ordered rules applied below every apply path
+	Parallelism      int              `json:"parallelism,omitempty"`     // Concurrent workers per apply path (default 1)
+	ProgressSeconds  int              `json:"progressSeconds,omitempty"` // Interval between progress log lines; 0 disables them
+}
+
+// PermissionRule sets ownership and modes for entries matching Path. Rules are
+// evaluated in order and every matching rule overrides the fields it sets.
+type PermissionRule struct {
+	Path      string `json:"path,omitempty"`      // Glob relative to the walked root; empty selects the root
+	User      *int   `json:"user,omitempty"`      // Owner uid
+	Group     *int   `json:"group,omitempty"`     // Owner gid
+	FileMode  string `json:"fileMode,omitempty"`  // Octal or symbolic (u+rwX) mode for regular files
+	DirMode   string `json:"dirMode,omitempty"`   // Octal or symbolic (u+rwX) mode for directories
+	Recursive *bool  `json:"recursive,omitempty"` // Also cover everything below matching directories (default true)
+
+	ACL        []string `json:"acl,omitempty"`        // Named POSIX ACL entries, e.g. user:1001:rwx; an empty list removes them
+	DefaultACL []string `json:"defaultAcl,omitempty"` // Default ACL entries inherited by new files in matching directories
 }
 
 // WatcherConfig configures the filesystem watcher sidecar.
@@ -74,10 +179,28 @@ type WatcherConfig struct {
 
 // PermissionJob defines a single chmod/chown pass executed inside an init container.
 type PermissionJob struct {
-	Path  string `json:"path"`
-	User  int    `json:"user"`
-	Group int    `json:"group"`
-	Mode  string `json:"mode"`
+	Path           string           `json:"path"`
+	Rules          []PermissionRule `json:"rules"`
+	Exclude        []string         `json:"exclude,omitempty"`        // Globs relative to Path that are skipped with everything below them
+	FollowSymlinks bool             `json:"followSymlinks,omitempty"` // Also fix the trees that symlinked directories point to
+}
+
+// PermissionConfig configures one permissions invocation: a single inline job,
+// a list of jobs, or both.
+type PermissionConfig struct {
+	PermissionJob
+	Jobs            []PermissionJob `json:"jobs,omitempty"`
+	Parallelism     int             `json:"parallelism,omitempty"`     // Concurrent workers per job (default 8)
+	ProgressSeconds int             `json:"progressSeconds,omitempty"` // Interval between progress log lines (default 10, negative disables)
+}
+
+// AllJobs returns the inline job, when it has a path, followed by Jobs.
+func (c PermissionConfig) AllJobs() []PermissionJob {
+	var jobs []PermissionJob
+	if strings.TrimSpace(c.Path) != "" {
+		jobs = append(jobs, c.PermissionJob)
+	}
+	return append(jobs, c.Jobs...)
 }
 
 // CopyJob models the entrypoint copy init container.
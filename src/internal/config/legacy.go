@@ -0,0 +1,70 @@
+package config
+
+import "encoding/json"
+
+// legacyPermissions holds the single owner and mode that permission jobs and
+// the merge permission phase took before ordered rules. Configurations that
+// still set them get an equivalent rule in front of their own rules instead of
+// silently changing nothing.
+type legacyPermissions struct {
+	User  *int   `json:"user"`
+	Group *int   `json:"group"`
+	Mode  string `json:"mode"`
+}
+
+// prepend returns rules led by the rule the legacy fields describe, if any.
+func (l legacyPermissions) prepend(rules []PermissionRule) []PermissionRule {
+	if l.User == nil && l.Group == nil && l.Mode == "" {
+		return rules
+	}
+	rule := PermissionRule{User: l.User, Group: l.Group, FileMode: l.Mode, DirMode: l.Mode}
+	return append([]PermissionRule{rule}, rules...)
+}
+
+// UnmarshalJSON decodes a job, translating the legacy user, group and mode
+// fields into a leading rule.
+func (j *PermissionJob) UnmarshalJSON(data []byte) error {
+	type plain PermissionJob
+	var legacy legacyPermissions
+	if err := json.Unmarshal(data, (*plain)(j)); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return err
+	}
+	j.Rules = legacy.prepend(j.Rules)
+	return nil
+}
+
+// UnmarshalJSON decodes the phase, translating the legacy user, group and mode
+// fields into a leading rule.
+func (p *PermissionPhase) UnmarshalJSON(data []byte) error {
+	type plain PermissionPhase
+	var legacy legacyPermissions
+	if err := json.Unmarshal(data, (*plain)(p)); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return err
+	}
+	p.Rules = legacy.prepend(p.Rules)
+	return nil
+}
+
+// UnmarshalJSON decodes the configuration. The embedded job's decoder would
+// otherwise be promoted and drop every other field.
+func (c *PermissionConfig) UnmarshalJSON(data []byte) error {
+	var rest struct {
+		Jobs            []PermissionJob `json:"jobs"`
+		Parallelism     int             `json:"parallelism"`
+		ProgressSeconds int             `json:"progressSeconds"`
+	}
+	if err := json.Unmarshal(data, &c.PermissionJob); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &rest); err != nil {
+		return err
+	}
+	c.Jobs, c.Parallelism, c.ProgressSeconds = rest.Jobs, rest.Parallelism, rest.ProgressSeconds
+	return nil
+}
@@ -0,0 +1,38 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestLegacyPermissionFieldsBecomeRules(t *testing.T) {
+	t.Setenv("PERMISSIONS_CONFIG", `{
+		"path": "/mnt/base", "user": 1000, "group": 1000, "mode": "775",
+		"rules": [{"path": "maps", "fileMode": "644"}],
+		"jobs": [{"path": "/mnt/base/data", "user": 1001}],
+		"parallelism": 4
+	}`)
+	cfg, err := FromEnv[PermissionConfig]("PERMISSIONS_CONFIG")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.Parallelism != 4 || len(cfg.Jobs) != 1 {
+		t.Fatalf("other fields lost: %+v", cfg)
+	}
+	rules := cfg.Rules
+	if len(rules) != 2 || rules[0].User == nil || *rules[0].User != 1000 || *rules[0].Group != 1000 ||
+		rules[0].FileMode != "775" || rules[0].DirMode != "775" || rules[1].Path != "maps" {
+		t.Errorf("inline job rules: %+v", rules)
+	}
+	if job := cfg.Jobs[0]; len(job.Rules) != 1 || *job.Rules[0].User != 1001 || job.Rules[0].Group != nil {
+		t.Errorf("extra job rules: %+v", job.Rules)
+	}
+
+	t.Setenv("MERGE_CONFIG", `{"permissions": {"applyDuringMerge": true, "mode": "g+w"}}`)
+	merge, err := FromEnv[MergeConfig]("MERGE_CONFIG")
+	if err != nil {
+		t.Fatalf("load merge config: %v", err)
+	}
+	if rules := merge.Permissions.Rules; !merge.Permissions.ApplyDuringMerge || len(rules) != 1 || rules[0].FileMode != "g+w" || rules[0].User != nil {
+		t.Errorf("merge phase rules: %+v", merge.Permissions)
+	}
+}
@@ -0,0 +1,259 @@
+package decompress
+
+import (
+	"archive/zip"
+	"compress/bzip2"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/UDL-TF/TF2Chart/src/internal/zstd"
+)
+
+// Zip compression methods beyond store and deflate seen in map packs.
+const (
+	zipMethodBzip2 = 12
+	zipMethodZstd  = 93
+)
+
+// archiveOutputRoot returns the directory an archive's content tree is
+// extracted into: the output directory, or for in-place runs the game
+// directory holding the archive (the parent of maps/ when it sits in one).
+// In-place extraction never leaves root, the path the archive was found below.
+func (d *Decompressor) archiveOutputRoot(root, srcPath string) string {
+	if d.outputDir != "" {
+		return d.outputDir
+	}
+	dir := filepath.Dir(srcPath)
+	if isContentDir(filepath.Base(dir)) {
+		parent := filepath.Dir(dir)
+		if rel, err := filepath.Rel(root, parent); err != nil || !filepath.IsLocal(rel) {
+			return filepath.Clean(root)
+		}
+		return parent
+	}
+	return dir
+}
+
+func isContentDir(name string) bool {
+	for _, dir := range contentDirs {
+		if strings.EqualFold(name, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// entryPath maps an archive entry onto the content tree, starting at its first
+// content directory: "MyPack/Maps/koth_foo.bsp" becomes "maps/koth_foo.bsp".
+// It returns "" for entries outside any content directory, and ErrUnsafePath
+// for names that could escape the extraction root.
+func entryPath(name string) (string, error) {
+	slashed := strings.ReplaceAll(name, `\`, "/")
+	if path.IsAbs(slashed) || filepath.VolumeName(slashed) != "" {
+		return "", fmt.Errorf("%w: %q is absolute", ErrUnsafePath, name)
+	}
+	parts := strings.Split(slashed, "/")
+	for _, part := range parts {
+		if part == ".." {
+			return "", fmt.Errorf("%w: %q leaves its directory", ErrUnsafePath, name)
+		}
+	}
+	for i, part := range parts[:len(parts)-1] {
+		if isContentDir(part) {
+			rel := path.Join(append([]string{strings.ToLower(part)}, parts[i+1:]...)...)
+			if !filepath.IsLocal(rel) {
+				return "", fmt.Errorf("%w: %q is not a local path", ErrUnsafePath, name)
+			}
+			return filepath.FromSlash(rel), nil
+		}
+	}
+	return "", nil
+}
+
+// archiveEntry is a zip entry planned for extraction.
+type archiveEntry struct {
+	name    string
+	outPath string
+}
+
+// archivePlan lists the entries an archive job extracts. Run resolves it
+// before any work starts, so entries that another source already produces are
+// left out.
+type archivePlan struct {
+	entries []archiveEntry
+	skipped int
+}
+
+// openArchive opens the zip archive at srcPath with the compression methods
+// of map packs registered. The caller closes the returned file.
+func openArchive(srcPath string, size int64) (*os.File, *zip.Reader, error) {
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open: %w", err)
+	}
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("read zip: %w", err)
+	}
+	zr.RegisterDecompressor(zipMethodBzip2, func(r io.Reader) io.ReadCloser {
+		return io.NopCloser(bzip2.NewReader(r))
+	})
+	zr.RegisterDecompressor(zipMethodZstd, func(r io.Reader) io.ReadCloser {
+		z, err := zstd.NewReader(r)
+		if err != nil {
+			return io.NopCloser(&errReader{err})
+		}
+		return io.NopCloser(z)
+	})
+	return f, zr, nil
+}
+
+// planArchiveFile plans the extraction of the zip archive at srcPath into
+// outRoot.
+func planArchiveFile(srcPath, outRoot string) (*archivePlan, error) {
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return nil, fmt.Errorf("stat: %w", err)
+	}
+	f, zr, err := openArchive(srcPath, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return planArchive(zr, srcPath, outRoot)
+}
+
+// planArchive maps the entries of zr below outRoot. Entries outside content
+// directories are skipped; one unsafe name rejects the whole archive before
+// anything is written.
+func planArchive(zr *zip.Reader, srcPath, outRoot string) (*archivePlan, error) {
+	plan := &archivePlan{}
+	seen := make(map[string]string)
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		rel, err := entryPath(zf.Name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", srcPath, err)
+		}
+		if rel == "" || !zf.Mode().IsRegular() {
+			log.Printf("decompressor: skipping %s:%s (not a file in a content directory)", srcPath, zf.Name)
+			plan.skipped++
+			continue
+		}
+		outPath := filepath.Join(outRoot, rel)
+		if within, err := filepath.Rel(outRoot, outPath); err != nil || !filepath.IsLocal(within) {
+			return nil, fmt.Errorf("%s: %w: %q resolves outside %s", srcPath, ErrUnsafePath, zf.Name, outRoot)
+		}
+		if first, ok := seen[outPath]; ok {
+			log.Printf("decompressor: warning - %s:%s and %s both produce %s, keeping %s", srcPath, first, zf.Name, outPath, first)
+			continue
+		}
+		seen[outPath] = zf.Name
+		plan.entries = append(plan.entries, archiveEntry{name: zf.Name, outPath: outPath})
+	}
+	return plan, nil
+}
+
+// extractArchive extracts the planned entries of the zip archive at srcPath,
+// found below root. Every entry is written atomically and has its own
+// manifest record, so only entries that are missing, damaged or from an older
+// version of the archive are extracted again.
+func (d *Decompressor) extractArchive(root, srcPath string, plan *archivePlan) error {
+	fp, err := fingerprint(srcPath)
+	if err != nil {
+		return fmt.Errorf("stat: %w", err)
+	}
+
+	f, zr, err := openArchive(srcPath, fp.size)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	files := make(map[string]*zip.File, len(zr.File))
+	for _, zf := range zr.File {
+		if _, ok := files[zf.Name]; !ok {
+			files[zf.Name] = zf
+		}
+	}
+
+	m := d.manifestFor(root)
+	var extracted, cached int
+	for _, e := range plan.entries {
+		if d.upToDate(m, e.outPath, fp) {
+			cached++
+			continue
+		}
+		zf := files[e.name]
+		if zf == nil {
+			return fmt.Errorf("extract %s: entry disappeared while scanning", e.name)
+		}
+		if err := d.extractEntry(m, fp, srcPath, zf, e.outPath); err != nil {
+			return fmt.Errorf("extract %s: %w", e.name, err)
+		}
+		extracted++
+	}
+
+	log.Printf("decompressor: %s: %d entries extracted, %d already up to date, %d skipped",
+		srcPath, extracted, cached, plan.skipped)
+	return nil
+}
+
+// extractEntry writes one archive entry to outPath and records it.
+func (d *Decompressor) extractEntry(m *manifest, fp sourceFingerprint, srcPath string, zf *zip.File, outPath string) error {
+	log.Printf("decompressor: extracting %s:%s -> %s", srcPath, zf.Name, outPath)
+	source := srcPath + ":" + zf.Name
+
+	// Reject entries whose declared size already breaks the limits
+	declared := int64(zf.UncompressedSize64)
+	if d.limits.MaxFileBytes > 0 && declared > d.limits.MaxFileBytes {
+		return fmt.Errorf("%w: %s: declared size %d exceeds %d bytes", ErrLimitExceeded, source, declared, d.limits.MaxFileBytes)
+	}
+	if err := d.checkFreeSpace(source, filepath.Dir(outPath), declared); err != nil {
+		return err
+	}
+
+	rc, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	// The zip reader checks the entry's CRC-32 once it reaches the end
+	sum, err := writeAtomic(outPath, 0o644, func(w io.Writer) error {
+		gw, err := d.guard(w, source, outPath, int64(zf.CompressedSize64))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(d.limiter.writer(gw), rc)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	srcSum, err := fp.sha256()
+	if err != nil {
+		return fmt.Errorf("hash source: %w", err)
+	}
+	rec, err := fp.newRecord(source, outPath, srcSum, sum)
+	if err != nil {
+		return fmt.Errorf("stat output: %w", err)
+	}
+	if err := m.record(outPath, rec); err != nil {
+		log.Printf("decompressor: warning - failed to update manifest %s: %v", m.path, err)
+	}
+	return nil
+}
+
+// errReader fails every read with err.
+type errReader struct{ err error }
+
+func (r *errReader) Read([]byte) (int, error) { return 0, r.err }
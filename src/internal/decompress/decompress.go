@@ -2,19 +2,68 @@ package decompress
 
 import (
 	"compress/bzip2"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
-	"sort"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Decompressor handles .bz2 file decompression and split map reassembly.
+// Decompressor handles compressed file decompression, archive extraction and
+// split map reassembly.
 type Decompressor struct {
 	paths     []string
 	outputDir string // Output directory for decompressed files (preserves structure)
+	verify    bool   // Re-hash cached outputs instead of trusting size and mtime
+	hashSrc   bool   // Compare the hash of compressed sources, not just size and mtime
+	workers   int
+	priority  Priority
+	limiter   *rateLimiter // nil when output throughput is unlimited
+	limits    Limits
+	total     atomic.Int64 // bytes written by the current Run, for Limits.MaxTotalBytes
+
+	manifestsMu sync.Mutex
+	manifests   map[string]*manifest // keyed by manifest path
+}
+
+// Options configures a Decompressor.
+type Options struct {
+	OutputDir     string // Output directory for decompressed files; empty decompresses in place
+	VerifyContent bool   // Check the SHA-256 of cached outputs before reusing them
+	HashSources   bool   // Check the SHA-256 of compressed sources before reusing their outputs
+	Workers       int    // Concurrent decompressions (default 1)
+	// MaxBytesPerSecond caps decompressed output across all workers; 0 is unlimited.
+	MaxBytesPerSecond int64
+	Priority          Priority // Scheduling priority of the worker threads
+	Limits            Limits   // Bounds on output size, compression ratio and disk usage
+}
+
+// Priority lowers the CPU and I/O priority of decompression workers so that
+// runtime decompression does not compete with the game server. Only the
+// worker threads are affected, never the rest of the process.
+type Priority struct {
+	Nice    int    // Nice value for worker threads, 1 (slightly lower) to 19 (lowest)
+	IOClass string // I/O scheduling class: "best-effort", "idle" or "realtime"; empty keeps the default
+	IOLevel int    // Level within the best-effort or realtime class, 0 (highest) to 7
+}
+
+// job is one unit of work found while scanning: a compressed file, an archive
+// or a split map folder.
+type job struct {
+	root   string // scanned path the job was found below
+	source string
+	output string       // output file, or the directory an archive is extracted into
+	format *format      // nil for split map folders
+	plan   *archivePlan // archive entries to extract, resolved by Run
 }
 
 // New creates a new Decompressor for the given paths.
@@ -26,13 +75,65 @@ func New(paths []string) *Decompressor {
 // If outputDir is empty, files are decompressed in-place (original behavior).
 // If outputDir is set, files are decompressed to outputDir with preserved directory structure.
 func NewWithOutputDir(paths []string, outputDir string) *Decompressor {
+	return NewWithOptions(paths, Options{OutputDir: outputDir})
+}
+
+// NewWithOptions creates a new Decompressor with the given options.
+func NewWithOptions(paths []string, opts Options) *Decompressor {
 	return &Decompressor{
 		paths:     paths,
-		outputDir: outputDir,
+		outputDir: opts.OutputDir,
+		verify:    opts.VerifyContent,
+		hashSrc:   opts.HashSources,
+		workers:   max(opts.Workers, 1),
+		priority:  opts.Priority,
+		limiter:   newRateLimiter(opts.MaxBytesPerSecond),
+		limits:    opts.Limits,
+		manifests: make(map[string]*manifest),
+	}
+}
+
+// manifestFor returns the manifest covering outputs produced while scanning
+// root: one per output directory, or one per scanned root for in-place runs.
+func (d *Decompressor) manifestFor(root string) *manifest {
+	dir := d.outputDir
+	if dir == "" {
+		dir = root
+	}
+	path := filepath.Join(dir, ManifestName)
+	d.manifestsMu.Lock()
+	defer d.manifestsMu.Unlock()
+	m, ok := d.manifests[path]
+	if !ok {
+		m = loadManifest(path)
+		d.manifests[path] = m
+	}
+	return m
+}
+
+// upToDate reports whether outPath was produced from the source fp describes
+// and is still intact, logging why it is about to be replaced otherwise.
+func (d *Decompressor) upToDate(m *manifest, outPath string, fp sourceFingerprint) bool {
+	rec, ok := m.lookup(outPath)
+	if !ok {
+		if _, err := os.Stat(outPath); err == nil {
+			log.Printf("decompressor: %s has no manifest record, decompressing again", outPath)
+		}
+		return false
+	}
+	if change := fp.changedFrom(rec, d.hashSrc); change != "" {
+		log.Printf("decompressor: source %s changed (%s), replacing %s", rec.Source, change, outPath)
+		return false
+	}
+	if !rec.valid(outPath, d.verify) {
+		log.Printf("decompressor: %s does not match its manifest record, decompressing again", outPath)
+		return false
 	}
+	return true
 }
 
-// Run scans configured paths for .bz2 files and split maps, then decompresses them.
+// Run scans configured paths for compressed files, archives and split maps,
+// then decompresses them with the configured number of workers.
 func (d *Decompressor) Run() error {
 	if len(d.paths) == 0 {
 		log.Printf("decompressor: no paths configured, skipping")
@@ -40,44 +141,138 @@ func (d *Decompressor) Run() error {
 	}
 
 	log.Printf("decompressor: scanning paths: %v", d.paths)
+	if d.outputDir != "" {
+		removePartials(d.outputDir)
+	}
 
-	var totalDecompressed int
-	var totalSplitMaps int
-
+	// Discover everything first so workers never contend with the walk and
+	// duplicate outputs can be resolved up front.
+	var jobs []job
+	outputs := make(map[string]string)
 	for _, scanPath := range d.paths {
-		decomp, split, err := d.scanAndDecompress(scanPath)
+		found, err := d.scan(scanPath)
 		if err != nil {
 			return fmt.Errorf("decompress path %s: %w", scanPath, err)
 		}
-		totalDecompressed += decomp
-		totalSplitMaps += split
+		for _, j := range found {
+			if j.format != nil && j.format.archive {
+				// Archive entries compete for outputs like any other source
+				plan, err := planArchiveFile(j.source, j.output)
+				if err != nil {
+					log.Printf("decompressor: error extracting %s: %v", j.source, err)
+					continue
+				}
+				kept := plan.entries[:0]
+				for _, e := range plan.entries {
+					source := j.source + ":" + e.name
+					if first, ok := outputs[e.outPath]; ok {
+						log.Printf("decompressor: warning - %s and %s both produce %s, keeping %s", first, source, e.outPath, first)
+						plan.skipped++
+						continue
+					}
+					outputs[e.outPath] = source
+					kept = append(kept, e)
+				}
+				plan.entries = kept
+				j.plan = plan
+				jobs = append(jobs, j)
+				continue
+			}
+			if first, ok := outputs[j.output]; ok {
+				log.Printf("decompressor: warning - %s and %s both produce %s, keeping %s", first, j.source, j.output, first)
+				continue
+			}
+			outputs[j.output] = j.source
+			jobs = append(jobs, j)
+		}
 	}
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	d.total.Store(0)
+	totalDecompressed, totalExtracted, totalSplitMaps := d.process(jobs)
 
-	if totalDecompressed > 0 || totalSplitMaps > 0 {
-		log.Printf("decompressor: completed - %d files decompressed, %d split maps reassembled",
-			totalDecompressed, totalSplitMaps)
+	if totalDecompressed > 0 || totalExtracted > 0 || totalSplitMaps > 0 {
+		log.Printf("decompressor: completed - %d files decompressed, %d archives extracted, %d split maps reassembled in %s",
+			totalDecompressed, totalExtracted, totalSplitMaps, time.Since(start).Round(time.Millisecond))
 	}
 
 	return nil
 }
 
-func (d *Decompressor) scanAndDecompress(rootPath string) (int, int, error) {
+// process runs jobs on a pool of workers and counts the ones that succeeded.
+// Failures are logged and do not stop the remaining jobs.
+func (d *Decompressor) process(jobs []job) (int, int, int) {
+	workers := min(d.workers, len(jobs))
+	log.Printf("decompressor: processing %d archives with %d workers", len(jobs), workers)
+
+	queue := make(chan job)
+	var files, archives, splits atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if d.priority != (Priority{}) {
+				// The thread is never unlocked, so the runtime discards it,
+				// along with its lowered priority, when the worker exits.
+				runtime.LockOSThread()
+				if err := setThreadPriority(d.priority); err != nil {
+					log.Printf("decompressor: warning - %v", err)
+				}
+			}
+			for j := range queue {
+				switch {
+				case j.format == nil:
+					if err := d.processSplitMap(j.root, j.source, j.output); err != nil {
+						log.Printf("decompressor: error processing split map %s: %v", j.source, err)
+						continue
+					}
+					splits.Add(1)
+				case j.format.archive:
+					if err := d.extractArchive(j.root, j.source, j.plan); err != nil {
+						log.Printf("decompressor: error extracting %s: %v", j.source, err)
+						continue
+					}
+					archives.Add(1)
+				default:
+					if err := d.decompressFile(j.root, j.source, j.output, j.format); err != nil {
+						log.Printf("decompressor: error decompressing %s: %v", j.source, err)
+						continue
+					}
+					files.Add(1)
+				}
+			}
+		}()
+	}
+	for _, j := range jobs {
+		queue <- j
+	}
+	close(queue)
+	wg.Wait()
+	return int(files.Load()), int(archives.Load()), int(splits.Load())
+}
+
+// scan walks rootPath and returns the compressed files, archives and split map
+// folders below it.
+func (d *Decompressor) scan(rootPath string) ([]job, error) {
 	info, err := os.Stat(rootPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			log.Printf("decompressor: path %s does not exist, skipping", rootPath)
-			return 0, 0, nil
+			return nil, nil
 		}
-		return 0, 0, fmt.Errorf("stat %s: %w", rootPath, err)
+		return nil, fmt.Errorf("stat %s: %w", rootPath, err)
 	}
 
 	if !info.IsDir() {
 		log.Printf("decompressor: path %s is not a directory, skipping", rootPath)
-		return 0, 0, nil
+		return nil, nil
 	}
 
-	var fileCount int
-	var splitMapCount int
+	var jobs []job
 
 	log.Printf("decompressor: scanning %s recursively", rootPath)
 
@@ -93,264 +288,318 @@ func (d *Decompressor) scanAndDecompress(rootPath string) (int, int, error) {
 			lowerName := strings.ToLower(info.Name())
 			if strings.HasSuffix(lowerName, ".bsp") || strings.HasSuffix(lowerName, ".bsp.bz2.parts") {
 				log.Printf("decompressor: found split map folder: %s", path)
-				if err := d.processSplitMap(path); err != nil {
-					log.Printf("decompressor: error processing split map %s: %v", path, err)
-				} else {
-					splitMapCount++
-				}
+				jobs = append(jobs, job{root: rootPath, source: path, output: d.splitOutputPath(path)})
 				return filepath.SkipDir // Don't descend into split map folders
 			}
 			return nil // Continue into other directories
 		}
 
-		// Check if file ends with .bz2
-		if !strings.HasSuffix(strings.ToLower(info.Name()), ".bz2") {
+		// Writes interrupted by a crash are never finished; start them over
+		if info.Mode().IsRegular() && IsPartial(info.Name()) {
+			removePartial(path)
 			return nil
 		}
 
-		log.Printf("decompressor: found bz2 file: %s", path)
-
-		// Decompress the file
-		if err := d.decompressFile(path); err != nil {
-			log.Printf("decompressor: error decompressing %s: %v", path, err)
+		// Check for a registered archive format
+		f := formatFor(info.Name())
+		if f == nil {
 			return nil
 		}
 
-		fileCount++
+		if f.archive {
+			log.Printf("decompressor: found %s archive: %s", strings.TrimPrefix(f.ext, "."), path)
+			jobs = append(jobs, job{root: rootPath, source: path, output: d.archiveOutputRoot(rootPath, path), format: f})
+			return nil
+		}
+		log.Printf("decompressor: found %s file: %s", strings.TrimPrefix(f.ext, "."), path)
+		jobs = append(jobs, job{root: rootPath, source: path, output: d.fileOutputPath(path, f), format: f})
 		return nil
 	})
 
 	if err != nil {
-		return fileCount, splitMapCount, fmt.Errorf("walk %s: %w", rootPath, err)
+		return jobs, fmt.Errorf("walk %s: %w", rootPath, err)
 	}
 
-	return fileCount, splitMapCount, nil
+	return dropLeftovers(jobs), nil
 }
 
-// decompressFile decompresses a .bz2 file
-func (d *Decompressor) decompressFile(bzipPath string) error {
-	// Determine output path first
-	var outPath string
+// dropLeftovers removes the jobs for concatenated archives that earlier
+// versions left next to split maps assembled in place. The split job deletes
+// them; any other file ending in leftoverSuffix is decompressed as usual.
+func dropLeftovers(jobs []job) []job {
+	leftovers := make(map[string]bool)
+	for _, j := range jobs {
+		if j.format == nil {
+			leftovers[j.output+leftoverSuffix] = true
+		}
+	}
+	kept := jobs[:0]
+	for _, j := range jobs {
+		if j.format != nil && leftovers[j.source] {
+			continue
+		}
+		kept = append(kept, j)
+	}
+	return kept
+}
+
+// fileOutputPath returns where the compressed file at srcPath is decompressed to.
+func (d *Decompressor) fileOutputPath(srcPath string, f *format) string {
+	// Remove the extension, whatever its case
+	outPath := srcPath[:len(srcPath)-len(f.ext)]
 	if d.outputDir != "" {
 		// Decompress to output directory, preserving structure
-		outPath = d.getOutputPath(bzipPath)
-	} else {
-		// Decompress in-place (remove .bz2 extension)
-		outPath = strings.TrimSuffix(bzipPath, ".bz2")
-		if outPath == bzipPath {
-			// Fallback in case extension is different case
-			outPath = bzipPath[:len(bzipPath)-4]
-		}
+		return d.getOutputPath(outPath)
 	}
+	// Decompress in-place
+	return outPath
+}
 
-	// Check if decompressed file already exists (caching)
-	if _, err := os.Stat(outPath); err == nil {
-		log.Printf("decompressor: skipping %s (already decompressed at %s)", bzipPath, outPath)
-		return nil
+// splitOutputPath returns where the split map in folderPath is assembled.
+func (d *Decompressor) splitOutputPath(folderPath string) string {
+	outputName := filepath.Base(folderPath)
+	if strings.HasSuffix(strings.ToLower(outputName), ".bsp.bz2.parts") {
+		outputName = outputName[:len(outputName)-len(".bz2.parts")]
 	}
+	if d.outputDir != "" {
+		// Output to cache directory with preserved structure
+		return d.getOutputPath(filepath.Join(folderPath, outputName))
+	}
+	// Output in-place
+	return filepath.Join(filepath.Dir(folderPath), outputName)
+}
 
-	// Open the bzip2 file
-	inFile, err := os.Open(bzipPath)
+// decompressFile decompresses a single-file archive of format f found below
+// root. The output is written atomically and recorded in the manifest; an
+// existing output is only reused while both it and its source still match the
+// manifest record.
+func (d *Decompressor) decompressFile(root, srcPath, outPath string, f *format) error {
+	fp, err := fingerprint(srcPath)
 	if err != nil {
-		return fmt.Errorf("open: %w", err)
+		return fmt.Errorf("stat: %w", err)
 	}
-	defer inFile.Close()
 
-	log.Printf("decompressor: decompressing %s -> %s", bzipPath, outPath)
+	// Reuse the output only when the manifest vouches for it
+	m := d.manifestFor(root)
+	if d.upToDate(m, outPath, fp) {
+		log.Printf("decompressor: skipping %s (already decompressed at %s)", srcPath, outPath)
+		return nil
+	}
 
-	// Create output file
-	outFile, err := os.Create(outPath)
+	// Open the compressed file
+	inFile, err := os.Open(srcPath)
 	if err != nil {
-		return fmt.Errorf("create output: %w", err)
+		return fmt.Errorf("open: %w", err)
 	}
-	defer outFile.Close()
+	defer inFile.Close()
 
-	// Create bzip2 reader
-	bzReader := bzip2.NewReader(inFile)
+	log.Printf("decompressor: decompressing %s -> %s", srcPath, outPath)
 
-	// Copy decompressed data
-	written, err := io.Copy(outFile, bzReader)
+	// Decompress into a temporary file that replaces outPath only once complete
+	var written int64
+	srcHash := sha256.New()
+	sum, err := writeAtomic(outPath, 0o644, func(w io.Writer) error {
+		src := io.TeeReader(inFile, srcHash)
+		r, err := f.decode(src)
+		if err != nil {
+			return err
+		}
+		gw, err := d.guard(w, srcPath, outPath, fp.size)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(d.limiter.writer(gw), r)
+		written = n
+		if err != nil {
+			return err
+		}
+		// Hash any trailing bytes the decoder left unread
+		_, err = io.Copy(io.Discard, src)
+		return err
+	})
 	if err != nil {
-		outFile.Close()
-		os.Remove(outPath) // Clean up partial file
 		return fmt.Errorf("decompress: %w", err)
 	}
 
-	// Close output file before removing source
-	if err := outFile.Close(); err != nil {
-		return fmt.Errorf("close output: %w", err)
+	rec, err := fp.newRecord(srcPath, outPath, hex.EncodeToString(srcHash.Sum(nil)), sum)
+	if err != nil {
+		return fmt.Errorf("stat output: %w", err)
+	}
+	if err := m.record(outPath, rec); err != nil {
+		log.Printf("decompressor: warning - failed to update manifest %s: %v", m.path, err)
 	}
 
 	log.Printf("decompressor: decompressed %d bytes", written)
 
-	// Keep the source .bz2 file - do not delete it
-	log.Printf("decompressor: kept source file %s", bzipPath)
+	// Keep the source file - do not delete it
+	log.Printf("decompressor: kept source file %s", srcPath)
 
 	return nil
 }
 
-// processSplitMap processes split map
-func (d *Decompressor) processSplitMap(folderPath string) error {
-	// Determine output file name first
-	folderName := filepath.Base(folderPath)
-	outputName := folderName
-	if strings.HasSuffix(strings.ToLower(outputName), ".bsp.bz2.parts") {
-		outputName = outputName[:len(outputName)-len(".bz2.parts")]
-	}
-
-	// Determine output path based on outputDir setting
-	var outputPath string
-	if d.outputDir != "" {
-		// Output to cache directory with preserved structure
-		outputPath = d.getOutputPath(filepath.Join(folderPath, outputName))
-	} else {
-		// Output in-place
-		outputPath = filepath.Join(filepath.Dir(folderPath), outputName)
+// processSplitMap reassembles the split map in folderPath, found below root.
+// Like single archives, the output is reused only while the manifest record
+// matches both it and the set of parts it was assembled from.
+func (d *Decompressor) processSplitMap(root, folderPath, outputPath string) error {
+	// Find the .bz2.part.N files in numeric order
+	partFiles, err := listParts(folderPath)
+	if err != nil {
+		return err
 	}
 
-	// Check if assembled file already exists (caching)
-	if _, err := os.Stat(outputPath); err == nil {
-		log.Printf("decompressor: skipping split map %s (already assembled at %s)", folderPath, outputPath)
+	if len(partFiles) == 0 {
+		log.Printf("decompressor: warning - no .bz2.part.* files found in %s", folderPath)
 		return nil
 	}
 
-	// Read all files in the folder
-	entries, err := os.ReadDir(folderPath)
+	pm, err := readPartsManifest(folderPath)
 	if err != nil {
-		return fmt.Errorf("read dir: %w", err)
+		return err
+	}
+	if pm != nil && pm.count() != 0 && pm.count() != len(partFiles) {
+		return fmt.Errorf("found %d parts, %s expects %d", len(partFiles), partsManifestName, pm.count())
 	}
 
-	// Find all .bz2.part.* files
-	var partFiles []string
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
-		name := entry.Name()
-		if strings.Contains(name, ".bz2.part.") {
-			partFiles = append(partFiles, filepath.Join(folderPath, name))
-		}
+	fp, err := fingerprint(partFiles...)
+	if err != nil {
+		return fmt.Errorf("stat parts: %w", err)
 	}
 
-	if len(partFiles) == 0 {
-		log.Printf("decompressor: warning - no .bz2.part.* files found in %s", folderPath)
+	// Earlier versions left the concatenated parts next to the output
+	removeLeftover(outputPath + leftoverSuffix)
+
+	// Reuse the assembled map only when the manifest vouches for it and it is
+	// the map the parts manifest describes
+	m := d.manifestFor(root)
+	if rec, ok := m.lookup(outputPath); ok && pm != nil && pm.SHA256 != "" && rec.SHA256 != pm.SHA256 {
+		log.Printf("decompressor: %s does not match %s in %s, assembling again", outputPath, partsManifestName, folderPath)
+	} else if d.upToDate(m, outputPath, fp) {
+		log.Printf("decompressor: skipping split map %s (already assembled at %s)", folderPath, outputPath)
 		return nil
 	}
 
-	// Sort files by name to ensure chronological order
-	sort.Strings(partFiles)
 	log.Printf("decompressor: found %d part files in %s", len(partFiles), folderPath)
-
-	// The output paths were already determined at the start
-	tempOutputPath := outputPath + ".tmp"
-
 	log.Printf("decompressor: assembling split map: %s -> %s", folderPath, outputPath)
 
-	// Create temporary concatenated bz2 file
-	concatBz2Path := tempOutputPath + ".bz2"
-	concatFile, err := os.Create(concatBz2Path)
-	if err != nil {
-		return fmt.Errorf("create concat file: %w", err)
-	}
-
-	var totalConcatenated int64
-
-	// Concatenate all part files into a single bz2 file
-	for i, partPath := range partFiles {
-		log.Printf("decompressor: concatenating part %d/%d: %s", i+1, len(partFiles), filepath.Base(partPath))
-
+	// Open every part up front so the stream is read straight from them
+	parts := make([]io.Reader, 0, len(partFiles))
+	partSums := make([]hash.Hash, 0, len(partFiles))
+	for _, partPath := range partFiles {
 		partFile, err := os.Open(partPath)
 		if err != nil {
-			concatFile.Close()
-			os.Remove(concatBz2Path)
 			return fmt.Errorf("open part %s: %w", partPath, err)
 		}
+		defer partFile.Close()
+		partSum := sha256.New()
+		parts = append(parts, io.TeeReader(partFile, partSum))
+		partSums = append(partSums, partSum)
+	}
 
-		written, err := io.Copy(concatFile, partFile)
-		partFile.Close()
+	// Decompress the parts as one bz2 stream into a temporary file that
+	// replaces outputPath only once complete
+	var totalWritten int64
+	srcHash := sha256.New()
+	sum, err := writeAtomic(outputPath, 0o644, func(w io.Writer) error {
+		gw, err := d.guard(w, folderPath, outputPath, fp.size)
 		if err != nil {
-			concatFile.Close()
-			os.Remove(concatBz2Path)
-			return fmt.Errorf("concatenate part %s: %w", partPath, err)
+			return err
 		}
-
-		totalConcatenated += written
-		log.Printf("decompressor: concatenated %d bytes from part %d", written, i+1)
-	}
-
-	// Close concatenated file
-	if err := concatFile.Close(); err != nil {
-		os.Remove(concatBz2Path)
-		return fmt.Errorf("close concat file: %w", err)
+		outSum := sha256.New()
+		src := io.TeeReader(io.MultiReader(parts...), srcHash)
+		n, err := io.Copy(io.MultiWriter(d.limiter.writer(gw), outSum), bzip2.NewReader(src))
+		totalWritten = n
+		if err != nil {
+			return err
+		}
+		// Hash any trailing bytes the decoder left unread
+		if _, err := io.Copy(io.Discard, src); err != nil {
+			return err
+		}
+		// A map that fails the parts manifest never replaces outputPath
+		if pm == nil {
+			return nil
+		}
+		if err := pm.verifyParts(partFiles, partSums); err != nil {
+			return err
+		}
+		if got := hex.EncodeToString(outSum.Sum(nil)); pm.SHA256 != "" && got != pm.SHA256 {
+			return fmt.Errorf("assembled map SHA-256 %s does not match %s %s", got, partsManifestName, pm.SHA256)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("decompress: %w", err)
 	}
 
-	log.Printf("decompressor: concatenated %d bytes total into temporary bz2 file", totalConcatenated)
+	log.Printf("decompressor: assembled %s: %d bytes total from %d compressed bytes", outputPath, totalWritten, fp.size)
 
-	// Now decompress the concatenated bz2 file
-	bzFile, err := os.Open(concatBz2Path)
+	rec, err := fp.newRecord(folderPath, outputPath, hex.EncodeToString(srcHash.Sum(nil)), sum)
 	if err != nil {
-		os.Remove(concatBz2Path)
-		return fmt.Errorf("open concat bz2: %w", err)
+		return fmt.Errorf("stat output: %w", err)
 	}
-	defer bzFile.Close()
-
-	// Create temporary output file
-	outFile, err := os.Create(tempOutputPath)
-	if err != nil {
-		os.Remove(concatBz2Path)
-		return fmt.Errorf("create output: %w", err)
+	if err := m.record(outputPath, rec); err != nil {
+		log.Printf("decompressor: warning - failed to update manifest %s: %v", m.path, err)
 	}
-	defer outFile.Close()
 
-	var totalWritten int64
+	// Keep the parts folder - do not delete it
+	log.Printf("decompressor: kept parts folder %s", folderPath)
+	log.Printf("decompressor: created final output: %s", outputPath)
 
-	// Create bzip2 reader and decompress
-	bzReader := bzip2.NewReader(bzFile)
-	totalWritten, err = io.Copy(outFile, bzReader)
-	if err != nil {
-		outFile.Close()
-		os.Remove(tempOutputPath)
-		os.Remove(concatBz2Path)
-		return fmt.Errorf("decompress: %w", err)
-	}
+	return nil
+}
 
-	// Close files
-	bzFile.Close()
-	if err := outFile.Close(); err != nil {
-		os.Remove(tempOutputPath)
-		os.Remove(concatBz2Path)
-		return fmt.Errorf("close output: %w", err)
+// leftoverSuffix marks the concatenated split map archives that earlier
+// versions wrote next to assembled maps and never removed.
+const leftoverSuffix = ".tmp.bz2"
+
+// removeLeftover deletes a concatenated archive left by an earlier version.
+func removeLeftover(path string) {
+	err := os.Remove(path)
+	switch {
+	case err == nil:
+		log.Printf("decompressor: removed leftover concatenated archive %s", path)
+	case !os.IsNotExist(err):
+		log.Printf("decompressor: warning - failed to remove leftover %s: %v", path, err)
 	}
+}
 
-	log.Printf("decompressor: assembled %s: %d bytes total", outputPath, totalWritten)
-
-	// Keep the temporary concatenated bz2 file and parts folder - do not delete them
-	log.Printf("decompressor: kept concatenated file %s and parts folder %s", concatBz2Path, folderPath)
+// removePartials deletes the temporary files of interrupted writes below dir.
+func removePartials(dir string) {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() && IsPartial(d.Name()) {
+			removePartial(path)
+		}
+		return nil
+	})
+}
 
-	// Rename temp file to final output
-	if err := os.Rename(tempOutputPath, outputPath); err != nil {
-		return fmt.Errorf("rename temp file: %w", err)
+// removePartial deletes the temporary file of an interrupted write.
+func removePartial(path string) {
+	err := os.Remove(path)
+	switch {
+	case err == nil:
+		log.Printf("decompressor: removed %s left by an interrupted write", path)
+	case !os.IsNotExist(err):
+		log.Printf("decompressor: warning - failed to remove stale %s: %v", path, err)
 	}
-	log.Printf("decompressor: created final output: %s", outputPath)
-
-	return nil
 }
 
-// getOutputPath determines the output path for a decompressed file
+// contentDirs are the common TF2 content directories whose structure is
+// preserved in outputs.
+var contentDirs = []string{"maps", "cfg", "materials", "models", "sound", "particles", "resource", "scripts", "media", "custom"}
+
+// getOutputPath determines the output path for a decompressed file, given its
+// path with the compression extension already removed.
 // Preserves one level of directory structure (e.g., maps/, cfg/, materials/)
-func (d *Decompressor) getOutputPath(bzipPath string) string {
-	// Remove .bz2 extension from filename
-	decompressedName := strings.TrimSuffix(filepath.Base(bzipPath), ".bz2")
+func (d *Decompressor) getOutputPath(decompressedPath string) string {
+	decompressedName := filepath.Base(decompressedPath)
 
 	// Try to detect the content type directory (maps, cfg, materials, etc.)
 	// by looking for common TF2 directories in the path
 	var subDir string
-	absPath, _ := filepath.Abs(bzipPath)
+	absPath, _ := filepath.Abs(decompressedPath)
 	pathLower := strings.ToLower(absPath)
 
-	// Common TF2 content directories to preserve
-	contentDirs := []string{"maps", "cfg", "materials", "models", "sound", "particles", "resource", "scripts", "media", "custom"}
-
 	for _, dir := range contentDirs {
 		// Look for /dirName/ in the path
 		pattern := fmt.Sprintf("/%s/", dir)
@@ -1,9 +1,20 @@
 package decompress
 
 import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestDecompressor_Run(t *testing.T) {
@@ -81,3 +92,677 @@ func TestDecompressor_WithOutputDir(t *testing.T) {
 
 	t.Logf("Decompressor with output directory test completed")
 }
+
+// TestDecompressor_RemovesStalePartials tests that temporary files of writes
+// interrupted by a crash are removed from scanned paths and the output
+// directory, while other hidden files stay.
+func TestDecompressor_RemovesStalePartials(t *testing.T) {
+	srcDir := t.TempDir()
+	outDir := t.TempDir()
+	writeBz2(t, filepath.Join(srcDir, "maps", "koth_foo.bsp.bz2"), helloBz2)
+	stale := []string{
+		filepath.Join(srcDir, "maps", ".koth_old.bsp.partial"),
+		filepath.Join(outDir, "."+ManifestName+".partial"),
+		filepath.Join(outDir, "maps", ".koth_foo.bsp.partial"),
+	}
+	kept := filepath.Join(srcDir, "maps", ".keep")
+	for _, path := range append(stale, kept) {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte("half"), 0o644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+	}
+
+	if err := NewWithOutputDir([]string{srcDir}, outDir).Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	for _, path := range stale {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, stat err=%v", path, err)
+		}
+	}
+	if _, err := os.Stat(kept); err != nil {
+		t.Errorf("expected %s to stay: %v", kept, err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(outDir, "maps", "koth_foo.bsp")); string(got) != helloContent {
+		t.Errorf("output: got %q, want %q", got, helloContent)
+	}
+}
+
+// helloBz2 is "hello tf2chart\n" repeated four times, compressed with bzip2.
+const helloBz2 = "425a68393141592653590156b71b000011d9800010400010002b4494002000310340d00aa80189449e20e173478e1048928a3e2ee48a70a12002ad6e36"
+
+// goodbyeBz2 is "goodbye tf2chart\n" repeated four times, compressed with bzip2.
+const goodbyeBz2 = "425a6839314159265359205e748f000013d9800010400010003fc09420200050a600002aa4d1a6d43c52883c3e3d364966c824e8a24b28b3f177245385090205e748f0"
+
+var (
+	helloContent   = strings.Repeat("hello tf2chart\n", 4)
+	goodbyeContent = strings.Repeat("goodbye tf2chart\n", 4)
+)
+
+func writeBz2(t *testing.T, path, fixture string) {
+	t.Helper()
+	data, err := hex.DecodeString(fixture)
+	if err != nil {
+		t.Fatalf("decode fixture: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
+
+func TestDecompressor_ReplacesUnverifiedOutput(t *testing.T) {
+	tmpDir := t.TempDir()
+	source := filepath.Join(tmpDir, "maps", "koth_foo.bsp.bz2")
+	writeBz2(t, source, helloBz2)
+
+	// A truncated output left behind by a killed pod
+	output := filepath.Join(tmpDir, "maps", "koth_foo.bsp")
+	if err := os.WriteFile(output, []byte("hel"), 0o644); err != nil {
+		t.Fatalf("write truncated output: %v", err)
+	}
+
+	if err := New([]string{tmpDir}).Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	if string(got) != helloContent {
+		t.Fatalf("output: got %q, want %q", got, helloContent)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, ManifestName)); err != nil {
+		t.Errorf("manifest missing: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "maps", ".koth_foo.bsp.partial")); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	// A verified output is reused; tampering is caught by VerifyContent.
+	info, _ := os.Stat(output)
+	if err := os.WriteFile(output, []byte(strings.ToUpper(helloContent)), 0o644); err != nil {
+		t.Fatalf("tamper output: %v", err)
+	}
+	if err := os.Chtimes(output, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	if err := New([]string{tmpDir}).Run(); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if got, _ := os.ReadFile(output); string(got) == helloContent {
+		t.Fatalf("expected cached output to be reused without verification")
+	}
+	if err := NewWithOptions([]string{tmpDir}, Options{VerifyContent: true}).Run(); err != nil {
+		t.Fatalf("verified run: %v", err)
+	}
+	if got, _ := os.ReadFile(output); string(got) != helloContent {
+		t.Errorf("verified run did not restore output, got %q", got)
+	}
+}
+
+func TestDecompressor_ReplacesOutputWhenSourceChanges(t *testing.T) {
+	srcDir := t.TempDir()
+	outDir := t.TempDir()
+	source := filepath.Join(srcDir, "maps", "koth_foo_b5.bsp.bz2")
+	writeBz2(t, source, helloBz2)
+	parts := filepath.Join(srcDir, "maps", "koth_big.bsp.bz2.parts")
+	writeParts(t, parts, "koth_big.bsp.bz2", helloBz2)
+
+	d := NewWithOutputDir([]string{srcDir}, outDir)
+	if err := d.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	for _, name := range []string{"koth_foo_b5.bsp", "koth_big.bsp"} {
+		if got, _ := os.ReadFile(filepath.Join(outDir, "maps", name)); string(got) != helloContent {
+			t.Fatalf("%s: got %q, want %q", name, got, helloContent)
+		}
+	}
+
+	// A fixed map pushed under the same names
+	writeBz2(t, source, goodbyeBz2)
+	writeParts(t, parts, "koth_big.bsp.bz2", goodbyeBz2)
+	if err := NewWithOutputDir([]string{srcDir}, outDir).Run(); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	for _, name := range []string{"koth_foo_b5.bsp", "koth_big.bsp"} {
+		if got, _ := os.ReadFile(filepath.Join(outDir, "maps", name)); string(got) != goodbyeContent {
+			t.Errorf("%s after source change: got %q, want %q", name, got, goodbyeContent)
+		}
+	}
+}
+
+func TestSourceFingerprintHashesOnlyWhenAsked(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "a.bsp.bz2")
+	writeBz2(t, source, helloBz2)
+	fp, err := fingerprint(source)
+	if err != nil {
+		t.Fatalf("fingerprint: %v", err)
+	}
+	sum, err := hashFiles(source)
+	if err != nil {
+		t.Fatalf("hash: %v", err)
+	}
+	rec := outputRecord{SourceSize: fp.size, SourceModTime: fp.modTime, SourceSHA256: sum}
+	if change := fp.changedFrom(rec, true); change != "" {
+		t.Fatalf("unchanged source reported as %q", change)
+	}
+
+	// Same size and mtime, different bytes: only the hash notices.
+	rec.SourceSHA256 = strings.Repeat("0", 64)
+	if change := fp.changedFrom(rec, false); change != "" {
+		t.Errorf("without hashing: got %q, want no change", change)
+	}
+	if change := fp.changedFrom(rec, true); change == "" {
+		t.Errorf("with hashing: expected a change")
+	}
+}
+
+// writeParts replaces the parts in dir with fixture split into two parts.
+func writeParts(t *testing.T, dir, name, fixture string) {
+	t.Helper()
+	data, err := hex.DecodeString(fixture)
+	if err != nil {
+		t.Fatalf("decode fixture: %v", err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("remove parts: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	half := len(data) / 2
+	for i, chunk := range [][]byte{data[:half], data[half:]} {
+		path := filepath.Join(dir, fmt.Sprintf("%s.part.%03d", name, i+1))
+		if err := os.WriteFile(path, chunk, 0o644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+	}
+}
+
+func TestDecompressor_WorkerPool(t *testing.T) {
+	srcDir := t.TempDir()
+	outDir := t.TempDir()
+	for i := 0; i < 8; i++ {
+		writeBz2(t, filepath.Join(srcDir, "maps", fmt.Sprintf("map_%d.bsp.bz2", i)), helloBz2)
+	}
+	// Same output name as map_0, found later in the walk; the first one wins.
+	writeBz2(t, filepath.Join(srcDir, "maps", "zz_dup", "maps", "map_0.bsp.bz2"), goodbyeBz2)
+
+	d := NewWithOptions([]string{srcDir}, Options{
+		OutputDir:         outDir,
+		Workers:           4,
+		MaxBytesPerSecond: 1 << 20,
+	})
+	if err := d.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	for i := 0; i < 8; i++ {
+		if got, _ := os.ReadFile(filepath.Join(outDir, "maps", fmt.Sprintf("map_%d.bsp", i))); string(got) != helloContent {
+			t.Errorf("map_%d: got %q", i, got)
+		}
+	}
+	if m := loadManifest(filepath.Join(outDir, ManifestName)); len(m.Outputs) != 8 {
+		t.Errorf("manifest: got %d records, want 8", len(m.Outputs))
+	}
+}
+
+func TestRateLimiterPacesWrites(t *testing.T) {
+	var out strings.Builder
+	l := newRateLimiter(10 << 20)
+	start := time.Now()
+	if _, err := l.writer(&out).Write(make([]byte, 3<<20)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	// The first chunk is free; the rest is paced at 10 MiB/s.
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("3 MiB at 10 MiB/s took %s", elapsed)
+	}
+	if out.Len() != 3<<20 {
+		t.Errorf("wrote %d bytes", out.Len())
+	}
+	if w := newRateLimiter(0).writer(&out); w != io.Writer(&out) {
+		t.Errorf("unlimited writer should not be wrapped")
+	}
+}
+
+// helloXz and helloZst hold helloContent compressed with xz and zstd.
+const (
+	helloXz  = "fd377a585a000004e6d6b44604c01e3c210116000000000000000000d408b6e4e0003b00165d00341949ee8de916b61f4f6cd7d505f0593b00775280000000006ef8793e78c32d1200013a3cd517402a1fb6f37d010000000004595a"
+	helloZst = "28b52ffd243cad00007868656c6c6f2074663263686172740a01008a39eb4bbd4cba"
+)
+
+func TestDecompressor_Formats(t *testing.T) {
+	srcDir := t.TempDir()
+	outDir := t.TempDir()
+	writeBz2(t, filepath.Join(srcDir, "maps", "a.bsp.bz2"), helloBz2)
+	writeBz2(t, filepath.Join(srcDir, "maps", "b.bsp.XZ"), helloXz)
+	writeBz2(t, filepath.Join(srcDir, "maps", "c.bsp.zst"), helloZst)
+	var gz strings.Builder
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(helloContent))
+	zw.Close()
+	if err := os.WriteFile(filepath.Join(srcDir, "maps", "d.bsp.gz"), []byte(gz.String()), 0o644); err != nil {
+		t.Fatalf("write gz: %v", err)
+	}
+
+	if err := NewWithOutputDir([]string{srcDir}, outDir).Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	for _, name := range []string{"a.bsp", "b.bsp", "c.bsp", "d.bsp"} {
+		if got, _ := os.ReadFile(filepath.Join(outDir, "maps", name)); string(got) != helloContent {
+			t.Errorf("%s: got %q", name, got)
+		}
+	}
+}
+
+func writeZip(t *testing.T, path string, entries map[string]string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create %s: %v", path, err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for name, content := range entries {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("create entry %s: %v", name, err)
+		}
+		io.WriteString(w, content)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("close zip: %v", err)
+	}
+}
+
+func TestDecompressor_ExtractsZipContentTrees(t *testing.T) {
+	gameDir := t.TempDir()
+	pack := filepath.Join(gameDir, "maps", "pack.zip")
+	writeZip(t, pack, map[string]string{
+		"MyPack/maps/koth_pack.bsp":             helloContent,
+		"MyPack/Materials/maps/koth_pack/a.vmt": goodbyeContent,
+		"MyPack/readme.txt":                     "not game content",
+	})
+
+	if err := New([]string{gameDir}).Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	bsp := filepath.Join(gameDir, "maps", "koth_pack.bsp")
+	if got, _ := os.ReadFile(bsp); string(got) != helloContent {
+		t.Errorf("koth_pack.bsp: got %q", got)
+	}
+	if got, _ := os.ReadFile(filepath.Join(gameDir, "materials", "maps", "koth_pack", "a.vmt")); string(got) != goodbyeContent {
+		t.Errorf("a.vmt: got %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(gameDir, "readme.txt")); err == nil {
+		t.Errorf("readme.txt should not have been extracted")
+	}
+
+	// Entries are cached individually: only the touched one is extracted again.
+	vmt := filepath.Join(gameDir, "materials", "maps", "koth_pack", "a.vmt")
+	vmtInfo, err := os.Stat(vmt)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	old := vmtInfo.ModTime().Add(-time.Hour)
+	if err := os.Chtimes(bsp, old, old); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	if err := New([]string{gameDir}).Run(); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if info, _ := os.Stat(bsp); info.ModTime().Equal(old) {
+		t.Errorf("damaged entry was not extracted again")
+	}
+	if info, _ := os.Stat(vmt); !info.ModTime().Equal(vmtInfo.ModTime()) {
+		t.Errorf("intact entry was extracted again")
+	}
+}
+
+func TestDecompressor_RejectsUnsafeArchiveEntries(t *testing.T) {
+	for _, name := range []string{"../maps/escape.bsp", "maps/../../escape.cfg", "/maps/abs.bsp", `maps\..\..\escape.cfg`} {
+		gameDir := t.TempDir()
+		pack := filepath.Join(gameDir, "maps", "pack.zip")
+		writeZip(t, pack, map[string]string{
+			"maps/koth_pack.bsp": helloContent,
+			name:                 "outside",
+		})
+		d := New([]string{filepath.Join(gameDir, "maps")})
+		_, err := planArchiveFile(pack, d.archiveOutputRoot(gameDir, pack))
+		if !errors.Is(err, ErrUnsafePath) || !strings.Contains(err.Error(), pack) {
+			t.Errorf("%s: got %v, want ErrUnsafePath naming %s", name, err, pack)
+		}
+		if err := d.Run(); err != nil {
+			t.Fatalf("%s: run: %v", name, err)
+		}
+		// The archive is rejected before anything is written.
+		if _, err := os.Stat(filepath.Join(gameDir, "maps", "koth_pack.bsp")); err == nil {
+			t.Errorf("%s: safe entries of a rejected archive were extracted", name)
+		}
+	}
+}
+
+func TestDecompressor_ArchivesStayBelowScannedPath(t *testing.T) {
+	gameDir := t.TempDir()
+	mapsDir := filepath.Join(gameDir, "maps")
+	writeZip(t, filepath.Join(mapsDir, "pack.zip"), map[string]string{
+		"maps/koth_pack.bsp":           helloContent,
+		"materials/koth_pack/wall.vmt": goodbyeContent,
+	})
+
+	// Scanning maps/ itself extracts into it rather than into its parent.
+	if err := New([]string{mapsDir}).Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(mapsDir, "maps", "koth_pack.bsp")); string(got) != helloContent {
+		t.Errorf("maps/maps/koth_pack.bsp: got %q", got)
+	}
+	if got, _ := os.ReadFile(filepath.Join(mapsDir, "materials", "koth_pack", "wall.vmt")); string(got) != goodbyeContent {
+		t.Errorf("maps/materials/koth_pack/wall.vmt: got %q", got)
+	}
+	for _, rel := range []string{"maps/koth_pack.bsp", "materials"} {
+		if _, err := os.Stat(filepath.Join(gameDir, rel)); err == nil {
+			t.Errorf("%s written outside the scanned path", rel)
+		}
+	}
+}
+
+func TestDecompressor_OverlappingArchivesKeepFirst(t *testing.T) {
+	gameDir := t.TempDir()
+	writeZip(t, filepath.Join(gameDir, "maps", "a.zip"), map[string]string{
+		"maps/koth_foo.bsp": helloContent,
+	})
+	writeZip(t, filepath.Join(gameDir, "maps", "b.zip"), map[string]string{
+		"maps/koth_foo.bsp": goodbyeContent,
+		"maps/koth_bar.bsp": goodbyeContent,
+	})
+
+	if err := New([]string{gameDir}).Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	foo := filepath.Join(gameDir, "maps", "koth_foo.bsp")
+	if got, _ := os.ReadFile(foo); string(got) != helloContent {
+		t.Errorf("koth_foo.bsp: got %q, want the first archive's copy", got)
+	}
+	if got, _ := os.ReadFile(filepath.Join(gameDir, "maps", "koth_bar.bsp")); string(got) != goodbyeContent {
+		t.Errorf("koth_bar.bsp: got %q", got)
+	}
+
+	// The losing archive does not overwrite the entry on later runs either.
+	info, err := os.Stat(foo)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if err := New([]string{gameDir}).Run(); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if again, _ := os.Stat(foo); !again.ModTime().Equal(info.ModTime()) {
+		t.Errorf("koth_foo.bsp was extracted again")
+	}
+}
+
+// writeGzip writes size zero bytes compressed with gzip, about a thousandfold.
+func writeGzip(t *testing.T, path string, size int) {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(make([]byte, size))
+	zw.Close()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
+
+func TestDecompressor_LimitsAbortOutputs(t *testing.T) {
+	for name, tc := range map[string]struct {
+		limits Limits
+		sizes  []int
+		failed int
+	}{
+		"file size":  {Limits{MaxFileBytes: 2 << 20}, []int{1 << 20, 3 << 20}, 1},
+		"ratio":      {Limits{MaxRatio: 100}, []int{512 << 10, 4 << 20}, 1},
+		"run total":  {Limits{MaxTotalBytes: 3 << 20}, []int{2 << 20, 2 << 20}, 1},
+		"free space": {Limits{MinFreeBytes: 1 << 62}, []int{1024}, 1},
+	} {
+		srcDir := t.TempDir()
+		outDir := t.TempDir()
+		for i, size := range tc.sizes {
+			writeGzip(t, filepath.Join(srcDir, "maps", fmt.Sprintf("map_%d.bsp.gz", i)), size)
+		}
+		d := NewWithOptions([]string{srcDir}, Options{OutputDir: outDir, Limits: tc.limits})
+		if err := d.Run(); err != nil {
+			t.Fatalf("%s: run: %v", name, err)
+		}
+		entries, _ := os.ReadDir(filepath.Join(outDir, "maps"))
+		var failed int
+		for i := range tc.sizes {
+			if _, err := os.Stat(filepath.Join(outDir, "maps", fmt.Sprintf("map_%d.bsp", i))); err != nil {
+				failed++
+			}
+		}
+		if failed != tc.failed || len(entries) != len(tc.sizes)-tc.failed {
+			t.Errorf("%s: %d outputs aborted and %d files left, want %d aborted and no partial files", name, failed, len(entries), tc.failed)
+		}
+	}
+
+	// Errors name the source archive.
+	srcDir := t.TempDir()
+	source := filepath.Join(srcDir, "maps", "bomb.bsp.gz")
+	writeGzip(t, source, 4<<20)
+	d := NewWithOptions([]string{srcDir}, Options{Limits: Limits{MaxRatio: 10}})
+	err := d.decompressFile(srcDir, source, filepath.Join(srcDir, "maps", "bomb.bsp"), formatFor(source))
+	if !errors.Is(err, ErrLimitExceeded) || !strings.Contains(err.Error(), source) {
+		t.Errorf("got %v, want ErrLimitExceeded naming %s", err, source)
+	}
+}
+
+func TestDecompressor_StreamsSplitMapParts(t *testing.T) {
+	srcDir := t.TempDir()
+	parts := filepath.Join(srcDir, "maps", "koth_big.bsp.bz2.parts")
+	writeParts(t, parts, "koth_big.bsp.bz2", helloBz2)
+	// Left behind by an earlier version that concatenated parts on disk
+	leftover := filepath.Join(srcDir, "maps", "koth_big.bsp.tmp.bz2")
+	writeBz2(t, leftover, helloBz2)
+
+	if err := New([]string{srcDir}).Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(srcDir, "maps", "koth_big.bsp")); string(got) != helloContent {
+		t.Errorf("assembled map: got %q, want %q", got, helloContent)
+	}
+	entries, err := os.ReadDir(filepath.Join(srcDir, "maps"))
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if want := []string{"koth_big.bsp", "koth_big.bsp.bz2.parts"}; strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("maps/ holds %v, want %v", names, want)
+	}
+
+	// Leftovers next to outputs in an output directory are removed as well
+	outDir := t.TempDir()
+	outLeftover := filepath.Join(outDir, "maps", "koth_big.bsp.tmp.bz2")
+	writeBz2(t, outLeftover, helloBz2)
+	if err := NewWithOutputDir([]string{srcDir}, outDir).Run(); err != nil {
+		t.Fatalf("run with output dir: %v", err)
+	}
+	if _, err := os.Stat(outLeftover); !os.IsNotExist(err) {
+		t.Errorf("leftover %s was not removed", outLeftover)
+	}
+
+	// Files that merely share the suffix belong to the user
+	other := filepath.Join(srcDir, "maps", "notes.tmp.bz2")
+	writeBz2(t, other, helloBz2)
+	if err := New([]string{srcDir}).Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(srcDir, "maps", "notes.tmp")); string(got) != helloContent {
+		t.Errorf("notes.tmp: got %q, want %q", got, helloContent)
+	}
+}
+
+// writeNumberedParts replaces the parts in dir with fixture split into n
+// parts numbered from 1 without zero padding, and returns the part paths.
+func writeNumberedParts(t *testing.T, dir, name, fixture string, n int) []string {
+	t.Helper()
+	data, err := hex.DecodeString(fixture)
+	if err != nil {
+		t.Fatalf("decode fixture: %v", err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("remove parts: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	var paths []string
+	for i := 0; i < n; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("%s.part.%d", name, i+1))
+		if err := os.WriteFile(path, data[len(data)*i/n:len(data)*(i+1)/n], 0o644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func writePartsManifest(t *testing.T, dir string, pm partsManifest) {
+	t.Helper()
+	data, err := json.Marshal(pm)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, partsManifestName), data, 0o644); err != nil {
+		t.Fatalf("write manifest: %v", err)
+	}
+}
+
+func TestDecompressor_SplitMapIntegrity(t *testing.T) {
+	srcDir := t.TempDir()
+	folder := filepath.Join(srcDir, "maps", "koth_big.bsp.bz2.parts")
+	output := filepath.Join(srcDir, "maps", "koth_big.bsp")
+	helloSum := sha256.Sum256([]byte(helloContent))
+	d := New([]string{srcDir})
+
+	// part.10 sorts before part.2 by name; stray files are ignored
+	paths := writeNumberedParts(t, folder, "koth_big.bsp.bz2", helloBz2, 12)
+	if err := os.WriteFile(filepath.Join(folder, "README.txt"), []byte("split with 7-zip"), 0o644); err != nil {
+		t.Fatalf("write stray file: %v", err)
+	}
+	pm := partsManifest{Parts: 12, SHA256: hex.EncodeToString(helloSum[:])}
+	for _, path := range paths {
+		sum, err := hashFiles(path)
+		if err != nil {
+			t.Fatalf("hash: %v", err)
+		}
+		pm.PartSHA256 = append(pm.PartSHA256, sum)
+	}
+	writePartsManifest(t, folder, pm)
+	if err := d.processSplitMap(srcDir, folder, output); err != nil {
+		t.Fatalf("assemble: %v", err)
+	}
+	if got, _ := os.ReadFile(output); string(got) != helloContent {
+		t.Fatalf("assembled map: got %q, want %q", got, helloContent)
+	}
+
+	for name, tc := range map[string]struct {
+		setup func(parts []string)
+		want  string
+	}{
+		"gap": {func(parts []string) { os.Remove(parts[4]) }, "missing part 5"},
+		"duplicate": {func(parts []string) {
+			data, _ := os.ReadFile(parts[2])
+			os.WriteFile(filepath.Join(folder, "koth_big.bsp.bz2.part.003"), data, 0o644)
+		}, "duplicate part 3"},
+		"count": {func([]string) { writePartsManifest(t, folder, partsManifest{Parts: 11}) }, "expects 11"},
+		"part hash": {func([]string) {
+			writePartsManifest(t, folder, partsManifest{PartSHA256: append([]string{strings.Repeat("0", 64)}, pm.PartSHA256[1:]...)})
+		}, "koth_big.bsp.bz2.part.1: SHA-256"},
+		"map hash":   {func([]string) { writePartsManifest(t, folder, partsManifest{SHA256: strings.Repeat("0", 64)}) }, "assembled map SHA-256"},
+		"mixed name": {func([]string) { writeBz2(t, filepath.Join(folder, "koth_other.bsp.bz2.part.13"), helloBz2) }, "different archives"},
+	} {
+		tc.setup(writeNumberedParts(t, folder, "koth_big.bsp.bz2", goodbyeBz2, 12))
+		err := d.processSplitMap(srcDir, folder, output)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %v, want an error containing %q", name, err, tc.want)
+		}
+		// A rejected map never replaces the previous output
+		if got, _ := os.ReadFile(output); string(got) != helloContent {
+			t.Errorf("%s: output replaced with %q", name, got)
+		}
+	}
+}
+
+func TestSplitMapRoundTrip(t *testing.T) {
+	srcDir := t.TempDir()
+	outDir := t.TempDir()
+	bsp := filepath.Join(t.TempDir(), "koth_big.bsp")
+	// Text compresses well, noise does not; together they span many parts.
+	content := []byte(strings.Repeat("koth_big lump data\n", 4000))
+	noise := make([]byte, 200000)
+	for i := range noise {
+		noise[i] = byte(i*2654435761>>13) ^ byte(i>>7)
+	}
+	content = append(content, noise...)
+	if err := os.WriteFile(bsp, content, 0o644); err != nil {
+		t.Fatalf("write map: %v", err)
+	}
+
+	folder, err := SplitMap(bsp, SplitOptions{OutputDir: filepath.Join(srcDir, "maps"), PartSize: 4 << 10, Level: 1})
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+	if want := filepath.Join(srcDir, "maps", "koth_big.bsp.bz2.parts"); folder != want {
+		t.Errorf("folder: got %s, want %s", folder, want)
+	}
+	pm, err := readPartsManifest(folder)
+	if err != nil || pm == nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+	parts, err := listParts(folder)
+	if err != nil {
+		t.Fatalf("list parts: %v", err)
+	}
+	if pm.Parts < 11 || len(parts) != pm.Parts || len(pm.PartSHA256) != pm.Parts {
+		t.Fatalf("manifest lists %d parts and %d checksums, folder holds %d", pm.Parts, len(pm.PartSHA256), len(parts))
+	}
+	for i, part := range parts {
+		if want := fmt.Sprintf("koth_big.bsp.bz2.part.%03d", i); filepath.Base(part) != want {
+			t.Errorf("part %d: got %s, want %s", i, filepath.Base(part), want)
+		}
+	}
+
+	if err := NewWithOutputDir([]string{srcDir}, outDir).Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(outDir, "maps", "koth_big.bsp")); !bytes.Equal(got, content) {
+		t.Errorf("reassembled map: got %d bytes that differ from the %d split", len(got), len(content))
+	}
+
+	// Splitting again replaces the folder, leaving no stale parts behind.
+	if _, err := SplitMap(bsp, SplitOptions{OutputDir: filepath.Join(srcDir, "maps"), PartSize: 1 << 20}); err != nil {
+		t.Fatalf("split again: %v", err)
+	}
+	if parts, err := listParts(folder); err != nil || len(parts) != 1 {
+		t.Errorf("after splitting into one part: %d parts, %v", len(parts), err)
+	}
+	if _, err := SplitMap(filepath.Join(srcDir, "notes.txt"), SplitOptions{}); err == nil {
+		t.Errorf("splitting a non-.bsp file: expected an error")
+	}
+}
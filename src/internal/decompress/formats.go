@@ -0,0 +1,52 @@
+package decompress
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/UDL-TF/TF2Chart/src/internal/xz"
+	"github.com/UDL-TF/TF2Chart/src/internal/zstd"
+)
+
+// DecoderFunc wraps a compressed stream in a reader of its decompressed content.
+type DecoderFunc func(r io.Reader) (io.Reader, error)
+
+// format is a registered archive type. Single-file formats decode one stream
+// to a file named like the source minus its extension; multi-file archives
+// are extracted into content trees instead.
+type format struct {
+	ext     string
+	decode  DecoderFunc // nil for multi-file archives
+	archive bool
+}
+
+var (
+	formatsMu sync.RWMutex
+	formats   = map[string]*format{
+		".bz2": {ext: ".bz2", decode: func(r io.Reader) (io.Reader, error) { return bzip2.NewReader(r), nil }},
+		".gz":  {ext: ".gz", decode: func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		".xz":  {ext: ".xz", decode: func(r io.Reader) (io.Reader, error) { return xz.NewReader(r) }},
+		".zst": {ext: ".zst", decode: func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) }},
+		".zip": {ext: ".zip", archive: true},
+	}
+)
+
+// RegisterFormat makes the decompressor pick up files ending in ext (for
+// example ".lz4") and decode them with decode.
+func RegisterFormat(ext string, decode DecoderFunc) {
+	ext = strings.ToLower(ext)
+	formatsMu.Lock()
+	defer formatsMu.Unlock()
+	formats[ext] = &format{ext: ext, decode: decode}
+}
+
+// formatFor returns the format of the file called name, or nil.
+func formatFor(name string) *format {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+	return formats[strings.ToLower(filepath.Ext(name))]
+}
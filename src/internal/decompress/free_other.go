@@ -0,0 +1,9 @@
+//go:build !linux
+
+package decompress
+
+import "errors"
+
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.New("free space checks are only supported on Linux")
+}
@@ -0,0 +1,104 @@
+package decompress
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var (
+	// ErrLimitExceeded is wrapped by errors for outputs aborted by Limits.
+	ErrLimitExceeded = errors.New("decompression limit exceeded")
+	// ErrUnsafePath is wrapped by errors for archives with entries that would
+	// be written outside the extraction root.
+	ErrUnsafePath = errors.New("unsafe archive entry path")
+)
+
+const (
+	// ratioFloor is the output size below which MaxRatio is not enforced, so
+	// that small, highly compressible files such as configs still pass.
+	ratioFloor = 1 << 20
+	// freeSpaceInterval is how much is written between free space checks.
+	freeSpaceInterval = 64 << 20
+)
+
+// Limits bounds what the decompressor writes, guarding against decompression
+// bombs and full disks. Zero disables a limit. An output that hits a limit is
+// aborted and its partial file removed.
+type Limits struct {
+	MaxFileBytes  int64   // Largest single output
+	MaxRatio      float64 // Largest output to compressed size ratio of one output
+	MaxTotalBytes int64   // Total output written by one Run
+	MinFreeBytes  int64   // Free space to leave on the output filesystem
+}
+
+// checkFreeSpace fails when writing expected more bytes below dir would
+// leave less than MinFreeBytes free.
+func (d *Decompressor) checkFreeSpace(source, dir string, expected int64) error {
+	if d.limits.MinFreeBytes <= 0 {
+		return nil
+	}
+	// The output directory may not exist yet; check the filesystem it will be on.
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	free, err := freeSpace(dir)
+	if err != nil {
+		return fmt.Errorf("check free space in %s: %w", dir, err)
+	}
+	if free-expected < d.limits.MinFreeBytes {
+		return fmt.Errorf("%w: %s: %d bytes free in %s, need %d more than the %d byte reserve",
+			ErrLimitExceeded, source, free, dir, expected, d.limits.MinFreeBytes)
+	}
+	return nil
+}
+
+// guard returns w wrapped to enforce Limits on one output produced from
+// compressed bytes of source. It runs the free space precheck first.
+func (d *Decompressor) guard(w io.Writer, source, outPath string, compressed int64) (io.Writer, error) {
+	if err := d.checkFreeSpace(source, filepath.Dir(outPath), 0); err != nil {
+		return nil, err
+	}
+	if d.limits == (Limits{}) {
+		return w, nil
+	}
+	return &guardedWriter{w: w, d: d, source: source, dir: filepath.Dir(outPath), compressed: compressed, nextCheck: freeSpaceInterval}, nil
+}
+
+type guardedWriter struct {
+	w          io.Writer
+	d          *Decompressor
+	source     string
+	dir        string
+	compressed int64
+	written    int64
+	nextCheck  int64 // written size at which free space is checked again
+}
+
+func (g *guardedWriter) Write(p []byte) (int, error) {
+	limits := g.d.limits
+	size := g.written + int64(len(p))
+	if limits.MaxFileBytes > 0 && size > limits.MaxFileBytes {
+		return 0, fmt.Errorf("%w: %s: output exceeds %d bytes", ErrLimitExceeded, g.source, limits.MaxFileBytes)
+	}
+	if limits.MaxRatio > 0 && size > ratioFloor && float64(size) > limits.MaxRatio*float64(max(g.compressed, 1)) {
+		return 0, fmt.Errorf("%w: %s: output exceeds %g times its %d compressed bytes", ErrLimitExceeded, g.source, limits.MaxRatio, g.compressed)
+	}
+	if limits.MaxTotalBytes > 0 && g.d.total.Add(int64(len(p))) > limits.MaxTotalBytes {
+		return 0, fmt.Errorf("%w: %s: run output exceeds %d bytes", ErrLimitExceeded, g.source, limits.MaxTotalBytes)
+	}
+	if size >= g.nextCheck {
+		if err := g.d.checkFreeSpace(g.source, g.dir, int64(len(p))); err != nil {
+			return 0, err
+		}
+		g.nextCheck += freeSpaceInterval
+	}
+	n, err := g.w.Write(p)
+	g.written += int64(n)
+	return n, err
+}
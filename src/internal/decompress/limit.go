@@ -0,0 +1,70 @@
+package decompress
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// throttleChunk bounds how much a single write may consume from the limiter,
+// so several workers interleave instead of taking turns per large buffer.
+const throttleChunk = 256 << 10
+
+// rateLimiter paces writes from every worker to a shared bytes-per-second budget.
+type rateLimiter struct {
+	bytesPerSecond float64
+
+	mu   sync.Mutex
+	next time.Time // when the budget is next free
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{bytesPerSecond: float64(bytesPerSecond)}
+}
+
+// wait reserves n bytes of budget and sleeps until the reservation starts.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	start := l.next
+	if start.Before(now) {
+		start = now
+	}
+	l.next = start.Add(time.Duration(float64(n) / l.bytesPerSecond * float64(time.Second)))
+	l.mu.Unlock()
+	time.Sleep(start.Sub(now))
+}
+
+// writer wraps w so that everything written through it is paced by l.
+func (l *rateLimiter) writer(w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+	return &throttledWriter{w: w, limiter: l}
+}
+
+type throttledWriter struct {
+	w       io.Writer
+	limiter *rateLimiter
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > throttleChunk {
+			chunk = chunk[:throttleChunk]
+		}
+		t.limiter.wait(len(chunk))
+		n, err := t.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
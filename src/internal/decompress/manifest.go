@@ -0,0 +1,260 @@
+package decompress
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ManifestName is the file, kept next to the outputs, recording what each
+// output was produced from. It is bookkeeping, not game content.
+const ManifestName = ".tf2chart-decompress.json"
+
+// partialSuffix ends the hidden temporary files writeAtomic renames into
+// place once they are complete.
+const partialSuffix = ".partial"
+
+// IsPartial reports whether name is a temporary file of an interrupted write
+// rather than content.
+func IsPartial(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, partialSuffix)
+}
+
+// outputRecord describes a finished output and the source it was produced from.
+type outputRecord struct {
+	Source        string    `json:"source"`
+	SourceSize    int64     `json:"sourceSize"`
+	SourceModTime time.Time `json:"sourceModTime"`
+	SourceParts   int       `json:"sourceParts,omitempty"`
+	SourceSHA256  string    `json:"sourceSha256,omitempty"`
+	Size          int64     `json:"size"`
+	ModTime       time.Time `json:"modTime"`
+	SHA256        string    `json:"sha256"`
+}
+
+// sourceFingerprint identifies the compressed input of an output: a single
+// archive, or the parts of a split map taken together.
+type sourceFingerprint struct {
+	paths   []string
+	size    int64
+	modTime time.Time // newest modification time across paths
+	digest  *sourceDigest
+}
+
+// sourceDigest hashes a source at most once, however many outputs it has.
+type sourceDigest struct {
+	once sync.Once
+	sum  string
+	err  error
+}
+
+func fingerprint(paths ...string) (sourceFingerprint, error) {
+	fp := sourceFingerprint{paths: paths, digest: &sourceDigest{}}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return fp, err
+		}
+		fp.size += info.Size()
+		if info.ModTime().After(fp.modTime) {
+			fp.modTime = info.ModTime()
+		}
+	}
+	return fp, nil
+}
+
+// parts is the part count stored in records; single archives store zero.
+func (fp sourceFingerprint) parts() int {
+	if len(fp.paths) == 1 {
+		return 0
+	}
+	return len(fp.paths)
+}
+
+// changedFrom describes how fp differs from the source recorded in rec, or
+// returns "" when it is the same source. The compressed stream is only hashed
+// when hashSources is set and the cheap checks pass.
+func (fp sourceFingerprint) changedFrom(rec outputRecord, hashSources bool) string {
+	switch {
+	case fp.parts() != rec.SourceParts:
+		return fmt.Sprintf("parts %d -> %d", rec.SourceParts, fp.parts())
+	case fp.size != rec.SourceSize:
+		return fmt.Sprintf("size %d -> %d", rec.SourceSize, fp.size)
+	case !fp.modTime.Equal(rec.SourceModTime):
+		return fmt.Sprintf("modified %s -> %s", rec.SourceModTime.Format(time.RFC3339), fp.modTime.Format(time.RFC3339))
+	case hashSources && rec.SourceSHA256 != "":
+		sum, err := fp.sha256()
+		if err != nil {
+			return fmt.Sprintf("hash failed: %v", err)
+		}
+		if sum != rec.SourceSHA256 {
+			return "content hash differs"
+		}
+	}
+	return ""
+}
+
+// sha256 returns the SHA-256 of the source content, hashing it on first use.
+func (fp sourceFingerprint) sha256() (string, error) {
+	fp.digest.once.Do(func() {
+		fp.digest.sum, fp.digest.err = hashFiles(fp.paths...)
+	})
+	return fp.digest.sum, fp.digest.err
+}
+
+// newRecord describes an output just written from fp.
+func (fp sourceFingerprint) newRecord(source, outPath, sourceSum, sum string) (outputRecord, error) {
+	info, err := os.Stat(outPath)
+	if err != nil {
+		return outputRecord{}, err
+	}
+	return outputRecord{
+		Source:        source,
+		SourceSize:    fp.size,
+		SourceModTime: fp.modTime,
+		SourceParts:   fp.parts(),
+		SourceSHA256:  sourceSum,
+		Size:          info.Size(),
+		ModTime:       info.ModTime(),
+		SHA256:        sum,
+	}, nil
+}
+
+// manifest maps output paths, relative to the manifest directory, to records.
+type manifest struct {
+	path string
+
+	mu      sync.Mutex
+	Outputs map[string]outputRecord `json:"outputs"`
+}
+
+// loadManifest reads the manifest at path. A missing or unreadable manifest
+// yields an empty one, which only costs a re-decompression.
+func loadManifest(path string) *manifest {
+	m := &manifest{path: path, Outputs: make(map[string]outputRecord)}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("decompressor: warning - failed to read manifest %s: %v", path, err)
+		}
+		return m
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		log.Printf("decompressor: warning - ignoring corrupt manifest %s: %v", path, err)
+		m.Outputs = make(map[string]outputRecord)
+	}
+	if m.Outputs == nil {
+		m.Outputs = make(map[string]outputRecord)
+	}
+	return m
+}
+
+func (m *manifest) key(outPath string) string {
+	if rel, err := filepath.Rel(filepath.Dir(m.path), outPath); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return outPath
+}
+
+func (m *manifest) lookup(outPath string) (outputRecord, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.Outputs[m.key(outPath)]
+	return rec, ok
+}
+
+// record stores rec for outPath and rewrites the manifest atomically.
+func (m *manifest) record(outPath string, rec outputRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Outputs[m.key(outPath)] = rec
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = writeAtomic(m.path, 0o644, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	return err
+}
+
+// valid reports whether the output at outPath is still the one rec describes.
+// With verify set the content hash is checked as well.
+func (rec outputRecord) valid(outPath string, verify bool) bool {
+	info, err := os.Stat(outPath)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != rec.Size || !info.ModTime().Equal(rec.ModTime) {
+		return false
+	}
+	if !verify {
+		return true
+	}
+	sum, err := hashFiles(outPath)
+	return err == nil && sum == rec.SHA256
+}
+
+// writeAtomic writes a file through a temporary sibling, fsyncs it and renames
+// it over path, so readers and restarts never see partial content. It returns
+// the SHA-256 of what was written.
+func writeAtomic(path string, perm os.FileMode, write func(io.Writer) error) (string, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	tmpPath := filepath.Join(dir, "."+filepath.Base(path)+partialSuffix)
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return "", fmt.Errorf("create temp file: %w", err)
+	}
+	h := sha256.New()
+	err = write(io.MultiWriter(tmp, h))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	syncDir(dir)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// syncDir persists a rename; failures only weaken durability, so they are ignored.
+func syncDir(dir string) {
+	if f, err := os.Open(dir); err == nil {
+		f.Sync()
+		f.Close()
+	}
+}
+
+// hashFiles returns the SHA-256 of the concatenated content of paths.
+func hashFiles(paths ...string) (string, error) {
+	h := sha256.New()
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
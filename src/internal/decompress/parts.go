@@ -0,0 +1,126 @@
+package decompress
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// partsManifestName is the optional file in a split map folder describing
+// the parts and the map they assemble into.
+const partsManifestName = "manifest.json"
+
+// partPattern matches split map parts such as koth_big.bsp.bz2.part.007.
+var partPattern = regexp.MustCompile(`^(.+\.bz2)\.part\.([0-9]+)$`)
+
+// partsManifest lists what a split map folder must contain. Every field is
+// optional; whatever is present is verified.
+type partsManifest struct {
+	Parts      int      `json:"parts,omitempty"`      // Number of parts
+	PartSHA256 []string `json:"partSha256,omitempty"` // SHA-256 of each part, in part order
+	SHA256     string   `json:"sha256,omitempty"`     // SHA-256 of the assembled map
+}
+
+// readPartsManifest loads the manifest in folderPath, returning nil when the
+// folder has none.
+func readPartsManifest(folderPath string) (*partsManifest, error) {
+	data, err := os.ReadFile(filepath.Join(folderPath, partsManifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	pm := &partsManifest{}
+	if err := json.Unmarshal(data, pm); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", partsManifestName, err)
+	}
+	if len(pm.PartSHA256) > 0 && pm.Parts != 0 && len(pm.PartSHA256) != pm.Parts {
+		return nil, fmt.Errorf("%s lists %d part checksums for %d parts", partsManifestName, len(pm.PartSHA256), pm.Parts)
+	}
+	return pm, nil
+}
+
+// count returns the number of parts the manifest expects, or 0 if unknown.
+func (pm *partsManifest) count() int {
+	if pm.Parts != 0 {
+		return pm.Parts
+	}
+	return len(pm.PartSHA256)
+}
+
+// listParts returns the parts in folderPath in numeric order. Parts must
+// share one name, be numbered consecutively from 0 or 1 and not repeat a
+// number; anything else in the folder is logged and ignored.
+func listParts(folderPath string) ([]string, error) {
+	entries, err := os.ReadDir(folderPath)
+	if err != nil {
+		return nil, fmt.Errorf("read dir: %w", err)
+	}
+
+	type part struct {
+		name  string
+		index int
+	}
+	var parts []part
+	prefix := ""
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || name == partsManifestName {
+			continue
+		}
+		match := partPattern.FindStringSubmatch(name)
+		if match == nil {
+			log.Printf("decompressor: ignoring %s in split map folder %s (not a .bz2.part.N file)", name, folderPath)
+			continue
+		}
+		if prefix == "" {
+			prefix = match[1]
+		} else if match[1] != prefix {
+			return nil, fmt.Errorf("parts of different archives: %s.part.* and %s", prefix, name)
+		}
+		index, err := strconv.Atoi(match[2])
+		if err != nil {
+			return nil, fmt.Errorf("part number of %s: %w", name, err)
+		}
+		parts = append(parts, part{name: name, index: index})
+	}
+	if len(parts) == 0 {
+		return nil, nil
+	}
+
+	sort.Slice(parts, func(i, j int) bool { return parts[i].index < parts[j].index })
+	first := parts[0].index
+	if first > 1 {
+		return nil, fmt.Errorf("missing parts before %s", parts[0].name)
+	}
+	paths := make([]string, len(parts))
+	for i, p := range parts {
+		if i > 0 && p.index == parts[i-1].index {
+			return nil, fmt.Errorf("duplicate part %d: %s and %s", p.index, parts[i-1].name, p.name)
+		}
+		if p.index != first+i {
+			return nil, fmt.Errorf("missing part %d before %s", first+i, p.name)
+		}
+		paths[i] = filepath.Join(folderPath, p.name)
+	}
+	return paths, nil
+}
+
+// verifyParts checks the part hashes computed while streaming against pm.
+func (pm *partsManifest) verifyParts(partFiles []string, sums []hash.Hash) error {
+	for i, want := range pm.PartSHA256 {
+		if got := hex.EncodeToString(sums[i].Sum(nil)); got != want {
+			return fmt.Errorf("part %s: SHA-256 %s does not match manifest %s", filepath.Base(partFiles[i]), got, want)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package decompress
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const (
+	ioprioClassShift = 13
+	ioprioWhoProcess = 1
+)
+
+var ioClasses = map[string]int{
+	"realtime":    1,
+	"best-effort": 2,
+	"idle":        3,
+}
+
+// setThreadPriority applies p to the calling OS thread only, so the caller
+// must hold it with runtime.LockOSThread for as long as the priority should
+// last. On Linux both nice values and I/O priorities are per thread.
+func setThreadPriority(p Priority) error {
+	tid := syscall.Gettid()
+	if p.Nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, p.Nice); err != nil {
+			return fmt.Errorf("set nice %d: %w", p.Nice, err)
+		}
+	}
+	if p.IOClass != "" {
+		class, ok := ioClasses[p.IOClass]
+		if !ok {
+			return fmt.Errorf("unknown I/O class %q", p.IOClass)
+		}
+		prio := class<<ioprioClassShift | p.IOLevel
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(prio)); errno != 0 {
+			return fmt.Errorf("set I/O priority %s/%d: %w", p.IOClass, p.IOLevel, errno)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package decompress
+
+import "errors"
+
+func setThreadPriority(p Priority) error {
+	if p.Nice != 0 || p.IOClass != "" {
+		return errors.New("thread priorities are only supported on Linux")
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package decompress
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/UDL-TF/TF2Chart/src/internal/bzip2"
+)
+
+// DefaultPartSize is the part size SplitMap uses when none is given.
+const DefaultPartSize = 50 << 20
+
+// SplitOptions configures SplitMap.
+type SplitOptions struct {
+	OutputDir string // Directory receiving the parts folder; empty uses the map's directory
+	PartSize  int64  // Largest part in bytes (default DefaultPartSize)
+	Level     int    // bzip2 compression level, 1 to 9 (default 9)
+}
+
+// SplitMap compresses the map at bspPath with bzip2 and splits the stream
+// into <name>.bsp.bz2.parts/<name>.bsp.bz2.part.NNN, numbered from 000,
+// together with a manifest.json holding the part count and the SHA-256 of
+// every part and of the map. This is the layout split map folders are
+// reassembled from. The folder is built under a temporary name and replaces
+// any previous one only once complete. It returns the folder's path.
+func SplitMap(bspPath string, opts SplitOptions) (string, error) {
+	name := filepath.Base(bspPath)
+	if !strings.HasSuffix(strings.ToLower(name), ".bsp") {
+		return "", fmt.Errorf("split %s: not a .bsp file", bspPath)
+	}
+	partSize := opts.PartSize
+	if partSize <= 0 {
+		partSize = DefaultPartSize
+	}
+	level := opts.Level
+	if level == 0 {
+		level = bzip2.DefaultCompression
+	}
+	outDir := opts.OutputDir
+	if outDir == "" {
+		outDir = filepath.Dir(bspPath)
+	}
+
+	in, err := os.Open(bspPath)
+	if err != nil {
+		return "", fmt.Errorf("split %s: %w", bspPath, err)
+	}
+	defer in.Close()
+
+	folder := filepath.Join(outDir, name+".bz2.parts")
+	tmpFolder := filepath.Join(outDir, "."+name+".bz2.parts.partial")
+	if err := os.RemoveAll(tmpFolder); err != nil {
+		return "", fmt.Errorf("split %s: remove stale %s: %w", bspPath, tmpFolder, err)
+	}
+	if err := os.MkdirAll(tmpFolder, 0o755); err != nil {
+		return "", fmt.Errorf("split %s: %w", bspPath, err)
+	}
+
+	pw := &partWriter{dir: tmpFolder, prefix: name + ".bz2", size: partSize}
+	mapHash := sha256.New()
+	err = func() error {
+		bz, err := bzip2.NewWriterLevel(pw, level)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(bz, io.TeeReader(in, mapHash)); err != nil {
+			return err
+		}
+		if err := bz.Close(); err != nil {
+			return err
+		}
+		if err := pw.Close(); err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(partsManifest{
+			Parts:      len(pw.sums),
+			PartSHA256: pw.sums,
+			SHA256:     hex.EncodeToString(mapHash.Sum(nil)),
+		}, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = writeAtomic(filepath.Join(tmpFolder, partsManifestName), 0o644, func(w io.Writer) error {
+			_, err := w.Write(append(data, '\n'))
+			return err
+		})
+		return err
+	}()
+	if err == nil {
+		// Replace the previous folder, if any, with the complete one
+		if err = os.RemoveAll(folder); err == nil {
+			err = os.Rename(tmpFolder, folder)
+		}
+	}
+	if err != nil {
+		pw.Close()
+		os.RemoveAll(tmpFolder)
+		return "", fmt.Errorf("split %s: %w", bspPath, err)
+	}
+	syncDir(outDir)
+
+	log.Printf("decompressor: split %s into %d parts of %d compressed bytes in %s", bspPath, len(pw.sums), pw.total, folder)
+	return folder, nil
+}
+
+// partWriter writes a stream as numbered part files of at most size bytes,
+// hashing each one.
+type partWriter struct {
+	dir    string
+	prefix string
+	size   int64
+
+	file    *os.File
+	hash    hash.Hash
+	written int64 // bytes in the current part
+	total   int64
+	sums    []string // SHA-256 of each finished part
+}
+
+func (p *partWriter) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		if p.file == nil || p.written == p.size {
+			if err := p.next(); err != nil {
+				return n, err
+			}
+		}
+		chunk := b[:min(int64(len(b)), p.size-p.written)]
+		m, err := p.file.Write(chunk)
+		p.hash.Write(chunk[:m])
+		p.written += int64(m)
+		p.total += int64(m)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		b = b[m:]
+	}
+	return n, nil
+}
+
+// next finishes the current part and starts the following one.
+func (p *partWriter) next() error {
+	if err := p.Close(); err != nil {
+		return err
+	}
+	path := filepath.Join(p.dir, fmt.Sprintf("%s.part.%03d", p.prefix, len(p.sums)))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	p.file, p.hash, p.written = f, sha256.New(), 0
+	return nil
+}
+
+// Close finishes the current part, if any.
+func (p *partWriter) Close() error {
+	if p.file == nil {
+		return nil
+	}
+	f := p.file
+	p.file = nil
+	err := f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	p.sums = append(p.sums, hex.EncodeToString(p.hash.Sum(nil)))
+	return nil
+}
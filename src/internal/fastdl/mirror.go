@@ -0,0 +1,325 @@
+// Package fastdl maintains a FastDL mirror of the merged content tree: bzip2
+// compressed copies of downloadable content at the paths clients request
+// from sv_downloadurl.
+package fastdl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/UDL-TF/TF2Chart/src/internal/bzip2"
+)
+
+// DefaultDirs are the content directories mirrored when none are configured.
+var DefaultDirs = []string{"maps", "materials", "models", "sound", "particles", "resource"}
+
+// Options configures a Mirror.
+type Options struct {
+	Dirs    []string // Content directories to mirror, relative to the source (default DefaultDirs)
+	Level   int      // bzip2 compression level, 1 to 9 (default 9)
+	Workers int      // Files compressed concurrently (default 1)
+}
+
+// Mirror keeps dest in step with the content directories of source. Every
+// file below them is stored as <path>.bz2 in dest; files are only compressed
+// again when their source changes, and outputs whose source disappeared are
+// removed.
+type Mirror struct {
+	source  string
+	dest    string
+	dirs    []string
+	level   int
+	workers int
+}
+
+// Stats summarises one Sync.
+type Stats struct {
+	Compressed int
+	Unchanged  int
+	Removed    int
+	Failed     int
+}
+
+// New creates a Mirror of source in dest.
+func New(source, dest string, opts Options) (*Mirror, error) {
+	source, dest = filepath.Clean(source), filepath.Clean(dest)
+	if within(dest, source) || within(source, dest) {
+		return nil, fmt.Errorf("fastdl: mirror %s and source %s must not contain each other", dest, source)
+	}
+	dirs := opts.Dirs
+	if len(dirs) == 0 {
+		dirs = DefaultDirs
+	}
+	for _, dir := range dirs {
+		if !filepath.IsLocal(dir) {
+			return nil, fmt.Errorf("fastdl: content directory %q must be relative to the source", dir)
+		}
+	}
+	level := opts.Level
+	if level == 0 {
+		level = bzip2.DefaultCompression
+	}
+	if level < bzip2.BestSpeed || level > bzip2.BestCompression {
+		return nil, fmt.Errorf("fastdl: invalid compression level %d", level)
+	}
+	return &Mirror{source: source, dest: dest, dirs: dirs, level: level, workers: max(opts.Workers, 1)}, nil
+}
+
+// within reports whether path is dir or below it.
+func within(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && filepath.IsLocal(rel)
+}
+
+// Sync compresses new and changed files and removes outputs whose source is
+// gone. Failures of single files are logged and counted; the state of every
+// other file is still saved.
+func (m *Mirror) Sync(ctx context.Context) (Stats, error) {
+	var stats Stats
+	start := time.Now()
+	st := loadState(m.dest)
+
+	wanted, err := m.scan()
+	if err != nil {
+		return stats, err
+	}
+
+	var pending []string
+	for rel, src := range wanted {
+		if m.upToDate(st, rel, src) {
+			stats.Unchanged++
+			continue
+		}
+		pending = append(pending, rel)
+	}
+
+	sort.Strings(pending)
+	stats.Compressed, stats.Failed = m.compressAll(ctx, pending, wanted, st)
+
+	for rel := range st.Files {
+		if _, ok := wanted[rel]; ok {
+			continue
+		}
+		if err := m.remove(rel); err != nil {
+			log.Printf("fastdl: error removing %s: %v", m.outputPath(rel), err)
+			stats.Failed++
+			continue
+		}
+		delete(st.Files, rel)
+		stats.Removed++
+	}
+
+	if err := st.save(); err != nil {
+		return stats, fmt.Errorf("fastdl: save state: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return stats, err
+	}
+	if stats.Compressed > 0 || stats.Removed > 0 || stats.Failed > 0 {
+		log.Printf("fastdl: %s: %d compressed, %d unchanged, %d removed, %d failed in %s",
+			m.dest, stats.Compressed, stats.Unchanged, stats.Removed, stats.Failed, time.Since(start).Round(time.Millisecond))
+	}
+	return stats, nil
+}
+
+// sourceFile is a file of the merged view and what it resolves to.
+type sourceFile struct {
+	path    string // resolved path, following the view's symlinks
+	size    int64
+	modTime time.Time
+}
+
+// scan returns the files below the content directories of the source, keyed
+// by their slash-separated path relative to the source.
+func (m *Mirror) scan() (map[string]sourceFile, error) {
+	files := make(map[string]sourceFile)
+	for _, dir := range m.dirs {
+		root := filepath.Join(m.source, dir)
+		if _, err := os.Stat(root); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, walkErr error) error {
+			if walkErr != nil {
+				return walkErr
+			}
+			if d.IsDir() {
+				return nil
+			}
+			name := d.Name()
+			// Hidden files are bookkeeping, and compressed sources are
+			// already what a client would download.
+			if strings.HasPrefix(name, ".") || strings.HasSuffix(strings.ToLower(name), ".bz2") {
+				return nil
+			}
+			// The merged view links files to their layers
+			resolved, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				log.Printf("fastdl: skipping %s: %v", path, err)
+				return nil
+			}
+			info, err := os.Stat(resolved)
+			if err != nil {
+				log.Printf("fastdl: skipping %s: %v", path, err)
+				return nil
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(m.source, path)
+			if err != nil {
+				return err
+			}
+			files[filepath.ToSlash(rel)] = sourceFile{path: resolved, size: info.Size(), modTime: info.ModTime()}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("fastdl: scan %s: %w", root, err)
+		}
+	}
+	return files, nil
+}
+
+func (m *Mirror) outputPath(rel string) string {
+	return filepath.Join(m.dest, filepath.FromSlash(rel)+".bz2")
+}
+
+// upToDate reports whether the output for rel was produced from src and is
+// still in place.
+func (m *Mirror) upToDate(st *state, rel string, src sourceFile) bool {
+	rec, ok := st.Files[rel]
+	if !ok || rec.Source != src.path || rec.SourceSize != src.size || !rec.SourceModTime.Equal(src.modTime) {
+		return false
+	}
+	info, err := os.Stat(m.outputPath(rel))
+	return err == nil && info.Size() == rec.Size
+}
+
+// stateSaveInterval is how many outputs compressAll records between saves of
+// the state, so a sync that is killed midway keeps most of its progress.
+const stateSaveInterval = 32
+
+// compressAll compresses pending on the configured number of workers,
+// recording each output in st, and returns how many succeeded and failed. A
+// failed file loses its previous output rather than serving stale content.
+func (m *Mirror) compressAll(ctx context.Context, pending []string, wanted map[string]sourceFile, st *state) (int, int) {
+	if len(pending) == 0 {
+		return 0, 0
+	}
+	workers := min(m.workers, len(pending))
+	log.Printf("fastdl: compressing %d files with %d workers", len(pending), workers)
+
+	queue := make(chan string)
+	var mu sync.Mutex
+	var done, failed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rel := range queue {
+				src := wanted[rel]
+				outPath := m.outputPath(rel)
+				size, err := m.compress(src, outPath)
+				if err != nil {
+					log.Printf("fastdl: error compressing %s: %v", src.path, err)
+					os.Remove(outPath)
+					mu.Lock()
+					delete(st.Files, rel)
+					mu.Unlock()
+					failed.Add(1)
+					continue
+				}
+				mu.Lock()
+				st.Files[rel] = record{Source: src.path, SourceSize: src.size, SourceModTime: src.modTime, Size: size}
+				if done.Add(1)%stateSaveInterval == 0 {
+					if err := st.save(); err != nil {
+						log.Printf("fastdl: warning - failed to save state %s: %v", st.path, err)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, rel := range pending {
+		if ctx.Err() != nil {
+			break
+		}
+		queue <- rel
+	}
+	close(queue)
+	wg.Wait()
+	return int(done.Load()), int(failed.Load())
+}
+
+// compress writes src to outPath as bzip2 through a temporary file, stamps it
+// with the source's modification time and returns its size.
+func (m *Mirror) compress(src sourceFile, outPath string) (int64, error) {
+	in, err := os.Open(src.path)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(outPath), 0o755); err != nil {
+		return 0, err
+	}
+	tmpPath := filepath.Join(filepath.Dir(outPath), "."+filepath.Base(outPath)+".partial")
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return 0, fmt.Errorf("create temp file: %w", err)
+	}
+	bz, err := bzip2.NewWriterLevel(tmp, m.level)
+	if err == nil {
+		_, err = io.Copy(bz, in)
+		if closeErr := bz.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	var size int64
+	if err == nil {
+		size, err = tmp.Seek(0, io.SeekCurrent)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(tmpPath, src.modTime, src.modTime)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, outPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	return size, nil
+}
+
+// remove deletes the output for rel and any directories it leaves empty.
+func (m *Mirror) remove(rel string) error {
+	outPath := m.outputPath(rel)
+	if err := os.Remove(outPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	log.Printf("fastdl: removed %s (source gone)", outPath)
+	for dir := filepath.Dir(outPath); dir != m.dest && within(dir, m.dest); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
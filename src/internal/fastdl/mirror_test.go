@@ -0,0 +1,162 @@
+package fastdl
+
+import (
+	"compress/bzip2"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeLayerFile writes a file into a layer and links it into the view, the
+// way the merger builds the merged content tree.
+func writeLayerFile(t *testing.T, layer, view, rel, content string) {
+	t.Helper()
+	src := filepath.Join(layer, rel)
+	if err := os.MkdirAll(filepath.Dir(src), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(src, []byte(content), 0o644); err != nil {
+		t.Fatalf("write %s: %v", rel, err)
+	}
+	target := filepath.Join(view, rel)
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	os.Remove(target)
+	if err := os.Symlink(src, target); err != nil {
+		t.Fatalf("link %s: %v", rel, err)
+	}
+}
+
+func readBz2(t *testing.T, path string) string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open %s: %v", path, err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(bzip2.NewReader(f))
+	if err != nil {
+		t.Fatalf("decompress %s: %v", path, err)
+	}
+	return string(data)
+}
+
+func TestMirrorSync(t *testing.T) {
+	layer, view, dest := t.TempDir(), t.TempDir(), t.TempDir()
+	writeLayerFile(t, layer, view, "maps/koth_foo.bsp", "koth_foo map data")
+	writeLayerFile(t, layer, view, "materials/foo/wall.vtf", "wall texture")
+	writeLayerFile(t, layer, view, "sound/foo/horn.wav", "honk")
+	writeLayerFile(t, layer, view, "cfg/server.cfg", "rcon_password secret")
+	writeLayerFile(t, layer, view, "maps/.tf2chart-decompress.json", "{}")
+	writeLayerFile(t, layer, view, "maps/koth_bar.bsp.bz2", "already compressed")
+
+	m, err := New(view, dest, Options{Level: 1, Workers: 2})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	stats, err := m.Sync(context.Background())
+	if err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if stats != (Stats{Compressed: 3}) {
+		t.Errorf("first sync: got %+v, want 3 compressed", stats)
+	}
+	if got := readBz2(t, filepath.Join(dest, "maps", "koth_foo.bsp.bz2")); got != "koth_foo map data" {
+		t.Errorf("koth_foo.bsp.bz2: got %q", got)
+	}
+	if got := readBz2(t, filepath.Join(dest, "materials", "foo", "wall.vtf.bz2")); got != "wall texture" {
+		t.Errorf("wall.vtf.bz2: got %q", got)
+	}
+	for _, rel := range []string{"cfg/server.cfg.bz2", "maps/.tf2chart-decompress.json.bz2", "maps/koth_bar.bsp.bz2.bz2"} {
+		if _, err := os.Stat(filepath.Join(dest, rel)); !os.IsNotExist(err) {
+			t.Errorf("%s should not be mirrored", rel)
+		}
+	}
+
+	// A file the mirror did not write is left alone.
+	unowned := filepath.Join(dest, "maps", "notes.txt")
+	if err := os.WriteFile(unowned, []byte("mine"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	stats, err = m.Sync(context.Background())
+	if err != nil {
+		t.Fatalf("second sync: %v", err)
+	}
+	if stats != (Stats{Unchanged: 3}) {
+		t.Errorf("second sync: got %+v, want 3 unchanged", stats)
+	}
+
+	// Change one file, remove the sound tree and move the map to another layer.
+	later := time.Now().Add(time.Minute)
+	writeLayerFile(t, layer, view, "materials/foo/wall.vtf", "wall texture v2")
+	os.Chtimes(filepath.Join(layer, "materials", "foo", "wall.vtf"), later, later)
+	if err := os.RemoveAll(filepath.Join(view, "sound")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	other := t.TempDir()
+	writeLayerFile(t, other, view, "maps/koth_foo.bsp", "koth_foo map data")
+
+	stats, err = m.Sync(context.Background())
+	if err != nil {
+		t.Fatalf("third sync: %v", err)
+	}
+	if stats != (Stats{Compressed: 2, Removed: 1}) {
+		t.Errorf("third sync: got %+v, want 2 compressed and 1 removed", stats)
+	}
+	if got := readBz2(t, filepath.Join(dest, "materials", "foo", "wall.vtf.bz2")); got != "wall texture v2" {
+		t.Errorf("wall.vtf.bz2 after change: got %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "sound")); !os.IsNotExist(err) {
+		t.Errorf("sound/ should be removed with its last output")
+	}
+	if _, err := os.Stat(unowned); err != nil {
+		t.Errorf("unowned file removed: %v", err)
+	}
+}
+
+func TestMirrorRebuildsMissingOutputs(t *testing.T) {
+	layer, view, dest := t.TempDir(), t.TempDir(), t.TempDir()
+	writeLayerFile(t, layer, view, "resource/ui/hud.res", "\"hud\" {}")
+
+	m, err := New(view, dest, Options{})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	if _, err := m.Sync(context.Background()); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	out := filepath.Join(dest, "resource", "ui", "hud.res.bz2")
+	if err := os.Remove(out); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	stats, err := m.Sync(context.Background())
+	if err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if stats.Compressed != 1 || readBz2(t, out) != `"hud" {}` {
+		t.Errorf("missing output not rebuilt: %+v", stats)
+	}
+}
+
+func TestNewRejectsInvalidOptions(t *testing.T) {
+	view := t.TempDir()
+	for name, tc := range map[string]struct {
+		dest string
+		opts Options
+	}{
+		"mirror inside source": {dest: filepath.Join(view, "fastdl")},
+		"source inside mirror": {dest: filepath.Dir(view)},
+		"absolute dir":         {dest: t.TempDir(), opts: Options{Dirs: []string{"/etc"}}},
+		"escaping dir":         {dest: t.TempDir(), opts: Options{Dirs: []string{"../cfg"}}},
+		"level":                {dest: t.TempDir(), opts: Options{Level: 10}},
+	} {
+		if _, err := New(view, tc.dest, tc.opts); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
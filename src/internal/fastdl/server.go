@@ -0,0 +1,314 @@
+package fastdl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// throttleChunk bounds how much of a response is written per rate limit
+// reservation, so a client's downloads interleave instead of taking turns.
+const throttleChunk = 32 << 10
+
+// ServerOptions configures a Server.
+type ServerOptions struct {
+	Dirs              []string // Content directories that may be downloaded (default DefaultDirs)
+	Prefix            string   // URL path prefix in front of the content paths, e.g. /tf
+	BytesPerSecond    int64    // Download rate of each client IP across its requests; 0 is unlimited
+	MaxConnsPerIP     int      // Concurrent downloads of each client IP; 0 is unlimited
+	TrustForwardedFor bool     // Identify clients by the last X-Forwarded-For entry, when behind a proxy
+}
+
+// Server serves the merged content tree and its FastDL mirror at the paths
+// clients derive from sv_downloadurl. Requests for <path>.bz2 are served from
+// the mirror when it has a copy; anything else comes from the content tree.
+// Only files below the allowed content directories can be downloaded.
+type Server struct {
+	content           string
+	mirror            string
+	dirs              []string
+	prefix            string
+	clients           *clientLimits
+	trustForwardedFor bool
+}
+
+// NewServer creates a Server for the content tree at content and the mirror
+// at mirror, which may be empty to serve uncompressed files only.
+func NewServer(content, mirror string, opts ServerOptions) (*Server, error) {
+	dirs := opts.Dirs
+	if len(dirs) == 0 {
+		dirs = DefaultDirs
+	}
+	allowed := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		if !filepath.IsLocal(dir) {
+			return nil, fmt.Errorf("fastdl: content directory %q must be relative to the content tree", dir)
+		}
+		allowed = append(allowed, filepath.ToSlash(filepath.Clean(dir)))
+	}
+	prefix := strings.Trim(opts.Prefix, "/")
+	if prefix != "" {
+		prefix = "/" + prefix
+	}
+	return &Server{
+		content:           content,
+		mirror:            mirror,
+		dirs:              allowed,
+		prefix:            prefix,
+		clients:           newClientLimits(opts.BytesPerSecond, opts.MaxConnsPerIP),
+		trustForwardedFor: opts.TrustForwardedFor,
+	}, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rel, ok := s.contentPath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	f, info, err := s.open(rel)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	ip := s.clientIP(r)
+	c, ok := s.clients.acquire(ip)
+	if !ok {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "too many concurrent downloads", http.StatusTooManyRequests)
+		return
+	}
+	defer s.clients.release(ip)
+
+	h := w.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("ETag", etag(info))
+	if s.clients.bytesPerSecond > 0 {
+		w = &throttledWriter{ResponseWriter: w, client: c, ctx: r.Context()}
+	}
+	http.ServeContent(w, r, path.Base(rel), info.ModTime(), f)
+}
+
+// contentPath maps a request path onto a slash-separated path in the content
+// tree, rejecting anything outside the allowed directories and hidden files.
+func (s *Server) contentPath(urlPath string) (string, bool) {
+	p := path.Clean("/" + urlPath)
+	if s.prefix != "" {
+		if !strings.HasPrefix(p, s.prefix+"/") {
+			return "", false
+		}
+		p = p[len(s.prefix):]
+	}
+	rel := strings.TrimPrefix(p, "/")
+	if !fs.ValidPath(rel) {
+		return "", false
+	}
+	for _, part := range strings.Split(rel, "/") {
+		if strings.HasPrefix(part, ".") {
+			return "", false
+		}
+	}
+	for _, dir := range s.dirs {
+		if strings.HasPrefix(rel, dir+"/") {
+			return rel, true
+		}
+	}
+	return "", false
+}
+
+// open returns the file to serve for rel: the mirror's copy for .bz2
+// requests, falling back to the content tree.
+func (s *Server) open(rel string) (*os.File, os.FileInfo, error) {
+	var candidates []string
+	if s.mirror != "" && strings.HasSuffix(strings.ToLower(rel), ".bz2") {
+		candidates = append(candidates, filepath.Join(s.mirror, filepath.FromSlash(rel)))
+	}
+	candidates = append(candidates, filepath.Join(s.content, filepath.FromSlash(rel)))
+
+	for _, candidate := range candidates {
+		f, err := os.Open(candidate)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		if !info.Mode().IsRegular() {
+			f.Close()
+			continue
+		}
+		return f, info, nil
+	}
+	return nil, nil, fs.ErrNotExist
+}
+
+// etag identifies a version of a file by its size and modification time.
+func etag(info os.FileInfo) string {
+	return `"` + strconv.FormatInt(info.Size(), 16) + "-" + strconv.FormatInt(info.ModTime().UnixNano(), 16) + `"`
+}
+
+// clientIP returns the address rate limits are applied to.
+func (s *Server) clientIP(r *http.Request) string {
+	if s.trustForwardedFor {
+		// The proxy appends the address it saw; earlier entries are the client's to forge
+		if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+			entries := strings.Split(fwd[len(fwd)-1], ",")
+			if ip := strings.TrimSpace(entries[len(entries)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientSweepInterval is how often acquire looks for idle clients whose rate
+// limit budget has recovered, so they can be forgotten.
+const clientSweepInterval = time.Minute
+
+// clientLimits tracks the downloads of every client IP.
+type clientLimits struct {
+	bytesPerSecond float64
+	maxConns       int
+
+	mu      sync.Mutex
+	clients map[string]*client
+	swept   time.Time
+}
+
+// client is one IP's share: its open downloads and rate limit budget.
+type client struct {
+	limits *clientLimits
+	conns  int
+	next   time.Time // when the client's budget is next free
+}
+
+func newClientLimits(bytesPerSecond int64, maxConns int) *clientLimits {
+	return &clientLimits{
+		bytesPerSecond: float64(max(bytesPerSecond, 0)),
+		maxConns:       max(maxConns, 0),
+		clients:        make(map[string]*client),
+	}
+}
+
+// acquire registers a download by ip, failing when it already has the
+// maximum number open. Clients are forgotten once their last download ends
+// and their budget has recovered, so back-to-back requests share one budget.
+func (l *clientLimits) acquire(ip string) (*client, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now := time.Now(); now.Sub(l.swept) >= clientSweepInterval {
+		l.expire(now)
+		l.swept = now
+	}
+	c := l.clients[ip]
+	if c == nil {
+		c = &client{limits: l}
+		l.clients[ip] = c
+	}
+	if l.maxConns > 0 && c.conns >= l.maxConns {
+		return nil, false
+	}
+	c.conns++
+	return c, true
+}
+
+func (l *clientLimits) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c := l.clients[ip]; c != nil {
+		c.conns--
+		if c.idle(time.Now()) {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+// expire forgets the clients that are idle at now. The caller holds l.mu.
+func (l *clientLimits) expire(now time.Time) {
+	for ip, c := range l.clients {
+		if c.idle(now) {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+// idle reports whether c has no open downloads and its budget is free at now,
+// so a fresh client would behave the same.
+func (c *client) idle(now time.Time) bool {
+	return c.conns <= 0 && !c.next.After(now)
+}
+
+// reserve books n bytes of the client's budget and returns how long to wait
+// before sending them.
+func (c *client) reserve(n int) time.Duration {
+	l := c.limits
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	start := c.next
+	if start.Before(now) {
+		start = now
+	}
+	c.next = start.Add(time.Duration(float64(n) / l.bytesPerSecond * float64(time.Second)))
+	return start.Sub(now)
+}
+
+// throttledWriter paces a response to its client's rate limit.
+type throttledWriter struct {
+	http.ResponseWriter
+	client *client
+	ctx    context.Context
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), throttleChunk)]
+		if delay := w.client.reserve(len(chunk)); delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-w.ctx.Done():
+				timer.Stop()
+				return written, w.ctx.Err()
+			case <-timer.C:
+			}
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
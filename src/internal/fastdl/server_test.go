@@ -0,0 +1,201 @@
+package fastdl
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T, opts ServerOptions) *Server {
+	t.Helper()
+	layer, view, mirror := t.TempDir(), t.TempDir(), t.TempDir()
+	writeLayerFile(t, layer, view, "maps/koth_foo.bsp", "koth_foo map data")
+	writeLayerFile(t, layer, view, "maps/koth_bar.bsp.bz2", "bar from the view")
+	writeLayerFile(t, layer, view, "cfg/server.cfg", "rcon_password secret")
+	writeLayerFile(t, layer, view, "addons/sourcemod/configs/admins.cfg", "admins")
+	if err := os.MkdirAll(filepath.Join(mirror, "maps"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(mirror, "maps", "koth_foo.bsp.bz2"), []byte("compressed koth_foo"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(mirror, stateName), []byte("{}"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	s, err := NewServer(view, mirror, opts)
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+	return s
+}
+
+func get(t *testing.T, h http.Handler, target string, header http.Header) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Result()
+}
+
+func body(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	return string(data)
+}
+
+func TestServerServesAllowedContent(t *testing.T) {
+	s := newTestServer(t, ServerOptions{})
+
+	for target, want := range map[string]string{
+		"/maps/koth_foo.bsp":     "koth_foo map data",
+		"/maps/koth_foo.bsp.bz2": "compressed koth_foo",
+		"/maps/koth_bar.bsp.bz2": "bar from the view",
+	} {
+		resp := get(t, s, target, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: status %d", target, resp.StatusCode)
+			continue
+		}
+		if got := body(t, resp); got != want {
+			t.Errorf("%s: got %q, want %q", target, got, want)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/octet-stream" {
+			t.Errorf("%s: content type %q", target, ct)
+		}
+	}
+
+	for _, target := range []string{
+		"/cfg/server.cfg",
+		"/addons/sourcemod/configs/admins.cfg",
+		"/maps/../cfg/server.cfg",
+		"/maps/%2e%2e/cfg/server.cfg",
+		"/maps/" + stateName,
+		"/" + stateName,
+		"/maps/koth_missing.bsp",
+		"/maps/koth_bar.bsp",
+		"/maps",
+		"/",
+	} {
+		if resp := get(t, s, target, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: status %d, want 404", target, resp.StatusCode)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/maps/koth_foo.bsp", nil)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status %d, want 405", rec.Code)
+	}
+}
+
+func TestServerPrefix(t *testing.T) {
+	s := newTestServer(t, ServerOptions{Prefix: "/tf/"})
+	if resp := get(t, s, "/tf/maps/koth_foo.bsp", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("prefixed path: status %d", resp.StatusCode)
+	}
+	if resp := get(t, s, "/maps/koth_foo.bsp", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unprefixed path: status %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestServerRangesAndETags(t *testing.T) {
+	s := newTestServer(t, ServerOptions{})
+
+	resp := get(t, s, "/maps/koth_foo.bsp", http.Header{"Range": {"bytes=9-11"}})
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("range: status %d", resp.StatusCode)
+	}
+	if got := body(t, resp); got != "map" {
+		t.Errorf("range: got %q", got)
+	}
+
+	resp = get(t, s, "/maps/koth_foo.bsp", nil)
+	tag := resp.Header.Get("ETag")
+	if tag == "" {
+		t.Fatalf("missing ETag")
+	}
+	if resp := get(t, s, "/maps/koth_foo.bsp", http.Header{"If-None-Match": {tag}}); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("If-None-Match: status %d, want 304", resp.StatusCode)
+	}
+	if other := get(t, s, "/maps/koth_foo.bsp.bz2", nil).Header.Get("ETag"); other == tag {
+		t.Errorf("compressed and uncompressed files share ETag %s", tag)
+	}
+}
+
+func TestServerLimitsClients(t *testing.T) {
+	s := newTestServer(t, ServerOptions{MaxConnsPerIP: 1, TrustForwardedFor: true})
+
+	if _, ok := s.clients.acquire("203.0.113.7"); !ok {
+		t.Fatalf("first download refused")
+	}
+	fwd := http.Header{"X-Forwarded-For": {"198.51.100.1, 203.0.113.7"}}
+	resp := get(t, s, "/maps/koth_foo.bsp", fwd)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("second download: status %d, want 429", resp.StatusCode)
+	}
+	if resp := get(t, s, "/maps/koth_foo.bsp", http.Header{"X-Forwarded-For": {"203.0.113.8"}}); resp.StatusCode != http.StatusOK {
+		t.Errorf("other client: status %d", resp.StatusCode)
+	}
+	s.clients.release("203.0.113.7")
+	if resp := get(t, s, "/maps/koth_foo.bsp", fwd); resp.StatusCode != http.StatusOK {
+		t.Errorf("after release: status %d", resp.StatusCode)
+	}
+	if n := len(s.clients.clients); n != 0 {
+		t.Errorf("%d clients still tracked after their downloads ended", n)
+	}
+}
+
+func TestServerThrottlesDownloads(t *testing.T) {
+	s := newTestServer(t, ServerOptions{BytesPerSecond: 100})
+
+	// 17 bytes at 100 bytes/s leave the client's budget busy for 170ms.
+	c, _ := s.clients.acquire("192.0.2.1")
+	w := &throttledWriter{ResponseWriter: httptest.NewRecorder(), client: c, ctx: context.Background()}
+	if _, err := w.Write([]byte("koth_foo map data")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	start := time.Now()
+	if _, err := w.Write([]byte("x")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("second write after %s, want it held back by the first", elapsed)
+	}
+}
+
+func TestServerKeepsBudgetAcrossRequests(t *testing.T) {
+	s := newTestServer(t, ServerOptions{BytesPerSecond: 100})
+
+	// The budget outlives the download that used it
+	c, _ := s.clients.acquire("192.0.2.1")
+	c.reserve(50)
+	s.clients.release("192.0.2.1")
+	c, _ = s.clients.acquire("192.0.2.1")
+	if delay := c.reserve(1); delay < 400*time.Millisecond {
+		t.Errorf("next request may send after %s, want the previous 500ms budget to apply", delay)
+	}
+	s.clients.release("192.0.2.1")
+
+	// Idle clients are forgotten once their budget has recovered
+	s.clients.mu.Lock()
+	s.clients.expire(time.Now())
+	tracked := len(s.clients.clients)
+	s.clients.expire(time.Now().Add(time.Second))
+	left := len(s.clients.clients)
+	s.clients.mu.Unlock()
+	if tracked != 1 || left != 0 {
+		t.Errorf("tracked %d clients while the budget is busy and %d after it recovered, want 1 and 0", tracked, left)
+	}
+}
@@ -0,0 +1,69 @@
+package fastdl
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateName is the file in the mirror recording which source each output was
+// compressed from. Only outputs listed here are ever removed.
+const stateName = ".tf2chart-fastdl.json"
+
+// record describes an output and the source file it was compressed from.
+type record struct {
+	Source        string    `json:"source"`
+	SourceSize    int64     `json:"sourceSize"`
+	SourceModTime time.Time `json:"sourceModTime"`
+	Size          int64     `json:"size"`
+}
+
+type state struct {
+	path  string
+	Files map[string]record `json:"files"` // Keyed by slash-separated path relative to the source
+}
+
+// loadState reads the state of the mirror in dest. A missing or unreadable
+// state starts empty, so every file is compressed again.
+func loadState(dest string) *state {
+	st := &state{path: filepath.Join(dest, stateName), Files: make(map[string]record)}
+	data, err := os.ReadFile(st.path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("fastdl: warning - cannot read %s, rebuilding mirror: %v", st.path, err)
+		}
+		return st
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		log.Printf("fastdl: warning - cannot parse %s, rebuilding mirror: %v", st.path, err)
+		st.Files = make(map[string]record)
+	}
+	if st.Files == nil {
+		st.Files = make(map[string]record)
+	}
+	return st
+}
+
+// save writes the state atomically.
+func (st *state) save() error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(st.path), 0o755); err != nil {
+		return err
+	}
+	tmpPath := st.path + ".partial"
+	if err := os.WriteFile(tmpPath, append(data, '\n'), 0o644); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, st.path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+// Package keyvalues reads, writes and deep-merges Valve KeyValues (VDF) text
+// files such as metamod .vdf plugin lists, SourceMod's databases.cfg and
+// core.cfg, and gameinfo.txt.
+package keyvalues
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Node is a single key with either a string value or a block of children.
+// The document returned by Parse is a block node with an empty key.
+type Node struct {
+	Key       string
+	Value     string
+	Children  []*Node
+	Condition string // Platform conditional such as [$WIN32], without brackets
+	block     bool
+}
+
+// NewBlock returns an empty block node.
+func NewBlock(key string) *Node {
+	return &Node{Key: key, block: true}
+}
+
+// IsBlock reports whether the node holds children rather than a value.
+func (n *Node) IsBlock() bool {
+	return n.block
+}
+
+// Find returns the first child whose key matches case-insensitively.
+func (n *Node) Find(key string) *Node {
+	for _, child := range n.Children {
+		if strings.EqualFold(child.Key, key) {
+			return child
+		}
+	}
+	return nil
+}
+
+// Parse reads a KeyValues document. Comments are discarded; quoted strings are
+// kept verbatim (backslashes are not interpreted) so paths round-trip intact.
+func Parse(r io.Reader) (*Node, error) {
+	p := &parser{r: bufio.NewReader(r), line: 1}
+	doc := NewBlock("")
+	if err := p.parseBlock(doc, true); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenString
+	tokenOpen
+	tokenClose
+	tokenCondition
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	line int
+}
+
+type parser struct {
+	r       *bufio.Reader
+	line    int
+	peeked  *token
+	peekErr error
+}
+
+func (p *parser) parseBlock(block *Node, root bool) error {
+	for {
+		tok, err := p.next()
+		if err != nil {
+			return err
+		}
+		switch tok.kind {
+		case tokenEOF:
+			if !root {
+				return fmt.Errorf("line %d: unexpected end of file inside %q", tok.line, block.Key)
+			}
+			return nil
+		case tokenClose:
+			if root {
+				return fmt.Errorf("line %d: unexpected }", tok.line)
+			}
+			return nil
+		case tokenString:
+		default:
+			return fmt.Errorf("line %d: expected key, found %q", tok.line, tok.text)
+		}
+
+		node := &Node{Key: tok.text}
+		value, err := p.next()
+		if err != nil {
+			return err
+		}
+		switch value.kind {
+		case tokenOpen:
+			node.block = true
+			if err := p.parseBlock(node, false); err != nil {
+				return err
+			}
+		case tokenString:
+			node.Value = value.text
+		case tokenCondition:
+			// Conditional before a block: "key" [$X360] { ... }
+			node.Condition = value.text
+			open, err := p.next()
+			if err != nil {
+				return err
+			}
+			if open.kind != tokenOpen {
+				return fmt.Errorf("line %d: expected { after condition for %q", open.line, node.Key)
+			}
+			node.block = true
+			if err := p.parseBlock(node, false); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("line %d: expected value for %q", value.line, node.Key)
+		}
+		if !node.block {
+			cond, err := p.peek()
+			if err != nil {
+				return err
+			}
+			if cond.kind == tokenCondition {
+				p.peeked = nil
+				node.Condition = cond.text
+			}
+		}
+		block.Children = append(block.Children, node)
+	}
+}
+
+func (p *parser) peek() (token, error) {
+	if p.peeked == nil && p.peekErr == nil {
+		tok, err := p.scan()
+		p.peeked, p.peekErr = &tok, err
+	}
+	if p.peekErr != nil {
+		return token{}, p.peekErr
+	}
+	return *p.peeked, nil
+}
+
+func (p *parser) next() (token, error) {
+	if p.peeked != nil || p.peekErr != nil {
+		tok, err := p.peek()
+		p.peeked, p.peekErr = nil, nil
+		return tok, err
+	}
+	return p.scan()
+}
+
+func (p *parser) scan() (token, error) {
+	for {
+		c, err := p.readRune()
+		if errors.Is(err, io.EOF) {
+			return token{kind: tokenEOF, line: p.line}, nil
+		}
+		if err != nil {
+			return token{}, err
+		}
+		switch {
+		case c == '\n':
+			p.line++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\uFEFF':
+		case c == '/':
+			next, err := p.r.ReadByte()
+			if err == nil && next == '/' {
+				if _, err := p.r.ReadString('\n'); err != nil && !errors.Is(err, io.EOF) {
+					return token{}, err
+				}
+				p.line++
+				continue
+			}
+			if err == nil {
+				p.r.UnreadByte()
+			}
+			return p.scanBare(c)
+		case c == '{':
+			return token{kind: tokenOpen, text: "{", line: p.line}, nil
+		case c == '}':
+			return token{kind: tokenClose, text: "}", line: p.line}, nil
+		case c == '"':
+			return p.scanQuoted()
+		case c == '[':
+			text, err := p.r.ReadString(']')
+			if err != nil {
+				return token{}, fmt.Errorf("line %d: unterminated condition", p.line)
+			}
+			return token{kind: tokenCondition, text: strings.TrimSuffix(text, "]"), line: p.line}, nil
+		default:
+			return p.scanBare(c)
+		}
+	}
+}
+
+func (p *parser) readRune() (rune, error) {
+	c, _, err := p.r.ReadRune()
+	return c, err
+}
+
+func (p *parser) scanQuoted() (token, error) {
+	start := p.line
+	var b strings.Builder
+	for {
+		c, err := p.readRune()
+		if err != nil {
+			return token{}, fmt.Errorf("line %d: unterminated string", start)
+		}
+		switch c {
+		case '"':
+			return token{kind: tokenString, text: b.String(), line: start}, nil
+		case '\\':
+			// Keep escapes verbatim but never let \" terminate the string.
+			b.WriteRune(c)
+			next, err := p.readRune()
+			if err != nil {
+				return token{}, fmt.Errorf("line %d: unterminated string", start)
+			}
+			if next == '\n' {
+				p.line++
+			}
+			b.WriteRune(next)
+		case '\n':
+			p.line++
+			b.WriteRune(c)
+		default:
+			b.WriteRune(c)
+		}
+	}
+}
+
+func (p *parser) scanBare(first rune) (token, error) {
+	var b strings.Builder
+	b.WriteRune(first)
+	for {
+		c, err := p.readRune()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return token{}, err
+		}
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '{' || c == '}' || c == '"' {
+			p.r.UnreadRune()
+			break
+		}
+		b.WriteRune(c)
+	}
+	return token{kind: tokenString, text: b.String(), line: p.line}, nil
+}
+
+// Write serialises a document produced by Parse using tab indentation.
+func Write(w io.Writer, doc *Node) error {
+	bw := bufio.NewWriter(w)
+	for _, child := range doc.Children {
+		writeNode(bw, child, 0)
+	}
+	return bw.Flush()
+}
+
+func writeNode(w *bufio.Writer, n *Node, depth int) {
+	indent := strings.Repeat("\t", depth)
+	if n.block {
+		fmt.Fprintf(w, "%s%s", indent, quote(n.Key))
+		if n.Condition != "" {
+			fmt.Fprintf(w, " [%s]", n.Condition)
+		}
+		fmt.Fprintf(w, "\n%s{\n", indent)
+		for _, child := range n.Children {
+			writeNode(w, child, depth+1)
+		}
+		fmt.Fprintf(w, "%s}\n", indent)
+		return
+	}
+	fmt.Fprintf(w, "%s%s\t%s", indent, quote(n.Key), quote(n.Value))
+	if n.Condition != "" {
+		fmt.Fprintf(w, " [%s]", n.Condition)
+	}
+	w.WriteByte('\n')
+}
+
+func quote(s string) string {
+	return `"` + s + `"`
+}
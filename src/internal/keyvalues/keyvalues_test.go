@@ -0,0 +1,123 @@
+package keyvalues
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseWriteRoundTrip(t *testing.T) {
+	input := "\uFEFF// metamod plugins\n" +
+		"\"Metamod Plugins\"\n{\n" +
+		"\t\"sourcemod\"\t\"addons\\sourcemod\\bin\\sourcemod_mm\" // comment\n" +
+		"\tstripper addons/stripper/bin/stripper_mm [$LINUX]\n" +
+		"}\n" +
+		"#base \"shared.vdf\"\n"
+	doc, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	plugins := doc.Find("metamod plugins")
+	if plugins == nil || !plugins.IsBlock() {
+		t.Fatalf("expected Metamod Plugins block, got %+v", plugins)
+	}
+	if got := plugins.Find("sourcemod").Value; got != `addons\sourcemod\bin\sourcemod_mm` {
+		t.Errorf("sourcemod value: got %q", got)
+	}
+	if got := plugins.Find("stripper").Condition; got != "$LINUX" {
+		t.Errorf("stripper condition: got %q", got)
+	}
+
+	var out bytes.Buffer
+	if err := Write(&out, doc); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	want := "\"Metamod Plugins\"\n{\n" +
+		"\t\"sourcemod\"\t\"addons\\sourcemod\\bin\\sourcemod_mm\"\n" +
+		"\t\"stripper\"\t\"addons/stripper/bin/stripper_mm\" [$LINUX]\n" +
+		"}\n" +
+		"\"#base\"\t\"shared.vdf\"\n"
+	if out.String() != want {
+		t.Errorf("write:\ngot  %q\nwant %q", out.String(), want)
+	}
+	reparsed, err := Parse(&out)
+	if err != nil {
+		t.Fatalf("reparse: %v", err)
+	}
+	if len(reparsed.Children) != 2 {
+		t.Errorf("reparsed document: got %d root keys, want 2", len(reparsed.Children))
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for name, input := range map[string]string{
+		"unterminated block":  "\"a\" { \"b\" \"c\"",
+		"unterminated string": "\"a\" \"b",
+		"stray close":         "}",
+		"missing value":       "\"a\"",
+	} {
+		if _, err := Parse(strings.NewReader(input)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestMergeDeepMergesAndReportsConflicts(t *testing.T) {
+	base, err := Parse(strings.NewReader(`"Databases"
+{
+	"driver_default"	"mysql"
+	"default"
+	{
+		"driver"	"default"
+		"host"	"localhost"
+	}
+}
+"SearchPaths"
+{
+	"game"	"tf"
+	"game"	"hl2"
+}`))
+	if err != nil {
+		t.Fatalf("parse base: %v", err)
+	}
+	overlay, err := Parse(strings.NewReader(`"databases"
+{
+	"default" { "HOST" "db.internal" }
+	"sourcebans"
+	{
+		"driver"	"mysql"
+		"database"	"sourcebans"
+	}
+}
+"SearchPaths"
+{
+	"game"	"tf/custom/*"
+	"game"	"tf"
+}`))
+	if err != nil {
+		t.Fatalf("parse overlay: %v", err)
+	}
+
+	conflicts := Merge(base, overlay)
+	if len(conflicts) != 1 {
+		t.Fatalf("expected 1 conflict, got %+v", conflicts)
+	}
+	if c := conflicts[0]; c.Path != "databases/default/HOST" || c.Previous != "localhost" || c.Value != "db.internal" {
+		t.Errorf("unexpected conflict %+v", c)
+	}
+
+	dbs := base.Find("Databases")
+	if got := dbs.Find("default").Find("host").Value; got != "db.internal" {
+		t.Errorf("default host: got %q", got)
+	}
+	if got := dbs.Find("sourcebans").Find("database").Value; got != "sourcebans" {
+		t.Errorf("sourcebans database: got %q", got)
+	}
+	var games []string
+	for _, child := range base.Find("SearchPaths").Children {
+		games = append(games, child.Value)
+	}
+	if strings.Join(games, ",") != "tf,hl2,tf/custom/*" {
+		t.Errorf("search paths: got %v", games)
+	}
+}
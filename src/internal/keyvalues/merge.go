@@ -0,0 +1,98 @@
+package keyvalues
+
+import "strings"
+
+// Conflict records a value that a later document replaced during Merge.
+type Conflict struct {
+	Path     string // Slash separated key path, e.g. Databases/default/host
+	Previous string
+	Value    string
+}
+
+// Merge deep-merges src into dst. Blocks with the same key (compared
+// case-insensitively, including the condition) are merged recursively and new
+// keys are appended. A value key that appears once in both blocks is replaced
+// and reported as a conflict when the value differs. Keys repeated within a
+// block, such as the SearchPaths entries in gameinfo.txt, are treated as a
+// list: values not yet present are appended instead of replacing.
+func Merge(dst, src *Node) []Conflict {
+	return mergeBlock(dst, src, "")
+}
+
+func mergeBlock(dst, src *Node, path string) []Conflict {
+	var conflicts []Conflict
+	for _, child := range src.Children {
+		childPath := joinPath(path, child.Key)
+		if child.block {
+			if existing := findMatch(dst, child, true); existing != nil {
+				conflicts = append(conflicts, mergeBlock(existing, child, childPath)...)
+				continue
+			}
+			dst.Children = append(dst.Children, clone(child))
+			continue
+		}
+		if countKey(src, child) > 1 || countKey(dst, child) > 1 {
+			if !hasPair(dst, child) {
+				dst.Children = append(dst.Children, clone(child))
+			}
+			continue
+		}
+		existing := findMatch(dst, child, false)
+		if existing == nil {
+			dst.Children = append(dst.Children, clone(child))
+			continue
+		}
+		if existing.Value != child.Value {
+			conflicts = append(conflicts, Conflict{Path: childPath, Previous: existing.Value, Value: child.Value})
+			existing.Value = child.Value
+		}
+	}
+	return conflicts
+}
+
+func sameKey(a, b *Node) bool {
+	return strings.EqualFold(a.Key, b.Key) && strings.EqualFold(a.Condition, b.Condition)
+}
+
+func findMatch(block, node *Node, wantBlock bool) *Node {
+	for _, child := range block.Children {
+		if child.block == wantBlock && sameKey(child, node) {
+			return child
+		}
+	}
+	return nil
+}
+
+func countKey(block, node *Node) int {
+	n := 0
+	for _, child := range block.Children {
+		if !child.block && sameKey(child, node) {
+			n++
+		}
+	}
+	return n
+}
+
+func hasPair(block, node *Node) bool {
+	for _, child := range block.Children {
+		if !child.block && sameKey(child, node) && child.Value == node.Value {
+			return true
+		}
+	}
+	return false
+}
+
+func clone(n *Node) *Node {
+	out := &Node{Key: n.Key, Value: n.Value, Condition: n.Condition, block: n.block}
+	for _, child := range n.Children {
+		out.Children = append(out.Children, clone(child))
+	}
+	return out
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "/" + key
+}
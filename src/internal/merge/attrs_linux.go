@@ -0,0 +1,99 @@
+package merge
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// preserveAttributes copies the selected metadata of src onto dest.
+// Timestamps are applied last so no other change bumps the mtime again.
+func preserveAttributes(src, dest string, attrs attributePolicy) error {
+	if !attrs.any() {
+		return nil
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("stat %s: no system metadata", src)
+	}
+	if attrs.ownership {
+		if err := os.Lchown(dest, int(st.Uid), int(st.Gid)); err != nil && !ignorePermError(err) {
+			return fmt.Errorf("chown %s: %w", dest, err)
+		}
+	}
+	if attrs.xattrs {
+		if err := copyXattrs(src, dest); err != nil {
+			return err
+		}
+	}
+	if attrs.timestamps {
+		atime := time.Unix(st.Atim.Sec, st.Atim.Nsec)
+		if err := os.Chtimes(dest, atime, info.ModTime()); err != nil && !ignorePermError(err) {
+			return fmt.Errorf("chtimes %s: %w", dest, err)
+		}
+	}
+	return nil
+}
+
+func copyXattrs(src, dest string) error {
+	names, err := listXattrs(src)
+	if err != nil {
+		if errors.Is(err, syscall.ENOTSUP) {
+			return nil
+		}
+		return fmt.Errorf("list xattrs %s: %w", src, err)
+	}
+	for _, name := range names {
+		value, err := getXattr(src, name)
+		if err != nil {
+			return fmt.Errorf("get xattr %s on %s: %w", name, src, err)
+		}
+		if err := syscall.Setxattr(dest, name, value, 0); err != nil {
+			// security.* and trusted.* need privileges; unsupported filesystems refuse all.
+			if ignorePermError(err) || errors.Is(err, syscall.ENOTSUP) {
+				continue
+			}
+			return fmt.Errorf("set xattr %s on %s: %w", name, dest, err)
+		}
+	}
+	return nil
+}
+
+func listXattrs(path string) ([]string, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+	return names, nil
+}
+
+func getXattr(path, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Getxattr(path, name, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:size], nil
+}
@@ -0,0 +1,98 @@
+package merge
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/UDL-TF/TF2Chart/src/internal/config"
+)
+
+// TestCopyTemplatePreservesAttributes tests that mtimes and user xattrs of
+// template files are carried over when requested.
+func TestCopyTemplatePreservesAttributes(t *testing.T) {
+	base := t.TempDir()
+	targetBase := filepath.Join(t.TempDir(), "view")
+	targetContent := filepath.Join(targetBase, "tf")
+	if err := os.MkdirAll(targetContent, 0o755); err != nil {
+		t.Fatalf("mkdir target content: %v", err)
+	}
+	source := filepath.Join(base, "plugins", "admin.smx")
+	writeFile(t, source, "plugin")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(source, mtime, mtime); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	xattrSupported := syscall.Setxattr(source, "user.tf2chart", []byte("yes"), 0) == nil
+
+	cfg := &config.MergeConfig{
+		BasePath:      base,
+		TargetBase:    targetBase,
+		TargetContent: targetContent,
+		CopyTemplates: []config.CopyTemplate{
+			{
+				SourceMount: base,
+				SourcePath:  "plugins",
+				TargetPath:  "tf/addons/sourcemod/plugins",
+				Clean:       true,
+				TargetMode:  "writable",
+				PreserveAttributes: &config.AttributePolicy{
+					Ownership:  true,
+					Timestamps: true,
+					Xattrs:     true,
+				},
+			},
+		},
+		Permissions: config.PermissionPhase{},
+	}
+	m, err := New(cfg)
+	if err != nil {
+		t.Fatalf("new merger: %v", err)
+	}
+	if err := m.Run(context.Background()); err != nil {
+		t.Fatalf("run merge: %v", err)
+	}
+
+	target := filepath.Join(targetContent, "addons", "sourcemod", "plugins", "admin.smx")
+	info, err := os.Stat(target)
+	if err != nil {
+		t.Fatalf("stat copied file: %v", err)
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("mtime: got %v, want %v", info.ModTime(), mtime)
+	}
+	if xattrSupported {
+		buf := make([]byte, 16)
+		n, err := syscall.Getxattr(target, "user.tf2chart", buf)
+		if err != nil {
+			t.Fatalf("get xattr: %v", err)
+		}
+		if string(buf[:n]) != "yes" {
+			t.Errorf("xattr: got %q, want %q", string(buf[:n]), "yes")
+		}
+	}
+}
+
+// TestCopyFileKeepsHoles tests that sparse sources are not inflated by copies.
+func TestCopyFileKeepsHoles(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "map.bsp")
+	writeSparseFile(t, src, 64<<20)
+	dest := filepath.Join(dir, "copy", "map.bsp")
+	if err := copyFile(src, dest, 0o644); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	info, err := os.Stat(dest)
+	if err != nil {
+		t.Fatalf("stat copy: %v", err)
+	}
+	if info.Size() != 64<<20 {
+		t.Fatalf("size: got %d, want %d", info.Size(), 64<<20)
+	}
+	if allocated := info.Sys().(*syscall.Stat_t).Blocks * 512; allocated > 1<<20 {
+		t.Errorf("copy allocated %d bytes for a sparse source", allocated)
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package merge
+
+import (
+	"fmt"
+	"os"
+)
+
+// preserveAttributes only supports timestamps outside Linux.
+func preserveAttributes(src, dest string, attrs attributePolicy) error {
+	if !attrs.any() {
+		return nil
+	}
+	if attrs.ownership || attrs.xattrs {
+		return fmt.Errorf("preserving ownership and xattrs is only supported on linux")
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dest, info.ModTime(), info.ModTime())
+}
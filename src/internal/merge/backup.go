@@ -0,0 +1,423 @@
+package merge
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/UDL-TF/TF2Chart/src/internal/config"
+)
+
+const (
+	backupFormatTarGz = "tar.gz"
+	backupFormatDir   = "dir"
+	defaultRetain     = 5
+	// backupDigestFile records the digest of the destination as the template
+	// last left it, so untouched destinations are not snapshotted on every
+	// watcher cycle and only runtime edits produce new snapshots.
+	backupDigestFile = ".last-digest"
+)
+
+func validateBackup(name string, policy *config.BackupPolicy, root string) error {
+	if policy == nil {
+		return nil
+	}
+	if strings.TrimSpace(root) == "" {
+		return fmt.Errorf("template %s: backup requires backupRoot", name)
+	}
+	switch policy.Format {
+	case "", backupFormatTarGz, backupFormatDir:
+	default:
+		return fmt.Errorf("template %s: unknown backup format %q", name, policy.Format)
+	}
+	if policy.Retain < 0 {
+		return fmt.Errorf("template %s: backup retain must not be negative", name)
+	}
+	return nil
+}
+
+// backupRecord is what backupDigestFile holds: the digest of the destination
+// as the template left it and a fingerprint of the sources it was copied from.
+type backupRecord struct {
+	digest string
+	source string
+}
+
+func readBackupRecord(dir string) backupRecord {
+	data, err := os.ReadFile(filepath.Join(dir, backupDigestFile))
+	if err != nil {
+		return backupRecord{}
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	rec := backupRecord{digest: strings.TrimSpace(lines[0])}
+	if len(lines) > 1 {
+		rec.source = strings.TrimSpace(lines[1])
+	}
+	return rec
+}
+
+// backupDestination snapshots dest into root/<name>/<timestamp> before clean
+// mode removes it and prunes snapshots beyond the retention count. It reports
+// whether the entries the template owns were still exactly as it left them;
+// preserved and excluded runtime files do not count as changes.
+func backupDestination(dest string, opts copyOptions) (bool, error) {
+	if opts.backup == nil || opts.backupRoot == "" {
+		return false, nil
+	}
+	entries, err := os.ReadDir(dest)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("read backup source %s: %w", dest, err)
+	}
+	if len(entries) == 0 {
+		return false, nil
+	}
+	digest, err := treeDigest(dest, opts.owns)
+	if err != nil {
+		return false, fmt.Errorf("digest %s: %w", dest, err)
+	}
+	dir, err := backupDir(opts.backupRoot, opts.backupName)
+	if err != nil {
+		return false, err
+	}
+	if readBackupRecord(dir).digest == digest {
+		log.Printf("backup: %s unchanged since last copy, skipping", dest)
+		return true, nil
+	}
+
+	stamp := time.Now().UTC().Format("20060102T150405.000Z")
+	var snapshot string
+	switch opts.backup.Format {
+	case backupFormatDir:
+		snapshot = uniqueBackupPath(filepath.Join(dir, stamp), "")
+		err = snapshotDir(dest, snapshot)
+	default:
+		snapshot = uniqueBackupPath(filepath.Join(dir, stamp), ".tar.gz")
+		err = snapshotTarGz(dest, snapshot)
+	}
+	if err != nil {
+		return false, fmt.Errorf("snapshot %s: %w", dest, err)
+	}
+	log.Printf("backup: snapshotted %s -> %s", dest, snapshot)
+
+	retain := opts.backup.Retain
+	if retain == 0 {
+		retain = defaultRetain
+	}
+	return false, pruneBackups(dir, retain)
+}
+
+// recordBackupDigest stores the digest of dest after a template copy so the
+// next backupDestination call can tell whether anything changed since. When
+// dest was unchanged before the copy and the sources are too, the copy
+// reproduced the recorded tree and dest is not hashed again. Rendered
+// templates also depend on secrets and the environment, so they are always
+// hashed.
+func recordBackupDigest(src, dest string, opts copyOptions, unchanged bool) error {
+	if opts.backup == nil || opts.backupRoot == "" {
+		return nil
+	}
+	dir, err := backupDir(opts.backupRoot, opts.backupName)
+	if err != nil {
+		return err
+	}
+	source, err := treeFingerprint(src, opts.owns)
+	if err != nil {
+		return fmt.Errorf("fingerprint %s: %w", src, err)
+	}
+	if unchanged && len(opts.render) == 0 && readBackupRecord(dir).source == source {
+		return nil
+	}
+	digest, err := treeDigest(dest, opts.owns)
+	if err != nil {
+		return fmt.Errorf("digest %s: %w", dest, err)
+	}
+	return os.WriteFile(filepath.Join(dir, backupDigestFile), []byte(digest+"\n"+source+"\n"), 0o644)
+}
+
+// backupDirName flattens a template target path into a single directory name.
+// A hash of the path keeps targets like tf/a_b and tf_a/b apart.
+func backupDirName(name string) string {
+	legacy := legacyBackupDirName(name)
+	if legacy == "root" {
+		return legacy
+	}
+	cleaned := strings.Trim(filepath.ToSlash(filepath.Clean(name)), "/")
+	sum := sha256.Sum256([]byte(cleaned))
+	return legacy + "-" + hex.EncodeToString(sum[:4])
+}
+
+// backupDir returns the backup directory of the template targeting name,
+// creating it. Backups written under the name earlier versions used, without
+// the hash suffix, are moved over the first time.
+func backupDir(root, name string) (string, error) {
+	dir := filepath.Join(root, backupDirName(name))
+	legacy := filepath.Join(root, legacyBackupDirName(name))
+	if legacy != dir {
+		if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+			if info, err := os.Stat(legacy); err == nil && info.IsDir() {
+				log.Printf("backup: moving %s to %s", legacy, dir)
+				if err := os.Rename(legacy, dir); err != nil {
+					return "", fmt.Errorf("migrate backups %s: %w", legacy, err)
+				}
+			}
+		}
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// legacyBackupDirName is the directory name used before backupDirName added
+// its hash suffix.
+func legacyBackupDirName(name string) string {
+	cleaned := strings.Trim(filepath.ToSlash(filepath.Clean(name)), "/")
+	if cleaned == "" || cleaned == "." {
+		return "root"
+	}
+	return strings.ReplaceAll(cleaned, "/", "_")
+}
+
+// uniqueBackupPath returns base+ext, or base_NNN+ext when that exists. The
+// suffix sorts after base+ext, so pruning keeps the newer snapshot.
+func uniqueBackupPath(base, ext string) string {
+	candidate := base + ext
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(candidate); errors.Is(err, os.ErrNotExist) {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s_%03d%s", base, i, ext)
+	}
+}
+
+func pruneBackups(dir string, retain int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var snapshots []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		// Snapshots interrupted by a crash are never completed
+		if strings.HasSuffix(name, ".tmp") {
+			log.Printf("backup: removing incomplete snapshot %s", filepath.Join(dir, name))
+			if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+				return err
+			}
+			continue
+		}
+		snapshots = append(snapshots, name)
+	}
+	if len(snapshots) <= retain {
+		return nil
+	}
+	sort.Strings(snapshots)
+	for _, name := range snapshots[:len(snapshots)-retain] {
+		log.Printf("backup: pruning old snapshot %s", filepath.Join(dir, name))
+		if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// treeFingerprint hashes the names, modes, sizes, modification times and link
+// targets of the entries below root that include accepts, without reading file
+// contents.
+func treeFingerprint(root string, include func(rel string) bool) (string, error) {
+	hash := sha256.New()
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel != "." && !include(rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%s\x00%o\x00%d\x00%d\x00", filepath.ToSlash(rel), info.Mode(), info.Size(), info.ModTime().UnixNano())
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			io.WriteString(hash, link)
+		}
+		hash.Write([]byte{0})
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// treeDigest hashes the names, modes, link targets and file contents of the
+// entries below root that include accepts.
+func treeDigest(root string, include func(rel string) bool) (string, error) {
+	hash := sha256.New()
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel != "." && !include(rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%s\x00%o\x00", filepath.ToSlash(rel), info.Mode())
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			io.WriteString(hash, link)
+		case info.Mode().IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(hash, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+		hash.Write([]byte{0})
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func snapshotTarGz(src, archive string) error {
+	tmp := archive + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	walkErr := filepath.WalkDir(src, func(path string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	err = errors.Join(walkErr, tw.Close(), gz.Close(), out.Close())
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, archive)
+}
+
+func snapshotDir(src, dest string) error {
+	tmp := dest + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(tmp, rel)
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, dirMode(d))
+		case d.Type()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case d.Type().IsRegular():
+			return copyFile(path, target, fileMode(d))
+		}
+		return nil
+	})
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
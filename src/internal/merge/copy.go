@@ -0,0 +1,60 @@
+package merge
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+)
+
+// copyMethod names the strategy copyContents used to move the data.
+type copyMethod string
+
+const (
+	copyReflink   copyMethod = "reflink"
+	copyFileRange copyMethod = "copy_file_range"
+	copyBuffered  copyMethod = "buffered"
+)
+
+const copyBlockSize = 128 << 10
+
+var zeroBlock = make([]byte, copyBlockSize)
+
+// copyContents copies size bytes of src into dst. It prefers a reflink, then
+// an in-kernel copy and finally a buffered copy; every strategy keeps holes in
+// sparse sources.
+func copyContents(dst, src *os.File, size int64) (copyMethod, error) {
+	if size > 0 {
+		if method, ok := fastCopy(dst, src, size); ok {
+			return method, nil
+		}
+	}
+	return copyBuffered, bufferedCopy(dst, src)
+}
+
+// bufferedCopy copies through user space and skips all-zero blocks so they
+// stay unallocated in dst. dst is truncated first because a failed fast path
+// may have left partial data behind.
+func bufferedCopy(dst, src *os.File) error {
+	if err := dst.Truncate(0); err != nil {
+		return err
+	}
+	buf := make([]byte, copyBlockSize)
+	var off int64
+	for {
+		n, err := src.ReadAt(buf, off)
+		if n > 0 && !bytes.Equal(buf[:n], zeroBlock[:n]) {
+			if _, werr := dst.WriteAt(buf[:n], off); werr != nil {
+				return werr
+			}
+		}
+		off += int64(n)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return dst.Truncate(off)
+}
@@ -0,0 +1,70 @@
+package merge
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	ficlone  = 0x40049409 // _IOW(0x94, 9, int)
+	seekData = 3
+	seekHole = 4
+)
+
+// fastCopy tries a FICLONE reflink, which shares extents on btrfs/XFS and
+// friends, and then copy_file_range over the data regions of src. It reports
+// false when neither is available so the caller falls back to a buffered copy.
+func fastCopy(dst, src *os.File, size int64) (copyMethod, bool) {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd()); errno == 0 {
+		return copyReflink, true
+	}
+	if sysCopyFileRange == 0 {
+		return "", false
+	}
+	// Holes are skipped below, so nothing from a previous file may remain.
+	if err := dst.Truncate(0); err != nil {
+		return "", false
+	}
+	for off := int64(0); off < size; {
+		data, err := src.Seek(off, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			break // only a trailing hole remains
+		}
+		if err != nil {
+			data = off // no SEEK_DATA support: treat the rest as data
+		}
+		hole, err := src.Seek(data, seekHole)
+		if err != nil || hole > size {
+			hole = size
+		}
+		if err := copyRange(dst, src, data, hole-data); err != nil {
+			return "", false
+		}
+		off = hole
+	}
+	if err := dst.Truncate(size); err != nil {
+		return "", false
+	}
+	return copyFileRange, true
+}
+
+// copyRange copies n bytes at off from src to the same offset in dst.
+func copyRange(dst, src *os.File, off, n int64) error {
+	inOff, outOff := off, off
+	for n > 0 {
+		copied, _, errno := syscall.Syscall6(sysCopyFileRange,
+			src.Fd(), uintptr(unsafe.Pointer(&inOff)),
+			dst.Fd(), uintptr(unsafe.Pointer(&outOff)),
+			uintptr(n), 0)
+		if errno != 0 {
+			return errno
+		}
+		if copied == 0 {
+			return syscall.EIO // source shrank underneath us
+		}
+		n -= int64(copied)
+	}
+	return nil
+}
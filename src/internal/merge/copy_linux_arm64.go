@@ -0,0 +1,3 @@
+package merge
+
+const sysCopyFileRange = 285
@@ -0,0 +1,7 @@
+//go:build linux && !amd64 && !arm64
+
+package merge
+
+// sysCopyFileRange is unset on architectures without a known syscall number;
+// copies there use reflinks or the buffered path.
+const sysCopyFileRange = 0
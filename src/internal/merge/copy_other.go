@@ -0,0 +1,10 @@
+//go:build !linux
+
+package merge
+
+import "os"
+
+// fastCopy has no kernel-assisted strategy outside Linux.
+func fastCopy(dst, src *os.File, size int64) (copyMethod, bool) {
+	return "", false
+}
@@ -0,0 +1,69 @@
+package merge
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/UDL-TF/TF2Chart/src/internal/fastdl"
+)
+
+// mirrorSync updates the FastDL mirror in the background, so compressing new
+// content never holds up a merge. A merge that finishes while a sync is still
+// running only requests one more pass, which picks up the latest view.
+type mirrorSync struct {
+	mirror *fastdl.Mirror
+
+	mu      sync.Mutex
+	running bool
+	pending bool
+	done    chan struct{}
+	err     error
+}
+
+// start syncs the mirror in a new goroutine, or schedules another pass after
+// the running one.
+func (s *mirrorSync) start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		s.pending = true
+		return
+	}
+	s.running = true
+	s.done = make(chan struct{})
+	go s.run(ctx, s.done)
+}
+
+func (s *mirrorSync) run(ctx context.Context, done chan struct{}) {
+	for {
+		_, err := s.mirror.Sync(ctx)
+		if err != nil {
+			log.Printf("fastdl: sync failed: %v", err)
+		}
+
+		s.mu.Lock()
+		s.err = err
+		if !s.pending || ctx.Err() != nil {
+			s.running, s.pending = false, false
+			close(done)
+			s.mu.Unlock()
+			return
+		}
+		s.pending = false
+		s.mu.Unlock()
+	}
+}
+
+// wait blocks until no sync is running and returns the error of the last one.
+func (s *mirrorSync) wait() error {
+	for {
+		s.mu.Lock()
+		running, done, err := s.running, s.done, s.err
+		s.mu.Unlock()
+		if !running {
+			return err
+		}
+		<-done
+	}
+}
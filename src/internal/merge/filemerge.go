@@ -0,0 +1,245 @@
+package merge
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/UDL-TF/TF2Chart/src/internal/config"
+	"github.com/UDL-TF/TF2Chart/src/internal/keyvalues"
+)
+
+const (
+	strategyLines     = "lines"
+	strategyKeyValues = "keyvalues"
+)
+
+// contentLayer is one source contributing to the content tree, in precedence order.
+type contentLayer struct {
+	name string
+	root string
+}
+
+// fileMergePlan lists every layer contribution to a single merged file.
+type fileMergePlan struct {
+	rel     string
+	rule    config.FileMerge
+	sources []layerFile
+}
+
+type layerFile struct {
+	layer string
+	path  string
+}
+
+// fileMergeFunc combines the contributions of every layer into one file body.
+type fileMergeFunc func(rule config.FileMerge, sources []layerFile) ([]byte, error)
+
+var fileMergers = map[string]fileMergeFunc{
+	strategyLines:     mergeLines,
+	strategyKeyValues: mergeKeyValues,
+}
+
+func validateFileMerges(rules []config.FileMerge) error {
+	for _, rule := range rules {
+		if strings.TrimSpace(rule.Path) == "" {
+			return errors.New("file merge path must not be empty")
+		}
+		if _, ok := fileMergers[rule.Strategy]; !ok {
+			return fmt.Errorf("file merge %s: unknown strategy %q", rule.Path, rule.Strategy)
+		}
+		if _, err := filepath.Match(rule.Path, ""); err != nil {
+			return fmt.Errorf("file merge %s: %w", rule.Path, err)
+		}
+	}
+	return nil
+}
+
+// contentLayers returns the base content root followed by every overlay.
+func (m *Merger) contentLayers() []contentLayer {
+	var layers []contentLayer
+	if rel, err := filepath.Rel(m.cfg.TargetBase, m.cfg.TargetContent); err == nil && !strings.HasPrefix(rel, "..") {
+		layers = append(layers, contentLayer{name: "base", root: filepath.Join(m.cfg.BasePath, rel)})
+	}
+	for _, ov := range m.cfg.Overlays {
+		layers = append(layers, contentLayer{name: ov.Name, root: ov.SourcePath})
+	}
+	return layers
+}
+
+// planFileMerges resolves the configured globs against every layer. Paths
+// matched by several rules use the first rule.
+func planFileMerges(rules []config.FileMerge, layers []contentLayer, excludePaths []string) ([]fileMergePlan, error) {
+	excluded := make(map[string]bool, len(excludePaths))
+	for _, excl := range excludePaths {
+		excluded[filepath.Clean(excl)] = true
+	}
+	byRel := make(map[string]*fileMergePlan)
+	var order []string
+	for _, rule := range rules {
+		pattern := filepath.Clean(strings.TrimPrefix(rule.Path, "/"))
+		for _, layer := range layers {
+			matches, err := filepath.Glob(filepath.Join(layer.root, pattern))
+			if err != nil {
+				return nil, fmt.Errorf("file merge %s: %w", rule.Path, err)
+			}
+			sort.Strings(matches)
+			for _, match := range matches {
+				info, err := os.Stat(match)
+				if err != nil || !info.Mode().IsRegular() {
+					continue
+				}
+				rel, err := filepath.Rel(layer.root, match)
+				if err != nil {
+					return nil, err
+				}
+				if excluded[rel] {
+					continue
+				}
+				plan, ok := byRel[rel]
+				if !ok {
+					plan = &fileMergePlan{rel: rel, rule: rule}
+					byRel[rel] = plan
+					order = append(order, rel)
+				}
+				if plan.rule.Path != rule.Path {
+					continue
+				}
+				plan.sources = append(plan.sources, layerFile{layer: layer.name, path: match})
+			}
+		}
+	}
+	plans := make([]fileMergePlan, 0, len(order))
+	for _, rel := range order {
+		plans = append(plans, *byRel[rel])
+	}
+	return plans, nil
+}
+
+// applyFileMerges writes each planned file as a real file below targetContent,
+// leaving it untouched when the merged content is already current. Files
+// generated by an earlier merge that no layer provides any more are removed;
+// statePath records the generated files between merges.
+func applyFileMerges(plans []fileMergePlan, targetContent, statePath string) error {
+	var previous []string
+	loadState(statePath, &previous)
+	generated := make([]string, 0, len(plans))
+	planned := make(map[string]bool, len(plans))
+	for _, plan := range plans {
+		target := filepath.Join(targetContent, plan.rel)
+		generated = append(generated, target)
+		planned[target] = true
+	}
+	for _, target := range previous {
+		if planned[target] {
+			continue
+		}
+		// A layer's symlink may already have taken the path over
+		if info, err := os.Lstat(target); err == nil && info.Mode().IsRegular() {
+			log.Printf("file merge: removing %s, no layer provides it any more", target)
+			if err := os.Remove(target); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+
+	for _, plan := range plans {
+		body, err := fileMergers[plan.rule.Strategy](plan.rule, plan.sources)
+		if err != nil {
+			return fmt.Errorf("file merge %s: %w", plan.rel, err)
+		}
+		target := filepath.Join(targetContent, plan.rel)
+		if info, err := os.Lstat(target); err == nil && info.Mode().IsRegular() {
+			if current, err := os.ReadFile(target); err == nil && bytes.Equal(current, body) {
+				continue
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+		if err := os.Remove(target); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := os.WriteFile(target, body, 0o644); err != nil {
+			return fmt.Errorf("write merged file %s: %w", target, err)
+		}
+		log.Printf("file merge: wrote %s from %d layers (%s)", target, len(plan.sources), plan.rule.Strategy)
+	}
+	if err := saveState(statePath, generated, len(generated) == 0); err != nil {
+		return fmt.Errorf("save merged files: %w", err)
+	}
+	return nil
+}
+
+// mergeLines concatenates every contribution in precedence order, optionally
+// dropping lines already emitted by an earlier layer.
+func mergeLines(rule config.FileMerge, sources []layerFile) ([]byte, error) {
+	prefix := rule.CommentPrefix
+	if prefix == "" {
+		prefix = "//"
+	}
+	seen := make(map[string]bool)
+	var out bytes.Buffer
+	for i, src := range sources {
+		content, err := os.ReadFile(src.path)
+		if err != nil {
+			return nil, err
+		}
+		if rule.Headers {
+			if i > 0 {
+				out.WriteByte('\n')
+			}
+			fmt.Fprintf(&out, "%s --- %s ---\n", prefix, src.layer)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(content))
+		scanner.Buffer(make([]byte, 64*1024), len(content)+1)
+		for scanner.Scan() {
+			line := strings.TrimRight(scanner.Text(), "\r")
+			key := strings.TrimSpace(line)
+			if rule.Dedupe && key != "" {
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+			}
+			out.WriteString(line)
+			out.WriteByte('\n')
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("read %s: %w", src.path, err)
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// mergeKeyValues deep-merges KeyValues documents from every layer, later layers
+// overriding earlier ones, and logs each overridden key.
+func mergeKeyValues(rule config.FileMerge, sources []layerFile) ([]byte, error) {
+	merged := keyvalues.NewBlock("")
+	for _, src := range sources {
+		f, err := os.Open(src.path)
+		if err != nil {
+			return nil, err
+		}
+		doc, err := keyvalues.Parse(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", src.path, err)
+		}
+		for _, conflict := range keyvalues.Merge(merged, doc) {
+			log.Printf("file merge warning: %s key %q: layer %s replaced %q with %q",
+				src.path, conflict.Path, src.layer, conflict.Previous, conflict.Value)
+		}
+	}
+	var out bytes.Buffer
+	if err := keyvalues.Write(&out, merged); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,44 @@
+package merge
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// matchAny reports whether rel (a slash or OS separated path relative to a
+// template root) is covered by any of the glob patterns. A pattern matches
+// when it matches rel itself or one of its parent directories, so "data"
+// covers everything below data/. Patterns without a slash are matched against
+// every path component, which lets "*.sq3" match files at any depth.
+func matchAny(patterns []string, rel string) bool {
+	if len(patterns) == 0 {
+		return false
+	}
+	rel = filepath.ToSlash(filepath.Clean(rel))
+	if rel == "." || rel == "" {
+		return false
+	}
+	parts := strings.Split(rel, "/")
+	for _, raw := range patterns {
+		pattern := strings.Trim(filepath.ToSlash(strings.TrimSpace(raw)), "/")
+		if pattern == "" {
+			continue
+		}
+		if !strings.Contains(pattern, "/") {
+			for _, part := range parts {
+				if ok, _ := path.Match(pattern, part); ok {
+					return true
+				}
+			}
+			continue
+		}
+		for i := range parts {
+			prefix := strings.Join(parts[:i+1], "/")
+			if ok, _ := path.Match(pattern, prefix); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -4,23 +4,27 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io"
 	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/UDL-TF/TF2Chart/src/internal/config"
 	"github.com/UDL-TF/TF2Chart/src/internal/decompress"
+	"github.com/UDL-TF/TF2Chart/src/internal/fastdl"
+	"github.com/UDL-TF/TF2Chart/src/internal/permissions"
 )
 
 // Merger renders the merged TF2 content tree according to MergeConfig.
 type Merger struct {
-	cfg      *config.MergeConfig
-	firstRun bool
+	cfg         *config.MergeConfig
+	firstRun    bool
+	pipeline    *pipeline
+	permissions permissions.Rules
+	fastdl      *mirrorSync
 }
 
 // New creates a Merger from the supplied configuration.
@@ -37,7 +41,39 @@ func New(cfg *config.MergeConfig) (*Merger, error) {
 	if err := config.ValidatePath(cfg.TargetContent); err != nil {
 		return nil, fmt.Errorf("invalid targetContent: %w", err)
 	}
-	return &Merger{cfg: cfg, firstRun: true}, nil
+	if err := validateFileMerges(cfg.FileMerges); err != nil {
+		return nil, err
+	}
+	for _, tpl := range cfg.CopyTemplates {
+		if err := validateBackup(tpl.TargetPath, tpl.Backup, cfg.BackupRoot); err != nil {
+			return nil, err
+		}
+	}
+	for _, wp := range cfg.WritablePaths {
+		if wp.Template == nil {
+			continue
+		}
+		if err := validateBackup(wp.Path, wp.Template.Backup, cfg.BackupRoot); err != nil {
+			return nil, err
+		}
+	}
+	transformers, err := buildTransformers(cfg.Transforms)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := permissions.Compile(cfg.Permissions.Rules)
+	if err != nil {
+		return nil, err
+	}
+	var syncer *mirrorSync
+	if fd := cfg.FastDL; fd != nil && fd.OutputDir != "" {
+		mirror, err := fastdl.New(cfg.TargetContent, fd.OutputDir, fastdl.Options{Dirs: fd.Dirs, Level: fd.Level, Workers: fd.Workers})
+		if err != nil {
+			return nil, err
+		}
+		syncer = &mirrorSync{mirror: mirror}
+	}
+	return &Merger{cfg: cfg, firstRun: true, pipeline: newPipeline(transformers, cfg.TargetContent, filepath.Join(cfg.TargetBase, transformStateName)), permissions: rules, fastdl: syncer}, nil
 }
 
 // Run executes a full merge pass.
@@ -49,15 +85,36 @@ func (m *Merger) Run(ctx context.Context) error {
 		return err
 	}
 
-	// Decompress any .bz2 files in configured paths before merging
+	// Decompress any compressed files and archives in configured paths before merging
 	if len(m.cfg.DecompressPaths) > 0 {
-		decompressor := decompress.NewWithOutputDir(m.cfg.DecompressPaths, m.cfg.DecompressionOutputDir)
+		limits := m.cfg.Decompression
+		decompressor := decompress.NewWithOptions(m.cfg.DecompressPaths, decompress.Options{
+			OutputDir:         m.cfg.DecompressionOutputDir,
+			Workers:           limits.Workers,
+			MaxBytesPerSecond: int64(limits.MaxMBPerSecond * (1 << 20)),
+			Priority:          decompress.Priority{Nice: limits.Nice, IOClass: limits.IOClass, IOLevel: limits.IOLevel},
+			Limits: decompress.Limits{
+				MaxFileBytes:  int64(limits.MaxFileMB * (1 << 20)),
+				MaxRatio:      limits.MaxRatio,
+				MaxTotalBytes: int64(limits.MaxTotalMB * (1 << 20)),
+				MinFreeBytes:  int64(limits.MinFreeMB * (1 << 20)),
+			},
+		})
 		if err := decompressor.Run(); err != nil {
 			return fmt.Errorf("decompress: %w", err)
 		}
 	}
 
-	if err := mergeTree(m.cfg.BasePath, m.cfg.TargetBase, nil); err != nil {
+	// Files combined from several layers are generated below, so keep
+	// mergeTree from replacing them with a single layer's symlink.
+	fileMerges, err := planFileMerges(m.cfg.FileMerges, m.contentLayers(), m.cfg.ExcludePaths)
+	if err != nil {
+		return err
+	}
+	baseExcludes, overlayExcludes := m.mergeExcludes(fileMerges)
+
+	m.pipeline.load()
+	if err := mergeTree(m.cfg.BasePath, m.cfg.TargetBase, baseExcludes, m.pipeline); err != nil {
 		return fmt.Errorf("merge base: %w", err)
 	}
 	for _, ov := range m.cfg.Overlays {
@@ -66,36 +123,106 @@ func (m *Merger) Run(ctx context.Context) error {
 			return ctx.Err()
 		default:
 		}
-		if err := mergeTree(ov.SourcePath, m.cfg.TargetContent, m.cfg.ExcludePaths); err != nil {
+		if err := mergeTree(ov.SourcePath, m.cfg.TargetContent, overlayExcludes, m.pipeline); err != nil {
 			return fmt.Errorf("merge overlay %s: %w", ov.Name, err)
 		}
 	}
+	if err := m.pipeline.flush(); err != nil {
+		return fmt.Errorf("transform files: %w", err)
+	}
+	if err := m.pipeline.pruneOutputs(); err != nil {
+		return fmt.Errorf("prune transformed files: %w", err)
+	}
+	if err := m.pipeline.save(); err != nil {
+		return fmt.Errorf("save transformed files: %w", err)
+	}
+	if err := applyFileMerges(fileMerges, m.cfg.TargetContent, filepath.Join(m.cfg.TargetBase, fileMergeStateName)); err != nil {
+		return err
+	}
 	if err := ensureWritablePaths(m.cfg.TargetBase, m.cfg.WritablePaths); err != nil {
 		return err
 	}
-	if err := copyTemplateDirs(m.cfg.CopyTemplates, m.cfg.TargetBase, m.cfg.TargetContent, m.firstRun); err != nil {
+	env := templateEnv{backupRoot: m.cfg.BackupRoot}
+	if m.rendersTemplates() {
+		data, err := loadRenderData(m.cfg.SecretDirs)
+		if err != nil {
+			return fmt.Errorf("load render data: %w", err)
+		}
+		env.render = data
+	}
+	if err := copyTemplateDirs(m.cfg.CopyTemplates, m.cfg.TargetBase, m.cfg.TargetContent, env, m.firstRun); err != nil {
 		return err
 	}
-	if err := copyWritableTemplates(m.cfg.TargetBase, m.cfg.WritablePaths); err != nil {
+	if err := copyWritableTemplates(m.cfg.TargetBase, m.cfg.WritablePaths, env); err != nil {
 		return err
 	}
 	if err := pruneDanglingSymlinks(m.cfg.TargetBase, m.cfg.TargetContent); err != nil {
 		return err
 	}
 	if m.cfg.Permissions.ApplyDuringMerge {
-		mode, err := parseFileMode(m.cfg.Permissions.Mode)
-		if err != nil {
-			return fmt.Errorf("permissions mode: %w", err)
+		opts := permissions.Options{
+			Parallelism: m.cfg.Permissions.Parallelism,
+			Progress:    time.Duration(m.cfg.Permissions.ProgressSeconds) * time.Second,
 		}
-		if err := applyPermissions(m.cfg.Permissions.ApplyPaths, m.cfg.Permissions.User, m.cfg.Permissions.Group, mode); err != nil {
+		if err := applyPermissions(ctx, m.cfg.Permissions.ApplyPaths, m.permissions, opts); err != nil {
 			return err
 		}
 	}
+	// Mirror the finished view in the background; compressing new content
+	// can take a while
+	if m.fastdl != nil {
+		m.fastdl.start(ctx)
+	}
 	m.firstRun = false
 	return nil
 }
 
-func mergeTree(src, dest string, excludePaths []string) error {
+// Wait blocks until the FastDL mirror update started by the last Run has
+// finished and returns its error. Without a mirror it returns immediately.
+func (m *Merger) Wait() error {
+	if m.fastdl == nil {
+		return nil
+	}
+	return m.fastdl.wait()
+}
+
+// mergeExcludes extends the configured exclusions with every generated file,
+// relative to the base target and the content target respectively.
+func (m *Merger) mergeExcludes(plans []fileMergePlan) ([]string, []string) {
+	if len(plans) == 0 {
+		return nil, m.cfg.ExcludePaths
+	}
+	contentRel, err := filepath.Rel(m.cfg.TargetBase, m.cfg.TargetContent)
+	if err != nil || strings.HasPrefix(contentRel, "..") {
+		contentRel = ""
+	}
+	var baseExcludes []string
+	overlayExcludes := append([]string(nil), m.cfg.ExcludePaths...)
+	for _, plan := range plans {
+		overlayExcludes = append(overlayExcludes, plan.rel)
+		if contentRel != "" {
+			baseExcludes = append(baseExcludes, filepath.Join(contentRel, plan.rel))
+		}
+	}
+	return baseExcludes, overlayExcludes
+}
+
+// rendersTemplates reports whether any template marks files for rendering.
+func (m *Merger) rendersTemplates() bool {
+	for _, tpl := range m.cfg.CopyTemplates {
+		if len(tpl.Render) > 0 {
+			return true
+		}
+	}
+	for _, wp := range m.cfg.WritablePaths {
+		if wp.Template != nil && len(wp.Template.Render) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func mergeTree(src, dest string, excludePaths []string, p *pipeline) error {
 	info, err := os.Stat(src)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
@@ -146,13 +273,27 @@ func mergeTree(src, dest string, excludePaths []string) error {
 		if !d.Type().IsRegular() {
 			return nil
 		}
+		// Decompressor manifests and interrupted writes are bookkeeping of
+		// the layer, not content; drop links to them that earlier versions
+		// put into the view
+		if d.Name() == decompress.ManifestName || decompress.IsPartial(d.Name()) {
+			if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				return os.Remove(target)
+			}
+			return nil
+		}
 		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
 			return err
 		}
+		sourcePath := filepath.Join(src, rel)
+		if contentRel, chain := p.matching(target); len(chain) > 0 {
+			p.queue(chain, sourcePath, contentRel)
+			return nil
+		}
+		p.drop(target)
 		if err := os.Remove(target); err != nil && !errors.Is(err, os.ErrNotExist) {
 			return err
 		}
-		sourcePath := filepath.Join(src, rel)
 		if err := os.Symlink(sourcePath, target); err != nil {
 			return err
 		}
@@ -175,14 +316,19 @@ func ensureWritablePaths(target string, paths []config.WritablePath) error {
 	return nil
 }
 
-func copyTemplateDirs(entries []config.CopyTemplate, targetBase, targetContent string, isFirstRun bool) error {
+// templateEnv carries merge-wide settings shared by every template copy.
+type templateEnv struct {
+	backupRoot string
+	render     *renderData
+}
+
+func copyTemplateDirs(entries []config.CopyTemplate, targetBase, targetContent string, env templateEnv, isFirstRun bool) error {
 	for _, tpl := range entries {
 		// Skip if onlyOnInit is true and this is not the first run
 		if tpl.OnlyOnInit && !isFirstRun {
 			log.Printf("copyTemplateDirs: skipping %s (onlyOnInit, not first run)", tpl.TargetPath)
 			continue
 		}
-		src := filepath.Join(tpl.SourceMount, filepath.Clean(tpl.SourcePath))
 		var destRoot string
 		targetPath := filepath.Clean(tpl.TargetPath)
 		if tpl.TargetMode == "writable" {
@@ -203,29 +349,176 @@ func copyTemplateDirs(entries []config.CopyTemplate, targetBase, targetContent s
 			destRoot = targetBase
 		}
 		dest := filepath.Join(destRoot, targetPath)
-		if err := copyDirectory(src, dest, tpl.Clean); err != nil {
+		opts := copyOptions{
+			clean:      tpl.Clean,
+			preserve:   tpl.Preserve,
+			exclude:    tpl.Exclude,
+			render:     tpl.Render,
+			data:       env.render,
+			uid:        -1,
+			gid:        -1,
+			backupRoot: env.backupRoot,
+			backupName: tpl.TargetPath,
+			backup:     tpl.Backup,
+		}
+		if err := opts.setOwnership(tpl.Mode, tpl.User, tpl.Group, tpl.PreserveAttributes); err != nil {
+			return fmt.Errorf("copy template %s: %w", tpl.TargetPath, err)
+		}
+		if err := copyTemplateSources(tpl, dest, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyTemplateSources copies every source of a copy template into dest. A
+// plain directory sourcePath keeps the historical behaviour of copying its
+// contents into dest; files and glob matches are placed inside dest by name.
+func copyTemplateSources(tpl config.CopyTemplate, dest string, opts copyOptions) error {
+	patterns := tpl.Sources
+	if strings.TrimSpace(tpl.SourcePath) != "" {
+		patterns = append([]string{tpl.SourcePath}, patterns...)
+	}
+	if len(patterns) == 1 && !hasGlobMeta(patterns[0]) {
+		src := filepath.Join(tpl.SourceMount, filepath.Clean(patterns[0]))
+		info, err := os.Stat(src)
+		if errors.Is(err, os.ErrNotExist) {
+			log.Printf("merge warning: template source %s missing, skipping", src)
+			return nil
+		}
+		if err == nil && !info.IsDir() {
+			name := filepath.Base(src)
+			if tpl.Rename != "" {
+				name = tpl.Rename
+			}
+			if err := copyTemplateFile(src, dest, name, opts); err != nil {
+				return fmt.Errorf("copy template %s -> %s: %w", src, dest, err)
+			}
+			return nil
+		}
+		if tpl.Rename != "" {
+			return fmt.Errorf("copy template %s: rename requires a single file source", tpl.TargetPath)
+		}
+		if err := copyDirectory(src, dest, opts); err != nil {
+			return fmt.Errorf("copy template %s -> %s: %w", src, dest, err)
+		}
+		return nil
+	}
+
+	var matches []string
+	for _, pattern := range patterns {
+		found, err := filepath.Glob(filepath.Join(tpl.SourceMount, filepath.Clean(pattern)))
+		if err != nil {
+			return fmt.Errorf("copy template %s: source %s: %w", tpl.TargetPath, pattern, err)
+		}
+		if len(found) == 0 {
+			log.Printf("merge warning: template source %s matched nothing, skipping", filepath.Join(tpl.SourceMount, pattern))
+		}
+		matches = append(matches, found...)
+	}
+	if tpl.Rename != "" && len(matches) != 1 {
+		return fmt.Errorf("copy template %s: rename requires a single file source, sources matched %d", tpl.TargetPath, len(matches))
+	}
+	for _, src := range matches {
+		info, err := os.Stat(src)
+		if err != nil {
+			return fmt.Errorf("copy template %s: %w", src, err)
+		}
+		if info.IsDir() {
+			sub := opts
+			sub.backupName = filepath.Join(opts.backupName, filepath.Base(src))
+			if err := copyDirectory(src, filepath.Join(dest, filepath.Base(src)), sub); err != nil {
+				return fmt.Errorf("copy template %s -> %s: %w", src, dest, err)
+			}
+			continue
+		}
+		name := filepath.Base(src)
+		if tpl.Rename != "" {
+			name = tpl.Rename
+		}
+		if err := copyTemplateFile(src, dest, name, opts); err != nil {
 			return fmt.Errorf("copy template %s -> %s: %w", src, dest, err)
 		}
 	}
 	return nil
 }
 
-func copyWritableTemplates(target string, paths []config.WritablePath) error {
+func hasGlobMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+func copyWritableTemplates(target string, paths []config.WritablePath, env templateEnv) error {
 	for _, wp := range paths {
 		if wp.Template == nil {
 			continue
 		}
 		src := filepath.Join(wp.Template.SourceMount, filepath.Clean(wp.Template.SourcePath))
 		dest := filepath.Join(target, filepath.Clean(wp.Path))
-		if err := copyDirectory(src, dest, wp.Template.Clean); err != nil {
+		opts := copyOptions{
+			clean:      wp.Template.Clean,
+			preserve:   wp.Template.Preserve,
+			exclude:    wp.Template.Exclude,
+			render:     wp.Template.Render,
+			data:       env.render,
+			uid:        -1,
+			gid:        -1,
+			backupRoot: env.backupRoot,
+			backupName: wp.Path,
+			backup:     wp.Template.Backup,
+		}
+		if err := opts.setOwnership(wp.Template.Mode, wp.Template.User, wp.Template.Group, wp.Template.PreserveAttributes); err != nil {
+			return fmt.Errorf("copy writable template %s: %w", wp.Path, err)
+		}
+		if err := copyDirectory(src, dest, opts); err != nil {
 			return fmt.Errorf("copy writable template %s -> %s: %w", src, dest, err)
 		}
 	}
 	return nil
 }
 
-func copyDirectory(src, dest string, clean bool) error {
-	log.Printf("copyDirectory: src=%s dest=%s clean=%v", src, dest, clean)
+// copyOptions controls how a template directory is copied into its destination.
+type copyOptions struct {
+	clean    bool
+	preserve []string // destination-relative globs that are never removed or overwritten
+	exclude  []string // source-relative globs that are neither copied nor cleaned
+	render   []string // source-relative globs rendered as text/template files
+	data     *renderData
+
+	mode     *permissions.Mode // applied to the source permission bits of copied files
+	uid, gid int               // ownership applied to copied files; -1 leaves it unchanged
+	attrs    attributePolicy
+
+	backupRoot string
+	backupName string
+	backup     *config.BackupPolicy
+}
+
+// setOwnership applies a template's explicit mode, owner and attribute settings.
+func (o *copyOptions) setOwnership(mode string, user, group *int, attrs *config.AttributePolicy) error {
+	if mode != "" {
+		parsed, err := permissions.ParseMode(mode)
+		if err != nil {
+			return fmt.Errorf("mode: %w", err)
+		}
+		o.mode = &parsed
+	}
+	if user != nil {
+		o.uid = *user
+	}
+	if group != nil {
+		o.gid = *group
+	}
+	o.attrs = newAttributePolicy(attrs)
+	return nil
+}
+
+// owns reports whether rel belongs to the template and may be removed or replaced.
+func (o copyOptions) owns(rel string) bool {
+	return !matchAny(o.preserve, rel) && !matchAny(o.exclude, rel)
+}
+
+func copyDirectory(src, dest string, opts copyOptions) error {
+	log.Printf("copyDirectory: src=%s dest=%s clean=%v", src, dest, opts.clean)
 	info, err := os.Stat(src)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
@@ -234,16 +527,27 @@ func copyDirectory(src, dest string, clean bool) error {
 		}
 		return err
 	}
-	if clean {
-		log.Printf("copyDirectory: removing dest %s", dest)
-		if err := os.RemoveAll(dest); err != nil {
-			return err
+	unchanged := false
+	if opts.clean {
+		if unchanged, err = backupDestination(dest, opts); err != nil {
+			return fmt.Errorf("backup %s: %w", dest, err)
+		}
+		if len(opts.preserve) == 0 && len(opts.exclude) == 0 {
+			log.Printf("copyDirectory: removing dest %s", dest)
+			if err := os.RemoveAll(dest); err != nil {
+				return err
+			}
+		} else {
+			log.Printf("copyDirectory: cleaning dest %s (preserve=%v exclude=%v)", dest, opts.preserve, opts.exclude)
+			if _, err := cleanOwned(dest, ".", opts); err != nil {
+				return err
+			}
 		}
 	}
 	if err := os.MkdirAll(dest, info.Mode().Perm()); err != nil {
 		return err
 	}
-	return filepath.WalkDir(src, func(path string, d fs.DirEntry, walkErr error) error {
+	err = filepath.WalkDir(src, func(path string, d fs.DirEntry, walkErr error) error {
 		if walkErr != nil {
 			return walkErr
 		}
@@ -254,10 +558,22 @@ func copyDirectory(src, dest string, clean bool) error {
 		if rel == "." {
 			return nil
 		}
+		if matchAny(opts.exclude, rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 		target := filepath.Join(dest, rel)
 		if d.IsDir() {
 			return os.MkdirAll(target, dirMode(d))
 		}
+		if matchAny(opts.preserve, rel) {
+			if _, err := os.Lstat(target); err == nil {
+				log.Printf("copyDirectory: keeping preserved file %s", target)
+				return nil
+			}
+		}
 		if d.Type()&os.ModeSymlink != 0 {
 			// Dereference the symlink and copy the actual file content
 			realPath, err := filepath.EvalSymlinks(path)
@@ -273,19 +589,149 @@ func copyDirectory(src, dest string, clean bool) error {
 				return nil
 			}
 			log.Printf("copyDirectory: dereferencing symlink %s -> %s, copying actual file to %s", path, realPath, target)
-			// Remove any existing file or symlink at the target
-			if err := os.Remove(target); err != nil && !errors.Is(err, os.ErrNotExist) {
-				log.Printf("copyDirectory: warning - failed to remove existing target %s: %v", target, err)
-			}
-			return copyFile(realPath, target, realInfo.Mode().Perm())
+			return installFile(realPath, target, rel, realInfo.Mode().Perm(), opts)
 		}
 		log.Printf("copyDirectory: copying file %s to %s", path, target)
-		// Remove any existing file or symlink at the target
+		return installFile(path, target, rel, fileMode(d), opts)
+	})
+	if err != nil {
+		return err
+	}
+	if opts.clean {
+		return recordBackupDigest(src, dest, opts, unchanged)
+	}
+	return nil
+}
+
+// installFile copies (or renders) a single template file to target and
+// applies the template's mode and ownership overrides.
+func installFile(src, target, rel string, perm os.FileMode, opts copyOptions) error {
+	render := matchAny(opts.render, rel)
+	if !render {
+		// Remove any existing file or symlink at the target; rendering
+		// replaces it atomically instead
 		if err := os.Remove(target); err != nil && !errors.Is(err, os.ErrNotExist) {
 			log.Printf("copyDirectory: warning - failed to remove existing target %s: %v", target, err)
 		}
-		return copyFile(path, target, fileMode(d))
-	})
+	}
+	if render && (opts.uid >= 0 || opts.gid >= 0) {
+		perm = renderedFileMode
+	}
+	if opts.mode != nil {
+		perm = opts.mode.Apply(perm, false)
+	}
+	var err error
+	if render {
+		log.Printf("copyDirectory: rendering template %s to %s", src, target)
+		err = renderFile(src, target, perm, opts.data)
+	} else {
+		err = copyFile(src, target, perm)
+	}
+	if err != nil {
+		return err
+	}
+	// Source ownership is applied first so explicit user/group settings win.
+	if err := preserveAttributes(src, target, opts.attrs); err != nil {
+		return err
+	}
+	if opts.mode != nil {
+		// OpenFile applies the umask, so set the requested mode explicitly.
+		if err := os.Chmod(target, perm); err != nil && !ignorePermError(err) {
+			return fmt.Errorf("chmod %s: %w", target, err)
+		}
+	}
+	if opts.uid >= 0 || opts.gid >= 0 {
+		if err := os.Lchown(target, opts.uid, opts.gid); err != nil && !ignorePermError(err) {
+			return fmt.Errorf("chown %s: %w", target, err)
+		}
+	}
+	return nil
+}
+
+// attributePolicy mirrors config.AttributePolicy for a single template.
+type attributePolicy struct {
+	ownership  bool
+	timestamps bool
+	xattrs     bool
+}
+
+func newAttributePolicy(cfg *config.AttributePolicy) attributePolicy {
+	if cfg == nil {
+		return attributePolicy{}
+	}
+	return attributePolicy{ownership: cfg.Ownership, timestamps: cfg.Timestamps, xattrs: cfg.Xattrs}
+}
+
+func (a attributePolicy) any() bool {
+	return a.ownership || a.timestamps || a.xattrs
+}
+
+// copyTemplateFile copies a single-file template source into destDir, using
+// name as the file name.
+func copyTemplateFile(src, destDir, name string, opts copyOptions) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	// Globs match the destination name, so a renamed file is owned, preserved
+	// and rendered under the name cleanOwned later sees
+	if matchAny(opts.exclude, name) {
+		return nil
+	}
+	target := filepath.Join(destDir, name)
+	if matchAny(opts.preserve, name) {
+		if _, err := os.Lstat(target); err == nil {
+			log.Printf("copyTemplateFile: keeping preserved file %s", target)
+			return nil
+		}
+	}
+	if err := os.MkdirAll(destDir, 0o755); err != nil {
+		return err
+	}
+	log.Printf("copyTemplateFile: copying file %s to %s", src, target)
+	return installFile(src, target, name, info.Mode().Perm(), opts)
+}
+
+// cleanOwned removes every entry below root/rel that the template owns and
+// reports whether the directory itself was left empty and removed. Directories
+// holding preserved or excluded entries are kept.
+func cleanOwned(root, rel string, opts copyOptions) (bool, error) {
+	dir := filepath.Join(root, rel)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return true, nil
+		}
+		return false, err
+	}
+	empty := true
+	for _, entry := range entries {
+		childRel := filepath.Join(rel, entry.Name())
+		if !opts.owns(childRel) {
+			empty = false
+			continue
+		}
+		if entry.IsDir() {
+			removed, err := cleanOwned(root, childRel, opts)
+			if err != nil {
+				return false, err
+			}
+			if !removed {
+				empty = false
+			}
+			continue
+		}
+		if err := os.Remove(filepath.Join(root, childRel)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return false, err
+		}
+	}
+	if !empty || rel == "." {
+		return false, nil
+	}
+	if err := os.Remove(dir); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	return true, nil
 }
 
 func dirMode(d fs.DirEntry) os.FileMode {
@@ -313,6 +759,10 @@ func copyFile(src, dest string, perm os.FileMode) error {
 		return err
 	}
 	defer srcFile.Close()
+	info, err := srcFile.Stat()
+	if err != nil {
+		return err
+	}
 	if err := os.Remove(dest); err != nil && !errors.Is(err, os.ErrNotExist) {
 		return err
 	}
@@ -320,11 +770,11 @@ func copyFile(src, dest string, perm os.FileMode) error {
 	if err != nil {
 		return err
 	}
-	defer dstFile.Close()
-	if _, err := io.Copy(dstFile, srcFile); err != nil {
-		return err
+	if _, err := copyContents(dstFile, srcFile, info.Size()); err != nil {
+		dstFile.Close()
+		return fmt.Errorf("copy %s: %w", src, err)
 	}
-	return nil
+	return dstFile.Close()
 }
 
 func pruneDanglingSymlinks(paths ...string) error {
@@ -351,29 +801,18 @@ func pruneDanglingSymlinks(paths ...string) error {
 	return nil
 }
 
-func applyPermissions(paths []string, uid, gid int, mode os.FileMode) error {
+func applyPermissions(ctx context.Context, paths []string, rules permissions.Rules, opts permissions.Options) error {
 	for _, root := range paths {
 		if strings.TrimSpace(root) == "" {
 			continue
 		}
-		if err := filepath.WalkDir(root, func(path string, d fs.DirEntry, walkErr error) error {
-			if walkErr != nil {
-				return walkErr
-			}
-			// Use Lchown to change symlink ownership itself, not the target
-			if err := os.Lchown(path, uid, gid); err != nil && !ignorePermError(err) {
-				return fmt.Errorf("chown %s: %w", path, err)
-			}
-			// Only chmod non-symlinks (chmod follows symlinks)
-			if d.Type()&os.ModeSymlink == 0 {
-				if err := os.Chmod(path, mode); err != nil && !ignorePermError(err) {
-					return fmt.Errorf("chmod %s: %w", path, err)
-				}
-			}
-			return nil
-		}); err != nil {
+		report, err := permissions.Apply(ctx, root, rules, opts)
+		if err != nil {
 			return err
 		}
+		if report.Changed > 0 {
+			log.Printf("permissions: fixed %d of %d entries below %s", report.Changed, report.Scanned, root)
+		}
 	}
 	return nil
 }
@@ -384,14 +823,3 @@ func ignorePermError(err error) bool {
 	}
 	return errors.Is(err, os.ErrPermission) || errors.Is(err, syscall.EPERM) || errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.EROFS)
 }
-
-func parseFileMode(val string) (os.FileMode, error) {
-	if strings.TrimSpace(val) == "" {
-		return 0o755, nil
-	}
-	parsed, err := strconv.ParseUint(val, 8, 32)
-	if err != nil {
-		return 0, err
-	}
-	return os.FileMode(parsed), nil
-}
@@ -1,12 +1,18 @@
 package merge
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/UDL-TF/TF2Chart/src/internal/config"
+	"github.com/UDL-TF/TF2Chart/src/internal/decompress"
 )
 
 func TestMergerCreatesSymlinks(t *testing.T) {
@@ -425,3 +431,1050 @@ func TestCopyTemplateOnlyOnInit(t *testing.T) {
 		t.Errorf("file should not be overwritten on second run: got %q", string(content))
 	}
 }
+
+// TestCopyTemplateCleanHonoursPreserveAndExclude tests that clean mode only
+// removes files owned by the template and leaves preserved runtime files alone.
+func TestCopyTemplateCleanHonoursPreserveAndExclude(t *testing.T) {
+	base := t.TempDir()
+	targetBase := filepath.Join(t.TempDir(), "view")
+	targetContent := filepath.Join(targetBase, "tf")
+	if err := os.MkdirAll(targetContent, 0o755); err != nil {
+		t.Fatalf("mkdir target content: %v", err)
+	}
+
+	templateSrc := filepath.Join(base, "templates", "sourcebans")
+	writeFile(t, filepath.Join(templateSrc, "sourcebans.cfg"), "template cfg")
+	writeFile(t, filepath.Join(templateSrc, "notes.md"), "not for the server")
+
+	targetDir := filepath.Join(targetContent, "configs", "sourcebans")
+	writeFile(t, filepath.Join(targetDir, "sourcebans.cfg"), "stale cfg")
+	writeFile(t, filepath.Join(targetDir, "stale.cfg"), "removed from template")
+	writeFile(t, filepath.Join(targetDir, "cache", "bans.sq3"), "runtime cache")
+	writeFile(t, filepath.Join(targetDir, "admins.db"), "runtime db")
+	writeFile(t, filepath.Join(targetDir, "notes.md"), "local notes")
+
+	cfg := &config.MergeConfig{
+		BasePath:      base,
+		TargetBase:    targetBase,
+		TargetContent: targetContent,
+		CopyTemplates: []config.CopyTemplate{
+			{
+				SourceMount: base,
+				SourcePath:  "templates/sourcebans",
+				TargetPath:  "tf/configs/sourcebans",
+				Clean:       true,
+				TargetMode:  "writable",
+				Preserve:    []string{"cache", "*.db"},
+				Exclude:     []string{"*.md"},
+			},
+		},
+		Permissions: config.PermissionPhase{},
+	}
+
+	m, err := New(cfg)
+	if err != nil {
+		t.Fatalf("new merger: %v", err)
+	}
+	if err := m.Run(context.Background()); err != nil {
+		t.Fatalf("run merge: %v", err)
+	}
+
+	expect := map[string]string{
+		"sourcebans.cfg": "template cfg",
+		"cache/bans.sq3": "runtime cache",
+		"admins.db":      "runtime db",
+		"notes.md":       "local notes",
+	}
+	for rel, want := range expect {
+		content, err := os.ReadFile(filepath.Join(targetDir, rel))
+		if err != nil {
+			t.Fatalf("read %s: %v", rel, err)
+		}
+		if string(content) != want {
+			t.Errorf("file %s: got %q, want %q", rel, string(content), want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "stale.cfg")); !os.IsNotExist(err) {
+		t.Errorf("expected stale.cfg to be cleaned, stat err=%v", err)
+	}
+}
+
+// TestCopyTemplateBackupBeforeClean tests that runtime edits are snapshotted
+// before clean mode wipes them and that old snapshots are pruned.
+func TestCopyTemplateBackupBeforeClean(t *testing.T) {
+	base := t.TempDir()
+	backupRoot := t.TempDir()
+	targetBase := filepath.Join(t.TempDir(), "view")
+	targetContent := filepath.Join(targetBase, "tf")
+	if err := os.MkdirAll(targetContent, 0o755); err != nil {
+		t.Fatalf("mkdir target content: %v", err)
+	}
+	writeFile(t, filepath.Join(base, "templates", "admins_simple.ini"), "template")
+
+	cfg := &config.MergeConfig{
+		BasePath:      base,
+		TargetBase:    targetBase,
+		TargetContent: targetContent,
+		BackupRoot:    backupRoot,
+		CopyTemplates: []config.CopyTemplate{
+			{
+				SourceMount: base,
+				SourcePath:  "templates",
+				TargetPath:  "tf/configs",
+				Clean:       true,
+				TargetMode:  "writable",
+				Backup:      &config.BackupPolicy{Format: "dir", Retain: 2},
+			},
+		},
+		Permissions: config.PermissionPhase{},
+	}
+	m, err := New(cfg)
+	if err != nil {
+		t.Fatalf("new merger: %v", err)
+	}
+	targetFile := filepath.Join(targetContent, "configs", "admins_simple.ini")
+	backupDir := filepath.Join(backupRoot, backupDirName("tf/configs"))
+	snapshots := func() []string {
+		t.Helper()
+		entries, err := os.ReadDir(backupDir)
+		if err != nil {
+			t.Fatalf("read backup dir: %v", err)
+		}
+		var names []string
+		for _, entry := range entries {
+			if entry.IsDir() {
+				names = append(names, entry.Name())
+			}
+		}
+		return names
+	}
+
+	if err := m.Run(context.Background()); err != nil {
+		t.Fatalf("run merge (first): %v", err)
+	}
+	if got := snapshots(); len(got) != 0 {
+		t.Fatalf("expected no snapshots after first run, got %v", got)
+	}
+
+	for i, edit := range []string{"edit one", "edit two", "edit three"} {
+		if err := os.WriteFile(targetFile, []byte(edit), 0o644); err != nil {
+			t.Fatalf("modify file: %v", err)
+		}
+		if err := m.Run(context.Background()); err != nil {
+			t.Fatalf("run merge (edit %d): %v", i, err)
+		}
+	}
+	// An unchanged destination must not produce another snapshot.
+	if err := m.Run(context.Background()); err != nil {
+		t.Fatalf("run merge (unchanged): %v", err)
+	}
+
+	got := snapshots()
+	if len(got) != 2 {
+		t.Fatalf("expected 2 retained snapshots, got %v", got)
+	}
+	content, err := os.ReadFile(filepath.Join(backupDir, got[len(got)-1], "admins_simple.ini"))
+	if err != nil {
+		t.Fatalf("read newest snapshot: %v", err)
+	}
+	if string(content) != "edit three" {
+		t.Errorf("newest snapshot: got %q, want %q", string(content), "edit three")
+	}
+}
+
+// TestCopyTemplateRendersMarkedFiles tests that files matching the render globs
+// are executed as text/template with env, secret and pod data while other
+// files are copied verbatim.
+func TestCopyTemplateRendersMarkedFiles(t *testing.T) {
+	base := t.TempDir()
+	secrets := t.TempDir()
+	targetBase := filepath.Join(t.TempDir(), "view")
+	targetContent := filepath.Join(targetBase, "tf")
+	if err := os.MkdirAll(targetContent, 0o755); err != nil {
+		t.Fatalf("mkdir target content: %v", err)
+	}
+	t.Setenv("POD_NAME", "tf2-pub-3")
+	t.Setenv("SERVER_REGION", "EU")
+	writeFile(t, filepath.Join(secrets, "rcon_password"), "hunter2\n")
+	writeFile(t, filepath.Join(base, "cfg", "server.cfg"),
+		`hostname "{{ env "SERVER_REGION" }} #{{ add .Pod.Ordinal 1 }}"`+"\n"+`rcon_password "{{ secret "rcon_password" }}"`)
+	writeFile(t, filepath.Join(base, "cfg", "motd.txt"), "{{ not rendered }}")
+
+	cfg := &config.MergeConfig{
+		BasePath:      base,
+		TargetBase:    targetBase,
+		TargetContent: targetContent,
+		SecretDirs:    []string{secrets},
+		CopyTemplates: []config.CopyTemplate{
+			{
+				SourceMount: base,
+				SourcePath:  "cfg",
+				TargetPath:  "tf/cfg",
+				Clean:       true,
+				TargetMode:  "writable",
+				Render:      []string{"*.cfg"},
+			},
+		},
+		Permissions: config.PermissionPhase{},
+	}
+	m, err := New(cfg)
+	if err != nil {
+		t.Fatalf("new merger: %v", err)
+	}
+	if err := m.Run(context.Background()); err != nil {
+		t.Fatalf("run merge: %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(targetContent, "cfg", "server.cfg"))
+	if err != nil {
+		t.Fatalf("read rendered file: %v", err)
+	}
+	want := "hostname \"EU #4\"\nrcon_password \"hunter2\""
+	if string(content) != want {
+		t.Errorf("rendered server.cfg: got %q, want %q", string(content), want)
+	}
+	content, err = os.ReadFile(filepath.Join(targetContent, "cfg", "motd.txt"))
+	if err != nil {
+		t.Fatalf("read copied file: %v", err)
+	}
+	if string(content) != "{{ not rendered }}" {
+		t.Errorf("motd.txt should be copied verbatim, got %q", string(content))
+	}
+
+	// Without an owner rendered files keep the source's mode, with one they
+	// are not world-readable, and an explicit mode wins over both.
+	checkMode := func(want os.FileMode) {
+		t.Helper()
+		info, err := os.Stat(filepath.Join(targetContent, "cfg", "server.cfg"))
+		if err != nil {
+			t.Fatalf("stat rendered file: %v", err)
+		}
+		if got := info.Mode().Perm(); got != want {
+			t.Errorf("rendered server.cfg: got mode %o, want %o", got, want)
+		}
+	}
+	checkMode(0o644)
+	uid := os.Getuid()
+	cfg.CopyTemplates[0].User = &uid
+	if err := m.Run(context.Background()); err != nil {
+		t.Fatalf("run merge with user: %v", err)
+	}
+	checkMode(0o640)
+	cfg.CopyTemplates[0].Mode = "600"
+	if err := m.Run(context.Background()); err != nil {
+		t.Fatalf("run merge with mode: %v", err)
+	}
+	checkMode(0o600)
+}
+
+// TestFileMergeLinesCombinesLayers tests that line-merged files collect the
+// base and every overlay in order into a real file instead of a symlink.
+func TestFileMergeLinesCombinesLayers(t *testing.T) {
+	base := t.TempDir()
+	targetBase := filepath.Join(t.TempDir(), "view")
+	targetContent := filepath.Join(targetBase, "tf")
+	if err := os.MkdirAll(targetContent, 0o755); err != nil {
+		t.Fatalf("mkdir target content: %v", err)
+	}
+	shared := t.TempDir()
+	server := t.TempDir()
+	admins := filepath.Join("addons", "sourcemod", "configs", "admins_simple.ini")
+	writeFile(t, filepath.Join(base, "tf", admins), "\"STEAM_0:1:1\" \"99:z\"\r\n")
+	writeFile(t, filepath.Join(shared, admins), "\"STEAM_0:1:2\" \"50:b\"\n\"STEAM_0:1:1\" \"99:z\"\n")
+	writeFile(t, filepath.Join(server, admins), "\"STEAM_0:1:3\" \"10:a\"")
+	writeFile(t, filepath.Join(server, "cfg", "server.cfg"), "hostname server")
+
+	cfg := &config.MergeConfig{
+		BasePath:      base,
+		TargetBase:    targetBase,
+		TargetContent: targetContent,
+		Overlays: []config.Overlay{
+			{Name: "shared", SourcePath: shared},
+			{Name: "server", SourcePath: server},
+		},
+		FileMerges: []config.FileMerge{
+			{Path: "addons/sourcemod/configs/*.ini", Strategy: "lines", Dedupe: true, Headers: true},
+		},
+		Permissions: config.PermissionPhase{},
+	}
+	m, err := New(cfg)
+	if err != nil {
+		t.Fatalf("new merger: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := m.Run(context.Background()); err != nil {
+			t.Fatalf("run merge %d: %v", i, err)
+		}
+	}
+
+	target := filepath.Join(targetContent, admins)
+	info, err := os.Lstat(target)
+	if err != nil {
+		t.Fatalf("stat merged file: %v", err)
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		t.Fatalf("expected generated file at %s, got symlink", target)
+	}
+	content, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatalf("read merged file: %v", err)
+	}
+	want := "// --- base ---\n\"STEAM_0:1:1\" \"99:z\"\n\n" +
+		"// --- shared ---\n\"STEAM_0:1:2\" \"50:b\"\n\n" +
+		"// --- server ---\n\"STEAM_0:1:3\" \"10:a\"\n"
+	if string(content) != want {
+		t.Errorf("merged file:\ngot  %q\nwant %q", string(content), want)
+	}
+	assertSymlink(t, filepath.Join(targetContent, "cfg", "server.cfg"))
+}
+
+// TestFileMergeKeyValuesDeepMerges tests that an overlay can add a single
+// database entry to databases.cfg without owning the whole file.
+func TestFileMergeKeyValuesDeepMerges(t *testing.T) {
+	base := t.TempDir()
+	targetBase := filepath.Join(t.TempDir(), "view")
+	targetContent := filepath.Join(targetBase, "tf")
+	if err := os.MkdirAll(targetContent, 0o755); err != nil {
+		t.Fatalf("mkdir target content: %v", err)
+	}
+	overlay := t.TempDir()
+	databases := filepath.Join("addons", "sourcemod", "configs", "databases.cfg")
+	writeFile(t, filepath.Join(base, "tf", databases), `"Databases"
+{
+	"driver_default"		"mysql"
+	"storage-local"
+	{
+		"driver"			"sqlite"
+		"database"			"sourcemod-local"
+	}
+}
+`)
+	writeFile(t, filepath.Join(overlay, databases), `"Databases"
+{
+	"sourcebans"
+	{
+		"driver"	"mysql"
+		"host"		"db.internal"
+	}
+}
+`)
+
+	cfg := &config.MergeConfig{
+		BasePath:      base,
+		TargetBase:    targetBase,
+		TargetContent: targetContent,
+		Overlays:      []config.Overlay{{Name: "sourcebans", SourcePath: overlay}},
+		FileMerges: []config.FileMerge{
+			{Path: "addons/sourcemod/configs/databases.cfg", Strategy: "keyvalues"},
+		},
+		Permissions: config.PermissionPhase{},
+	}
+	m, err := New(cfg)
+	if err != nil {
+		t.Fatalf("new merger: %v", err)
+	}
+	if err := m.Run(context.Background()); err != nil {
+		t.Fatalf("run merge: %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(targetContent, databases))
+	if err != nil {
+		t.Fatalf("read merged file: %v", err)
+	}
+	want := "\"Databases\"\n{\n" +
+		"\t\"driver_default\"\t\"mysql\"\n" +
+		"\t\"storage-local\"\n\t{\n\t\t\"driver\"\t\"sqlite\"\n\t\t\"database\"\t\"sourcemod-local\"\n\t}\n" +
+		"\t\"sourcebans\"\n\t{\n\t\t\"driver\"\t\"mysql\"\n\t\t\"host\"\t\"db.internal\"\n\t}\n" +
+		"}\n"
+	if string(content) != want {
+		t.Errorf("merged databases.cfg:\ngot  %q\nwant %q", string(content), want)
+	}
+}
+
+// TestTransformersMaterializeChangedFiles tests that transformed files become
+// real copies in the view while untouched files remain symlinks.
+func TestTransformersMaterializeChangedFiles(t *testing.T) {
+	base := t.TempDir()
+	targetBase := filepath.Join(t.TempDir(), "view")
+	targetContent := filepath.Join(targetBase, "tf")
+	if err := os.MkdirAll(targetContent, 0o755); err != nil {
+		t.Fatalf("mkdir target content: %v", err)
+	}
+	overlay := t.TempDir()
+	writeFile(t, filepath.Join(overlay, "cfg", "windows.cfg"), "\xEF\xBB\xBFexec a\r\nexec b\r\n")
+	writeFile(t, filepath.Join(overlay, "cfg", "unix.cfg"), "exec a\n")
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("map data"))
+	zw.Close()
+	writeFile(t, filepath.Join(overlay, "maps", "koth_test.bsp.gz"), gz.String())
+
+	cfg := &config.MergeConfig{
+		BasePath:      base,
+		TargetBase:    targetBase,
+		TargetContent: targetContent,
+		Overlays:      []config.Overlay{{Name: "overlay", SourcePath: overlay}},
+		Transforms: []config.TransformRule{
+			{Name: "bom"},
+			{Name: "crlf"},
+			{Name: "gunzip", Paths: []string{"maps/*.gz"}},
+		},
+		Permissions: config.PermissionPhase{},
+	}
+	m, err := New(cfg)
+	if err != nil {
+		t.Fatalf("new merger: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := m.Run(context.Background()); err != nil {
+			t.Fatalf("run merge %d: %v", i, err)
+		}
+	}
+
+	checkCopy := func(rel, want string) {
+		t.Helper()
+		path := filepath.Join(targetContent, rel)
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Fatalf("stat %s: %v", rel, err)
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			t.Fatalf("expected materialized copy at %s, got symlink", rel)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("read %s: %v", rel, err)
+		}
+		if string(content) != want {
+			t.Errorf("%s: got %q, want %q", rel, string(content), want)
+		}
+	}
+	checkCopy("cfg/windows.cfg", "exec a\nexec b\n")
+	checkCopy("maps/koth_test.bsp", "map data")
+	assertSymlink(t, filepath.Join(targetContent, "cfg", "unix.cfg"))
+
+	if err := os.Remove(filepath.Join(overlay, "maps", "koth_test.bsp.gz")); err != nil {
+		t.Fatalf("remove source: %v", err)
+	}
+	if err := m.Run(context.Background()); err != nil {
+		t.Fatalf("run merge after removal: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(targetContent, "maps", "koth_test.bsp")); !os.IsNotExist(err) {
+		t.Errorf("expected expanded map to be removed with its source, stat err=%v", err)
+	}
+}
+
+// TestCopyTemplateFileAndGlobSources tests single-file sources with rename,
+// multiple glob sources and an explicit mode for copied files.
+func TestCopyTemplateFileAndGlobSources(t *testing.T) {
+	base := t.TempDir()
+	targetBase := filepath.Join(t.TempDir(), "view")
+	targetContent := filepath.Join(targetBase, "tf")
+	if err := os.MkdirAll(targetContent, 0o755); err != nil {
+		t.Fatalf("mkdir target content: %v", err)
+	}
+	writeFile(t, filepath.Join(base, "servers", "pub.cfg"), "hostname pub")
+	writeFile(t, filepath.Join(base, "shared", "motd.txt"), "motd")
+	writeFile(t, filepath.Join(base, "shared", "motd_text.txt"), "motd text")
+	writeFile(t, filepath.Join(base, "shared", "readme.md"), "readme")
+	writeFile(t, filepath.Join(base, "extra", "plugins", "a.smx"), "plugin")
+	writeFile(t, filepath.Join(targetContent, "cfg", "autoexec.cfg"), "keep me")
+
+	cfg := &config.MergeConfig{
+		BasePath:      base,
+		TargetBase:    targetBase,
+		TargetContent: targetContent,
+		CopyTemplates: []config.CopyTemplate{
+			{
+				SourceMount: base,
+				SourcePath:  "servers/pub.cfg",
+				TargetPath:  "tf/cfg",
+				Rename:      "server.cfg",
+				Clean:       true,
+				TargetMode:  "writable",
+				Mode:        "600",
+			},
+			{
+				SourceMount: base,
+				Sources:     []string{"shared/*.txt", "extra/*"},
+				TargetPath:  "tf/misc",
+				TargetMode:  "writable",
+			},
+		},
+		Permissions: config.PermissionPhase{},
+	}
+	m, err := New(cfg)
+	if err != nil {
+		t.Fatalf("new merger: %v", err)
+	}
+	if err := m.Run(context.Background()); err != nil {
+		t.Fatalf("run merge: %v", err)
+	}
+
+	for rel, want := range map[string]string{
+		"cfg/server.cfg":     "hostname pub",
+		"cfg/autoexec.cfg":   "keep me",
+		"misc/motd.txt":      "motd",
+		"misc/motd_text.txt": "motd text",
+		"misc/plugins/a.smx": "plugin",
+	} {
+		content, err := os.ReadFile(filepath.Join(targetContent, rel))
+		if err != nil {
+			t.Fatalf("read %s: %v", rel, err)
+		}
+		if string(content) != want {
+			t.Errorf("%s: got %q, want %q", rel, string(content), want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(targetContent, "misc", "readme.md")); !os.IsNotExist(err) {
+		t.Errorf("readme.md should not match the sources, stat err=%v", err)
+	}
+	info, err := os.Stat(filepath.Join(targetContent, "cfg", "server.cfg"))
+	if err != nil {
+		t.Fatalf("stat server.cfg: %v", err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("server.cfg mode: got %o, want 600", info.Mode().Perm())
+	}
+}
+
+// TestCopyTemplateRenameMatchesDestinationName tests that the exclude, preserve
+// and render globs of a renamed file all match its destination name.
+func TestCopyTemplateRenameMatchesDestinationName(t *testing.T) {
+	base := t.TempDir()
+	targetBase := filepath.Join(t.TempDir(), "view")
+	targetContent := filepath.Join(targetBase, "tf")
+	t.Setenv("TF2CHART_TEST_HOSTNAME", "rendered")
+	writeFile(t, filepath.Join(base, "servers", "pub.cfg"), `hostname "{{ env "TF2CHART_TEST_HOSTNAME" }}"`)
+	writeFile(t, filepath.Join(base, "shared", "motd_src.txt"), "motd")
+	writeFile(t, filepath.Join(base, "shared", "mapcycle_src.txt"), "new cycle")
+	writeFile(t, filepath.Join(targetContent, "misc", "mapcycle.txt"), "runtime cycle")
+
+	cfg := &config.MergeConfig{
+		BasePath:      base,
+		TargetBase:    targetBase,
+		TargetContent: targetContent,
+		CopyTemplates: []config.CopyTemplate{
+			{
+				SourceMount: base,
+				SourcePath:  "servers/pub.cfg",
+				TargetPath:  "tf/cfg",
+				Rename:      "server.cfg",
+				Clean:       true,
+				Exclude:     []string{"pub.cfg"},
+				Render:      []string{"server.cfg"},
+				TargetMode:  "writable",
+			},
+			{
+				SourceMount: base,
+				SourcePath:  "shared/motd_src.txt",
+				TargetPath:  "tf/misc",
+				Rename:      "motd.txt",
+				Exclude:     []string{"motd.txt"},
+				TargetMode:  "writable",
+			},
+			{
+				SourceMount: base,
+				SourcePath:  "shared/mapcycle_src.txt",
+				TargetPath:  "tf/misc",
+				Rename:      "mapcycle.txt",
+				Preserve:    []string{"mapcycle.txt"},
+				TargetMode:  "writable",
+			},
+		},
+	}
+	m, err := New(cfg)
+	if err != nil {
+		t.Fatalf("new merger: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := m.Run(context.Background()); err != nil {
+			t.Fatalf("run merge %d: %v", i, err)
+		}
+	}
+
+	if got, _ := os.ReadFile(filepath.Join(targetContent, "cfg", "server.cfg")); string(got) != `hostname "rendered"` {
+		t.Errorf("server.cfg: got %q, want the rendered file", got)
+	}
+	if _, err := os.Stat(filepath.Join(targetContent, "misc", "motd.txt")); !os.IsNotExist(err) {
+		t.Errorf("motd.txt matches exclude and must not be copied, stat err=%v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(targetContent, "misc", "mapcycle.txt")); string(got) != "runtime cycle" {
+		t.Errorf("mapcycle.txt: got %q, want the preserved file", got)
+	}
+}
+
+// writeSparseFile creates a file of size bytes with data only at both ends.
+func writeSparseFile(t testing.TB, path string, size int64) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create %s: %v", path, err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt([]byte("head"), 0); err != nil {
+		t.Fatalf("write head: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("tail"), size-4); err != nil {
+		t.Fatalf("write tail: %v", err)
+	}
+}
+
+// TestCopyEnginesPreserveContent tests that every copy strategy reproduces
+// sparse sources byte for byte.
+func TestCopyEnginesPreserveContent(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "map.bsp")
+	writeSparseFile(t, src, 4<<20)
+	want, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatalf("read source: %v", err)
+	}
+
+	engines := map[string]func(dst, src *os.File, size int64) error{
+		"auto": func(dst, src *os.File, size int64) error {
+			_, err := copyContents(dst, src, size)
+			return err
+		},
+		"buffered": func(dst, src *os.File, _ int64) error { return bufferedCopy(dst, src) },
+	}
+	for name, engine := range engines {
+		t.Run(name, func(t *testing.T) {
+			in, err := os.Open(src)
+			if err != nil {
+				t.Fatalf("open source: %v", err)
+			}
+			defer in.Close()
+			dest := filepath.Join(dir, name+".bsp")
+			out, err := os.Create(dest)
+			if err != nil {
+				t.Fatalf("create dest: %v", err)
+			}
+			// Stale bytes must not survive into the copy.
+			if _, err := out.WriteAt(bytes.Repeat([]byte{'x'}, 1<<20), 1<<20); err != nil {
+				t.Fatalf("write stale data: %v", err)
+			}
+			if err := engine(out, in, int64(len(want))); err != nil {
+				t.Fatalf("copy: %v", err)
+			}
+			out.Close()
+			got, err := os.ReadFile(dest)
+			if err != nil {
+				t.Fatalf("read copy: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("copy differs from source (%d vs %d bytes)", len(got), len(want))
+			}
+		})
+	}
+}
+
+func BenchmarkCopyFile(b *testing.B) {
+	dir := b.TempDir()
+	src := filepath.Join(dir, "custom.vpk")
+	data := make([]byte, 64<<20)
+	for i := range data {
+		data[i] = byte(i*7 + i>>12)
+	}
+	if err := os.WriteFile(src, data, 0o644); err != nil {
+		b.Fatalf("write source: %v", err)
+	}
+	sparse := filepath.Join(dir, "sparse.bsp")
+	writeSparseFile(b, sparse, int64(len(data)))
+
+	run := func(b *testing.B, source string, copyFn func(dst, src *os.File, size int64) error) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			in, err := os.Open(source)
+			if err != nil {
+				b.Fatalf("open source: %v", err)
+			}
+			out, err := os.Create(filepath.Join(dir, "copy"))
+			if err != nil {
+				b.Fatalf("create dest: %v", err)
+			}
+			if err := copyFn(out, in, int64(len(data))); err != nil {
+				b.Fatalf("copy: %v", err)
+			}
+			out.Close()
+			in.Close()
+		}
+	}
+	auto := func(dst, src *os.File, size int64) error {
+		_, err := copyContents(dst, src, size)
+		return err
+	}
+	buffered := func(dst, src *os.File, _ int64) error { return bufferedCopy(dst, src) }
+	stream := func(dst, src *os.File, _ int64) error {
+		_, err := io.Copy(struct{ io.Writer }{dst}, struct{ io.Reader }{src})
+		return err
+	}
+
+	b.Run("dense/auto", func(b *testing.B) { run(b, src, auto) })
+	b.Run("dense/buffered", func(b *testing.B) { run(b, src, buffered) })
+	b.Run("dense/io.Copy", func(b *testing.B) { run(b, src, stream) })
+	b.Run("sparse/auto", func(b *testing.B) { run(b, sparse, auto) })
+	b.Run("sparse/buffered", func(b *testing.B) { run(b, sparse, buffered) })
+	b.Run("sparse/io.Copy", func(b *testing.B) { run(b, sparse, stream) })
+}
+
+func TestMergerMirrorsFastDLContent(t *testing.T) {
+	base := t.TempDir()
+	targetBase := filepath.Join(t.TempDir(), "view")
+	targetContent := filepath.Join(targetBase, "tf")
+	fastdlDir := filepath.Join(t.TempDir(), "fastdl")
+	writeFile(t, filepath.Join(base, "tf", "maps", "ctf_2fort.bsp"), "base map")
+	writeFile(t, filepath.Join(base, "tf", "cfg", "server.cfg"), "hostname base")
+	overlay := t.TempDir()
+	writeFile(t, filepath.Join(overlay, "maps", "koth_foo.bsp"), "overlay map")
+
+	cfg := &config.MergeConfig{
+		BasePath:      base,
+		TargetBase:    targetBase,
+		TargetContent: targetContent,
+		Overlays:      []config.Overlay{{Name: "maps", SourcePath: overlay}},
+		FastDL:        &config.FastDL{OutputDir: fastdlDir, Level: 1},
+	}
+	m, err := New(cfg)
+	if err != nil {
+		t.Fatalf("new merger: %v", err)
+	}
+	if err := m.Run(context.Background()); err != nil {
+		t.Fatalf("run merge: %v", err)
+	}
+	if err := m.Wait(); err != nil {
+		t.Fatalf("fastdl sync: %v", err)
+	}
+	for _, rel := range []string{"maps/ctf_2fort.bsp.bz2", "maps/koth_foo.bsp.bz2"} {
+		if info, err := os.Stat(filepath.Join(fastdlDir, rel)); err != nil || info.Size() == 0 {
+			t.Errorf("expected %s in the FastDL mirror: %v", rel, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(fastdlDir, "cfg")); !os.IsNotExist(err) {
+		t.Errorf("cfg must not be mirrored")
+	}
+
+	// Merges finishing while a sync runs are caught up by a later pass
+	writeFile(t, filepath.Join(overlay, "maps", "pl_bar.bsp"), "second map")
+	for i := 0; i < 2; i++ {
+		if err := m.Run(context.Background()); err != nil {
+			t.Fatalf("run merge: %v", err)
+		}
+	}
+	if err := m.Wait(); err != nil {
+		t.Fatalf("fastdl sync: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(fastdlDir, "maps", "pl_bar.bsp.bz2")); err != nil {
+		t.Errorf("expected the new map in the FastDL mirror: %v", err)
+	}
+
+	cfg.FastDL.OutputDir = filepath.Join(targetContent, "fastdl")
+	if _, err := New(cfg); err == nil {
+		t.Errorf("expected an error for a mirror inside the content tree")
+	}
+}
+
+// TestTransformersAcrossProcessesAndLayers tests that base files match the
+// same content-relative patterns as overlays and that a later merger, like the
+// watcher after the init container, still removes outputs of an earlier one.
+func TestTransformersAcrossProcessesAndLayers(t *testing.T) {
+	base := t.TempDir()
+	targetBase := filepath.Join(t.TempDir(), "view")
+	targetContent := filepath.Join(targetBase, "tf")
+	overlay := t.TempDir()
+	writeFile(t, filepath.Join(base, "tf", "cfg", "base.cfg"), "exec base\r\n")
+	writeFile(t, filepath.Join(base, "bin", "notes.cfg"), "engine\r\n")
+	writeFile(t, filepath.Join(overlay, "cfg", "overlay.cfg"), "exec overlay\r\n")
+
+	cfg := &config.MergeConfig{
+		BasePath:      base,
+		TargetBase:    targetBase,
+		TargetContent: targetContent,
+		Overlays:      []config.Overlay{{Name: "overlay", SourcePath: overlay}},
+		Transforms:    []config.TransformRule{{Name: "crlf", Paths: []string{"cfg/*.cfg"}}},
+	}
+	run := func() {
+		t.Helper()
+		m, err := New(cfg)
+		if err != nil {
+			t.Fatalf("new merger: %v", err)
+		}
+		if err := m.Run(context.Background()); err != nil {
+			t.Fatalf("run merge: %v", err)
+		}
+	}
+	run()
+
+	for rel, want := range map[string]string{"cfg/base.cfg": "exec base\n", "cfg/overlay.cfg": "exec overlay\n"} {
+		path := filepath.Join(targetContent, rel)
+		if info, err := os.Lstat(path); err != nil || info.Mode()&os.ModeSymlink != 0 {
+			t.Fatalf("expected materialized copy at %s, err=%v", rel, err)
+		}
+		if got, _ := os.ReadFile(path); string(got) != want {
+			t.Errorf("%s: got %q, want %q", rel, got, want)
+		}
+	}
+	assertSymlink(t, filepath.Join(targetBase, "bin", "notes.cfg"))
+
+	if err := os.Remove(filepath.Join(base, "tf", "cfg", "base.cfg")); err != nil {
+		t.Fatalf("remove source: %v", err)
+	}
+	if err := os.Remove(filepath.Join(overlay, "cfg", "overlay.cfg")); err != nil {
+		t.Fatalf("remove source: %v", err)
+	}
+	run()
+	for _, rel := range []string{"cfg/base.cfg", "cfg/overlay.cfg"} {
+		if _, err := os.Lstat(filepath.Join(targetContent, rel)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed with its source, stat err=%v", rel, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(targetBase, transformStateName)); !os.IsNotExist(err) {
+		t.Errorf("expected the transform record to be removed once empty, stat err=%v", err)
+	}
+}
+
+// TestTransformersMaterializeOnlyTheWinningLayer tests that a file several
+// layers provide is transformed from the highest one only, so repeated merges
+// leave it alone, and that an unchanged winner is linked rather than replaced
+// by a lower layer's transformed copy.
+func TestTransformersMaterializeOnlyTheWinningLayer(t *testing.T) {
+	base := t.TempDir()
+	targetBase := filepath.Join(t.TempDir(), "view")
+	targetContent := filepath.Join(targetBase, "tf")
+	overlay := t.TempDir()
+	writeFile(t, filepath.Join(base, "tf", "cfg", "server.cfg"), "exec base\r\n")
+	writeFile(t, filepath.Join(overlay, "cfg", "server.cfg"), "exec overlay\r\n")
+	writeFile(t, filepath.Join(base, "tf", "cfg", "motd.cfg"), "base motd\r\n")
+	writeFile(t, filepath.Join(overlay, "cfg", "motd.cfg"), "overlay motd\n")
+
+	m, err := New(&config.MergeConfig{
+		BasePath:      base,
+		TargetBase:    targetBase,
+		TargetContent: targetContent,
+		Overlays:      []config.Overlay{{Name: "overlay", SourcePath: overlay}},
+		Transforms:    []config.TransformRule{{Name: "crlf", Paths: []string{"cfg/*.cfg"}}},
+	})
+	if err != nil {
+		t.Fatalf("new merger: %v", err)
+	}
+	if err := m.Run(context.Background()); err != nil {
+		t.Fatalf("run merge: %v", err)
+	}
+	server := filepath.Join(targetContent, "cfg", "server.cfg")
+	first, err := os.Lstat(server)
+	if err != nil || !first.Mode().IsRegular() {
+		t.Fatalf("expected a materialized server.cfg, err=%v", err)
+	}
+	if got, _ := os.ReadFile(server); string(got) != "exec overlay\n" {
+		t.Errorf("server.cfg: got %q, want the overlay's", got)
+	}
+	assertSymlink(t, filepath.Join(targetContent, "cfg", "motd.cfg"))
+
+	if err := m.Run(context.Background()); err != nil {
+		t.Fatalf("run merge again: %v", err)
+	}
+	second, err := os.Lstat(server)
+	if err != nil || !os.SameFile(first, second) {
+		t.Errorf("expected server.cfg to be left alone by the second merge, err=%v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(targetContent, "cfg", "motd.cfg")); string(got) != "overlay motd\n" {
+		t.Errorf("motd.cfg: got %q, want the overlay's", got)
+	}
+}
+
+// TestFileMergeRemovesDroppedFiles tests that a generated file disappears once
+// no layer provides its source, even when another merger generated it.
+func TestFileMergeRemovesDroppedFiles(t *testing.T) {
+	base := t.TempDir()
+	targetBase := filepath.Join(t.TempDir(), "view")
+	targetContent := filepath.Join(targetBase, "tf")
+	overlay := t.TempDir()
+	mapcycle := filepath.Join("cfg", "mapcycle.txt")
+	writeFile(t, filepath.Join(base, "tf", mapcycle), "koth_harvest_final\n")
+	writeFile(t, filepath.Join(overlay, mapcycle), "pl_upward\n")
+
+	cfg := &config.MergeConfig{
+		BasePath:      base,
+		TargetBase:    targetBase,
+		TargetContent: targetContent,
+		Overlays:      []config.Overlay{{Name: "overlay", SourcePath: overlay}},
+		FileMerges:    []config.FileMerge{{Path: "cfg/mapcycle.txt", Strategy: "lines"}},
+	}
+	run := func() {
+		t.Helper()
+		m, err := New(cfg)
+		if err != nil {
+			t.Fatalf("new merger: %v", err)
+		}
+		if err := m.Run(context.Background()); err != nil {
+			t.Fatalf("run merge: %v", err)
+		}
+	}
+	run()
+	target := filepath.Join(targetContent, mapcycle)
+	if got, _ := os.ReadFile(target); string(got) != "koth_harvest_final\npl_upward\n" {
+		t.Fatalf("merged file: got %q", got)
+	}
+
+	if err := os.Remove(filepath.Join(base, "tf", mapcycle)); err != nil {
+		t.Fatalf("remove source: %v", err)
+	}
+	if err := os.Remove(filepath.Join(overlay, mapcycle)); err != nil {
+		t.Fatalf("remove source: %v", err)
+	}
+	run()
+	if _, err := os.Lstat(target); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed with its sources, stat err=%v", target, err)
+	}
+	if _, err := os.Stat(filepath.Join(targetBase, fileMergeStateName)); !os.IsNotExist(err) {
+		t.Errorf("expected the file merge record to be removed once empty, stat err=%v", err)
+	}
+}
+
+// TestMergeSkipsDecompressManifests tests that decompressor manifests and
+// unfinished writes kept in a layer are not linked into the view.
+func TestMergeSkipsDecompressManifests(t *testing.T) {
+	base := t.TempDir()
+	targetBase := filepath.Join(t.TempDir(), "view")
+	targetContent := filepath.Join(targetBase, "tf")
+	overlay := t.TempDir()
+	writeFile(t, filepath.Join(overlay, "maps", "koth_foo.bsp"), "map")
+	writeFile(t, filepath.Join(overlay, "maps", decompress.ManifestName), "{}")
+	writeFile(t, filepath.Join(base, "tf", decompress.ManifestName), "{}")
+	partial := "." + decompress.ManifestName + ".partial"
+	writeFile(t, filepath.Join(overlay, "maps", partial), "{")
+	writeFile(t, filepath.Join(overlay, "maps", ".koth_bar.bsp.partial"), "half a map")
+
+	// A link left by an earlier version is removed.
+	if err := os.MkdirAll(filepath.Join(targetContent, "maps"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	stale := filepath.Join(targetContent, "maps", decompress.ManifestName)
+	if err := os.Symlink(filepath.Join(overlay, "maps", decompress.ManifestName), stale); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	m, err := New(&config.MergeConfig{
+		BasePath:      base,
+		TargetBase:    targetBase,
+		TargetContent: targetContent,
+		Overlays:      []config.Overlay{{Name: "overlay", SourcePath: overlay}},
+	})
+	if err != nil {
+		t.Fatalf("new merger: %v", err)
+	}
+	if err := m.Run(context.Background()); err != nil {
+		t.Fatalf("run merge: %v", err)
+	}
+	assertSymlink(t, filepath.Join(targetContent, "maps", "koth_foo.bsp"))
+	for _, path := range []string{
+		stale,
+		filepath.Join(targetContent, decompress.ManifestName),
+		filepath.Join(targetContent, "maps", partial),
+		filepath.Join(targetContent, "maps", ".koth_bar.bsp.partial"),
+	} {
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("expected no %s in the view, stat err=%v", path, err)
+		}
+	}
+}
+
+// TestBackupDirNameKeepsTargetsApart tests that target paths differing only in
+// where their separators are get separate backup directories.
+func TestBackupDirNameKeepsTargetsApart(t *testing.T) {
+	if a, b := backupDirName("tf/a_b"), backupDirName("tf_a/b"); a == b {
+		t.Errorf("tf/a_b and tf_a/b share backup directory %s", a)
+	}
+	if a, b := backupDirName("/tf/configs/"), backupDirName("tf/configs"); a != b {
+		t.Errorf("equivalent paths got %s and %s", a, b)
+	}
+}
+
+// TestCopyTemplateBackupIgnoresRuntimeFiles tests that preserved files the
+// server rewrites on its own do not trigger snapshots, and that backups under
+// the directory name of earlier versions are carried over.
+func TestCopyTemplateBackupIgnoresRuntimeFiles(t *testing.T) {
+	base := t.TempDir()
+	backupRoot := t.TempDir()
+	targetBase := filepath.Join(t.TempDir(), "view")
+	targetContent := filepath.Join(targetBase, "tf")
+	writeFile(t, filepath.Join(base, "templates", "core.cfg"), "template")
+	writeFile(t, filepath.Join(backupRoot, "tf_data", "20200101T000000.000Z.tar.gz"), "old snapshot")
+
+	cfg := &config.MergeConfig{
+		BasePath:      base,
+		TargetBase:    targetBase,
+		TargetContent: targetContent,
+		BackupRoot:    backupRoot,
+		CopyTemplates: []config.CopyTemplate{
+			{
+				SourceMount: base,
+				SourcePath:  "templates",
+				TargetPath:  "tf/data",
+				Clean:       true,
+				TargetMode:  "writable",
+				Preserve:    []string{"logs", "*.sq3"},
+				Backup:      &config.BackupPolicy{},
+			},
+		},
+	}
+	m, err := New(cfg)
+	if err != nil {
+		t.Fatalf("new merger: %v", err)
+	}
+	backupDir := filepath.Join(backupRoot, backupDirName("tf/data"))
+	if err := m.Run(context.Background()); err != nil {
+		t.Fatalf("run merge: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		writeFile(t, filepath.Join(targetContent, "data", "logs", "L.log"), fmt.Sprintf("cycle %d", i))
+		writeFile(t, filepath.Join(targetContent, "data", "clientprefs.sq3"), fmt.Sprintf("rows %d", i))
+		if err := m.Run(context.Background()); err != nil {
+			t.Fatalf("run merge %d: %v", i, err)
+		}
+	}
+	entries, err := os.ReadDir(backupDir)
+	if err != nil {
+		t.Fatalf("read backup dir: %v", err)
+	}
+	var snapshots []string
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), ".") {
+			snapshots = append(snapshots, entry.Name())
+		}
+	}
+	if len(snapshots) != 1 || snapshots[0] != "20200101T000000.000Z.tar.gz" {
+		t.Errorf("expected only the migrated snapshot, got %v", snapshots)
+	}
+	if _, err := os.Stat(filepath.Join(backupRoot, "tf_data")); !os.IsNotExist(err) {
+		t.Errorf("expected the old backup directory to be moved, stat err=%v", err)
+	}
+}
+
+// TestPruneBackupsOrder tests that colliding snapshot names sort after the
+// original and that incomplete snapshots are not kept as backups.
+func TestPruneBackupsOrder(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "20240101T000000.000Z")
+	writeFile(t, base+".tar.gz", "first")
+	second := uniqueBackupPath(base, ".tar.gz")
+	writeFile(t, second, "second")
+	writeFile(t, filepath.Join(dir, "20230101T000000.000Z.tar.gz.tmp"), "crashed")
+	writeFile(t, filepath.Join(dir, "20230101T000000.000Z.tmp", "a.cfg"), "crashed")
+
+	if err := pruneBackups(dir, 1); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	if len(entries) != 1 || filepath.Join(dir, entries[0].Name()) != second {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Errorf("expected only %s to remain, got %v", filepath.Base(second), names)
+	}
+}
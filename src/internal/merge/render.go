@@ -0,0 +1,181 @@
+package merge
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// renderData is exposed to copy template files marked for rendering.
+type renderData struct {
+	Env     map[string]string
+	Secrets map[string]string
+	Pod     podInfo
+}
+
+// podInfo describes the pod the merger runs in.
+type podInfo struct {
+	Hostname  string
+	Name      string
+	Namespace string
+	// Ordinal is the StatefulSet ordinal parsed from the pod name, or -1.
+	Ordinal int
+}
+
+// loadRenderData collects environment variables, secret files and pod metadata.
+// Secret directories are read in order; later directories override earlier ones.
+func loadRenderData(secretDirs []string) (*renderData, error) {
+	data := &renderData{
+		Env:     make(map[string]string),
+		Secrets: make(map[string]string),
+	}
+	for _, kv := range os.Environ() {
+		if key, val, ok := strings.Cut(kv, "="); ok {
+			data.Env[key] = val
+		}
+	}
+	for _, dir := range secretDirs {
+		if err := readSecretDir(dir, data.Secrets); err != nil {
+			return nil, err
+		}
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Printf("render warning: unable to read hostname: %v", err)
+	}
+	name := data.Env["POD_NAME"]
+	if name == "" {
+		name = hostname
+	}
+	data.Pod = podInfo{
+		Hostname:  hostname,
+		Name:      name,
+		Namespace: data.Env["POD_NAMESPACE"],
+		Ordinal:   podOrdinal(name),
+	}
+	return data, nil
+}
+
+// readSecretDir loads every file of a mounted secret into secrets keyed by file
+// name. Kubernetes bookkeeping entries (..data, ..2024_01_01...) are skipped.
+func readSecretDir(dir string, secrets map[string]string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			log.Printf("render warning: secret dir %s missing, skipping", dir)
+			return nil
+		}
+		return fmt.Errorf("read secret dir %s: %w", dir, err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "..") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read secret %s: %w", path, err)
+		}
+		secrets[entry.Name()] = strings.TrimRight(string(content), "\r\n")
+	}
+	return nil
+}
+
+// podOrdinal extracts the trailing StatefulSet ordinal from a pod name.
+func podOrdinal(name string) int {
+	idx := strings.LastIndex(name, "-")
+	if idx < 0 || idx == len(name)-1 {
+		return -1
+	}
+	n, err := strconv.Atoi(name[idx+1:])
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+func (d *renderData) funcs() template.FuncMap {
+	return template.FuncMap{
+		"env": func(key string) string {
+			return d.Env[key]
+		},
+		"secret": func(name string) (string, error) {
+			val, ok := d.Secrets[name]
+			if !ok {
+				return "", fmt.Errorf("secret %q not found", name)
+			}
+			return val, nil
+		},
+		"default": func(fallback, val string) string {
+			if val == "" {
+				return fallback
+			}
+			return val
+		},
+		"add": func(a, b int) int {
+			return a + b
+		},
+	}
+}
+
+// renderedFileMode is the mode of rendered files when the template sets an
+// owner but no mode. Rendered files usually carry secrets, so they are not
+// world-readable like their sources; without an owner the merger's root would
+// own them, so they keep the source's mode instead.
+const renderedFileMode os.FileMode = 0o640
+
+// renderFile executes src as a text/template and atomically replaces dest
+// with the result.
+func renderFile(src, dest string, perm os.FileMode, data *renderData) error {
+	if data == nil {
+		return fmt.Errorf("render %s: no render data", src)
+	}
+	raw, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	tpl, err := template.New(filepath.Base(src)).
+		Option("missingkey=error").
+		Funcs(data.funcs()).
+		Parse(string(raw))
+	if err != nil {
+		return fmt.Errorf("parse template %s: %w", src, err)
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		return fmt.Errorf("render template %s: %w", src, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+	// Replace dest in one step so the server never reads a partial file
+	tmp, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".render-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(buf.Bytes())
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dest)
+	}
+	if err != nil {
+		return fmt.Errorf("write %s: %w", dest, err)
+	}
+	return nil
+}
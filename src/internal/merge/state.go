@@ -0,0 +1,55 @@
+package merge
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+)
+
+// The init container and the watcher merge in separate processes, so what a
+// merge generated in the view is recorded next to it for the next merge to
+// clean up, whichever process runs it.
+const (
+	transformStateName = ".tf2chart-transforms.json"
+	fileMergeStateName = ".tf2chart-file-merges.json"
+)
+
+// loadState reads the JSON record at path into v. A missing or unreadable
+// record leaves v untouched.
+func loadState(path string, v any) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("merge warning: cannot read %s: %v", path, err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		log.Printf("merge warning: cannot parse %s: %v", path, err)
+	}
+}
+
+// saveState writes v to path atomically. An empty record removes the file.
+func saveState(path string, v any, empty bool) error {
+	if empty {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".partial"
+	if err := os.WriteFile(tmpPath, append(data, '\n'), 0o644); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,392 @@
+package merge
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/UDL-TF/TF2Chart/src/internal/config"
+)
+
+// Transformer rewrites file content on its way from a layer into the view.
+// Files matched by at least one transformer are materialized as real files;
+// everything else stays a symlink to the layer.
+type Transformer interface {
+	// Match reports whether the transformer applies to rel, a path relative to the content root.
+	Match(rel string) bool
+	// Rename returns the view path for a transformed file, or rel unchanged.
+	Rename(rel string) string
+	// Transform writes the transformed content of src to dst and reports
+	// whether the output differs from the input.
+	Transform(dst io.Writer, src io.Reader) (bool, error)
+}
+
+// TransformerFactory builds a transformer for the given globs. An empty glob
+// list selects the transformer's default patterns.
+type TransformerFactory func(paths []string) Transformer
+
+var (
+	transformersMu sync.RWMutex
+	transformers   = map[string]TransformerFactory{
+		"crlf":    func(paths []string) Transformer { return &crlfTransformer{globs(paths, "*.cfg", "*.txt")} },
+		"bom":     func(paths []string) Transformer { return &bomTransformer{globs(paths, "*.cfg", "*.txt")} },
+		"gunzip":  func(paths []string) Transformer { return &expandTransformer{globs(paths, "*.gz"), ".gz", gunzip} },
+		"bunzip2": func(paths []string) Transformer { return &expandTransformer{globs(paths, "*.bz2"), ".bz2", bunzip2} },
+	}
+)
+
+// RegisterTransformer makes a transformer available to MergeConfig.Transforms by name.
+func RegisterTransformer(name string, factory TransformerFactory) {
+	transformersMu.Lock()
+	defer transformersMu.Unlock()
+	transformers[name] = factory
+}
+
+func buildTransformers(rules []config.TransformRule) ([]Transformer, error) {
+	transformersMu.RLock()
+	defer transformersMu.RUnlock()
+	var out []Transformer
+	for _, rule := range rules {
+		factory, ok := transformers[rule.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown transformer %q", rule.Name)
+		}
+		out = append(out, factory(rule.Paths))
+	}
+	return out, nil
+}
+
+// pipeline applies transformers to the files mergeTree finds and remembers
+// which view files it materialized so they can be removed once their source
+// disappears.
+type pipeline struct {
+	transformers []Transformer
+	contentRoot  string
+	statePath    string
+	outputs      map[string]string        // view path -> layer source
+	pending      map[string]pendingOutput // view path -> file of the highest layer providing it
+}
+
+// pendingOutput is a layer file the transformers apply to, materialized once
+// every layer is merged.
+type pendingOutput struct {
+	chain  []Transformer
+	source string
+	rel    string
+}
+
+func newPipeline(transformers []Transformer, contentRoot, statePath string) *pipeline {
+	return &pipeline{
+		transformers: transformers,
+		contentRoot:  filepath.Clean(contentRoot),
+		statePath:    statePath,
+		outputs:      make(map[string]string),
+		pending:      make(map[string]pendingOutput),
+	}
+}
+
+// load replaces the known outputs with the ones recorded by the last merge,
+// whichever process ran it.
+func (p *pipeline) load() {
+	if p == nil || p.statePath == "" {
+		return
+	}
+	outputs := make(map[string]string)
+	loadState(p.statePath, &outputs)
+	p.outputs = outputs
+}
+
+// save records the known outputs for the next merge.
+func (p *pipeline) save() error {
+	if p == nil || p.statePath == "" {
+		return nil
+	}
+	return saveState(p.statePath, p.outputs, len(p.outputs) == 0)
+}
+
+// matching returns the path of the view file target relative to the content
+// root and the transformers that apply to it, in configured order. Base and
+// overlay files thereby match the same patterns; files outside the content
+// root are never transformed.
+func (p *pipeline) matching(target string) (string, []Transformer) {
+	if p == nil {
+		return "", nil
+	}
+	rel, err := filepath.Rel(p.contentRoot, target)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", nil
+	}
+	var out []Transformer
+	for _, t := range p.transformers {
+		if t.Match(rel) {
+			out = append(out, t)
+		}
+	}
+	return rel, out
+}
+
+// outputPath returns the view file chain writes for rel.
+func (p *pipeline) outputPath(chain []Transformer, rel string) string {
+	for _, t := range chain {
+		rel = t.Rename(rel)
+	}
+	return filepath.Join(p.contentRoot, rel)
+}
+
+// queue schedules source, merged to rel below the content root, for chain. A
+// higher layer providing the same view file replaces the entry, so only the
+// file that wins is materialized and recorded.
+func (p *pipeline) queue(chain []Transformer, source, rel string) {
+	p.pending[p.outputPath(chain, rel)] = pendingOutput{chain: chain, source: source, rel: rel}
+}
+
+// drop forgets the queued output for target once a higher layer links an
+// untransformed file there.
+func (p *pipeline) drop(target string) {
+	if p != nil {
+		delete(p.pending, target)
+	}
+}
+
+// flush materializes the queued outputs, linking the original file wherever
+// no transformer changed anything.
+func (p *pipeline) flush() error {
+	if p == nil {
+		return nil
+	}
+	defer clear(p.pending)
+	for target, out := range p.pending {
+		materialized, err := p.materialize(out.chain, out.source, out.rel)
+		if err != nil {
+			return err
+		}
+		if materialized {
+			continue
+		}
+		delete(p.outputs, target)
+		if err := os.Remove(target); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := os.Symlink(out.source, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// materialize writes the transformed source to rel (after renames) below the
+// content root and reports false when no transformer changed anything, in
+// which case the caller links the original instead.
+func (p *pipeline) materialize(chain []Transformer, source, rel string) (bool, error) {
+	target := p.outputPath(chain, rel)
+	renamed := target != filepath.Join(p.contentRoot, rel)
+	srcInfo, err := os.Stat(source)
+	if err != nil {
+		return false, err
+	}
+	if info, err := os.Lstat(target); err == nil && info.Mode().IsRegular() && p.outputs[target] == source && info.ModTime().Equal(srcInfo.ModTime()) {
+		return true, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return false, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".transform-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	in, err := os.Open(source)
+	if err != nil {
+		tmp.Close()
+		return false, err
+	}
+	changed, err := runChain(chain, tmp, in)
+	in.Close()
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, fmt.Errorf("transform %s: %w", source, err)
+	}
+	if !changed && !renamed {
+		return false, nil
+	}
+	if err := os.Chmod(tmp.Name(), srcInfo.Mode().Perm()); err != nil {
+		return false, err
+	}
+	if err := os.Chtimes(tmp.Name(), srcInfo.ModTime(), srcInfo.ModTime()); err != nil {
+		return false, err
+	}
+	if err := os.Remove(target); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return false, err
+	}
+	p.outputs[target] = source
+	return true, nil
+}
+
+// pruneOutputs removes materialized files whose layer source no longer exists.
+func (p *pipeline) pruneOutputs() error {
+	if p == nil {
+		return nil
+	}
+	for target, source := range p.outputs {
+		if _, err := os.Stat(source); err == nil {
+			continue
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if info, err := os.Lstat(target); err == nil && info.Mode().IsRegular() {
+			log.Printf("transform: removing %s, source %s is gone", target, source)
+			if err := os.Remove(target); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		delete(p.outputs, target)
+	}
+	return nil
+}
+
+// runChain streams src through every transformer in order.
+func runChain(chain []Transformer, dst io.Writer, src io.Reader) (bool, error) {
+	if len(chain) == 1 {
+		return chain[0].Transform(dst, src)
+	}
+	results := make(chan error, len(chain))
+	changed := make([]bool, len(chain))
+	reader := src
+	for i, t := range chain[:len(chain)-1] {
+		pr, pw := io.Pipe()
+		go func(i int, t Transformer, in io.Reader) {
+			var err error
+			changed[i], err = t.Transform(pw, in)
+			pw.CloseWithError(err)
+			if upstream, ok := in.(*io.PipeReader); ok {
+				upstream.Close()
+			}
+			results <- err
+		}(i, t, reader)
+		reader = pr
+	}
+	last := len(chain) - 1
+	var err error
+	changed[last], err = chain[last].Transform(dst, reader)
+	if err != nil {
+		// Unblock upstream writers before collecting their results.
+		reader.(*io.PipeReader).CloseWithError(err)
+	}
+	for range chain[:last] {
+		if upstream := <-results; upstream != nil && err == nil {
+			err = upstream
+		}
+	}
+	result := false
+	for _, c := range changed {
+		result = result || c
+	}
+	return result, err
+}
+
+func globs(paths []string, defaults ...string) []string {
+	if len(paths) > 0 {
+		return paths
+	}
+	return defaults
+}
+
+// crlfTransformer normalizes CRLF line endings to LF.
+type crlfTransformer struct{ paths []string }
+
+func (t *crlfTransformer) Match(rel string) bool    { return matchAny(t.paths, rel) }
+func (t *crlfTransformer) Rename(rel string) string { return rel }
+
+func (t *crlfTransformer) Transform(dst io.Writer, src io.Reader) (bool, error) {
+	r := bufio.NewReader(src)
+	w := bufio.NewWriter(dst)
+	changed := false
+	for {
+		b, err := r.ReadByte()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+		if b == '\r' {
+			if next, err := r.Peek(1); err == nil && next[0] == '\n' {
+				changed = true
+				continue
+			}
+		}
+		if err := w.WriteByte(b); err != nil {
+			return false, err
+		}
+	}
+	return changed, w.Flush()
+}
+
+// bomTransformer strips a leading UTF-8 byte order mark.
+type bomTransformer struct{ paths []string }
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+func (t *bomTransformer) Match(rel string) bool    { return matchAny(t.paths, rel) }
+func (t *bomTransformer) Rename(rel string) string { return rel }
+
+func (t *bomTransformer) Transform(dst io.Writer, src io.Reader) (bool, error) {
+	r := bufio.NewReader(src)
+	head, err := r.Peek(len(utf8BOM))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+	changed := bytes.Equal(head, utf8BOM)
+	if changed {
+		r.Discard(len(utf8BOM))
+	}
+	_, err = io.Copy(dst, r)
+	return changed, err
+}
+
+// expandTransformer decompresses single-file archives and drops their extension.
+type expandTransformer struct {
+	paths  []string
+	ext    string
+	expand func(io.Reader) (io.Reader, error)
+}
+
+func (t *expandTransformer) Match(rel string) bool { return matchAny(t.paths, rel) }
+
+func (t *expandTransformer) Rename(rel string) string {
+	if strings.HasSuffix(strings.ToLower(rel), t.ext) {
+		return rel[:len(rel)-len(t.ext)]
+	}
+	return rel
+}
+
+func (t *expandTransformer) Transform(dst io.Writer, src io.Reader) (bool, error) {
+	r, err := t.expand(src)
+	if err != nil {
+		return false, err
+	}
+	_, err = io.Copy(dst, r)
+	return true, err
+}
+
+func gunzip(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+func bunzip2(r io.Reader) (io.Reader, error) {
+	return bzip2.NewReader(r), nil
+}
@@ -0,0 +1,208 @@
+package permissions
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Extended attribute names and tags of the Linux POSIX ACL encoding.
+const (
+	xattrAccessACL  = "system.posix_acl_access"
+	xattrDefaultACL = "system.posix_acl_default"
+
+	aclVersion   = 2
+	aclUserObj   = 0x01
+	aclUser      = 0x02
+	aclGroupObj  = 0x04
+	aclGroup     = 0x08
+	aclMask      = 0x10
+	aclOther     = 0x20
+	aclUndefined = 0xFFFFFFFF
+)
+
+type aclEntry struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+// ACL is a list of named POSIX ACL entries. The owner, owning group and other
+// entries are derived from the file mode when the ACL is applied, and the
+// mask defaults to the union of the group class permissions like setfacl.
+type ACL struct {
+	entries []aclEntry
+	mask    *uint16
+}
+
+// ParseACL parses entries such as user:1001:rwx, g:2000:r-x or mask::rx.
+// Principals are numeric ids because the images carry no passwd database.
+// An empty list yields an ACL that removes every named entry.
+func ParseACL(specs []string) (*ACL, error) {
+	acl := &ACL{}
+	for _, spec := range specs {
+		parts := strings.Split(strings.TrimSpace(spec), ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("acl entry %q: want type:id:perms", spec)
+		}
+		perm, err := parseACLPerm(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("acl entry %q: %w", spec, err)
+		}
+		switch parts[0] {
+		case "u", "user", "g", "group":
+			if parts[1] == "" {
+				return nil, fmt.Errorf("acl entry %q: owner and owning group come from the mode", spec)
+			}
+			id, err := strconv.ParseUint(parts[1], 10, 32)
+			if err != nil || id == aclUndefined {
+				return nil, fmt.Errorf("acl entry %q: id must be numeric", spec)
+			}
+			tag := uint16(aclUser)
+			if parts[0][0] == 'g' {
+				tag = aclGroup
+			}
+			acl.entries = append(acl.entries, aclEntry{tag: tag, perm: perm, id: uint32(id)})
+		case "m", "mask":
+			if parts[1] != "" {
+				return nil, fmt.Errorf("acl entry %q: mask takes no id", spec)
+			}
+			acl.mask = &perm
+		default:
+			return nil, fmt.Errorf("acl entry %q: unknown type %q", spec, parts[0])
+		}
+	}
+	sort.SliceStable(acl.entries, func(i, j int) bool {
+		a, b := acl.entries[i], acl.entries[j]
+		if a.tag != b.tag {
+			return a.tag < b.tag
+		}
+		return a.id < b.id
+	})
+	return acl, nil
+}
+
+func parseACLPerm(val string) (uint16, error) {
+	if len(val) == 1 && val[0] >= '0' && val[0] <= '7' {
+		return uint16(val[0] - '0'), nil
+	}
+	var perm uint16
+	for _, c := range val {
+		switch c {
+		case 'r':
+			perm |= 4
+		case 'w':
+			perm |= 2
+		case 'x':
+			perm |= 1
+		case '-':
+		default:
+			return 0, fmt.Errorf("invalid permission %q", val)
+		}
+	}
+	return perm, nil
+}
+
+// encode returns the xattr value for the ACL on an entry whose permission
+// bits are mode, with the owning group granted groupObj. It returns nil when
+// the ACL has no named entries, meaning the attribute should not exist, and
+// otherwise the mode the kernel reports afterwards: the group bits show the mask.
+func (a *ACL) encode(mode fs.FileMode, groupObj uint16) ([]byte, fs.FileMode) {
+	if len(a.entries) == 0 && a.mask == nil {
+		return nil, mode
+	}
+	mask := groupObj
+	for _, e := range a.entries {
+		mask |= e.perm
+	}
+	if a.mask != nil {
+		mask = *a.mask
+	}
+	bits := uint16(mode.Perm())
+	entries := []aclEntry{{tag: aclUserObj, perm: bits >> 6 & 7, id: aclUndefined}}
+	var groups []aclEntry
+	for _, e := range a.entries {
+		if e.tag == aclUser {
+			entries = append(entries, e)
+		} else {
+			groups = append(groups, e)
+		}
+	}
+	entries = append(entries, aclEntry{tag: aclGroupObj, perm: groupObj, id: aclUndefined})
+	entries = append(entries, groups...)
+	entries = append(entries,
+		aclEntry{tag: aclMask, perm: mask, id: aclUndefined},
+		aclEntry{tag: aclOther, perm: bits & 7, id: aclUndefined})
+
+	buf := make([]byte, 4, 4+8*len(entries))
+	binary.LittleEndian.PutUint32(buf, aclVersion)
+	for _, e := range entries {
+		buf = binary.LittleEndian.AppendUint16(buf, e.tag)
+		buf = binary.LittleEndian.AppendUint16(buf, e.perm)
+		buf = binary.LittleEndian.AppendUint32(buf, e.id)
+	}
+	return buf, mode&^0o070 | fs.FileMode(mask)<<3
+}
+
+// decodeACL parses an xattr value produced by the kernel or encode.
+func decodeACL(value []byte) ([]aclEntry, error) {
+	if len(value) < 4 || (len(value)-4)%8 != 0 || binary.LittleEndian.Uint32(value) != aclVersion {
+		return nil, fmt.Errorf("malformed posix acl of %d bytes", len(value))
+	}
+	var entries []aclEntry
+	for off := 4; off < len(value); off += 8 {
+		entries = append(entries, aclEntry{
+			tag:  binary.LittleEndian.Uint16(value[off:]),
+			perm: binary.LittleEndian.Uint16(value[off+2:]),
+			id:   binary.LittleEndian.Uint32(value[off+4:]),
+		})
+	}
+	return entries, nil
+}
+
+// groupObj returns the owning group permissions recorded in an ACL value.
+func groupObj(value []byte) (uint16, bool) {
+	entries, err := decodeACL(value)
+	if err != nil {
+		return 0, false
+	}
+	for _, e := range entries {
+		if e.tag == aclGroupObj {
+			return e.perm, true
+		}
+	}
+	return 0, false
+}
+
+// formatACL renders an ACL value in getfacl's short text form.
+func formatACL(value []byte) string {
+	if value == nil {
+		return "none"
+	}
+	entries, err := decodeACL(value)
+	if err != nil {
+		return err.Error()
+	}
+	names := map[uint16]string{
+		aclUserObj: "user", aclUser: "user", aclGroupObj: "group", aclGroup: "group",
+		aclMask: "mask", aclOther: "other",
+	}
+	parts := make([]string, 0, len(entries))
+	for _, e := range entries {
+		id := ""
+		if e.tag == aclUser || e.tag == aclGroup {
+			id = strconv.FormatUint(uint64(e.id), 10)
+		}
+		perm := []byte("---")
+		for i, c := range "rwx" {
+			if e.perm&(4>>i) != 0 {
+				perm[i] = byte(c)
+			}
+		}
+		parts = append(parts, fmt.Sprintf("%s:%s:%s", names[e.tag], id, perm))
+	}
+	return strings.Join(parts, ",")
+}
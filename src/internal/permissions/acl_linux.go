@@ -0,0 +1,44 @@
+package permissions
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// getACL returns the raw ACL stored in the named xattr, or nil when there is none.
+func getACL(path, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(path, name, nil)
+	if errors.Is(err, syscall.ENODATA) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get %s on %s: %w", name, path, err)
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Getxattr(path, name, buf)
+	if err != nil {
+		return nil, fmt.Errorf("get %s on %s: %w", name, path, err)
+	}
+	return buf[:size], nil
+}
+
+// setACL stores value in the named xattr, removing the attribute for nil.
+func setACL(path, name string, value []byte) error {
+	var err error
+	if value == nil {
+		err = syscall.Removexattr(path, name)
+		if errors.Is(err, syscall.ENODATA) {
+			return nil
+		}
+	} else {
+		err = syscall.Setxattr(path, name, value, 0)
+	}
+	if errors.Is(err, syscall.ENOTSUP) {
+		return fmt.Errorf("set %s on %s: filesystem does not support POSIX ACLs", name, path)
+	}
+	if err != nil {
+		return fmt.Errorf("set %s on %s: %w", name, path, err)
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package permissions
+
+import "errors"
+
+var errACLUnsupported = errors.New("POSIX ACLs are only supported on Linux")
+
+func getACL(path, name string) ([]byte, error) {
+	return nil, errACLUnsupported
+}
+
+func setACL(path, name string, value []byte) error {
+	return errACLUnsupported
+}
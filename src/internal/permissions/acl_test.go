@@ -0,0 +1,54 @@
+package permissions
+
+import (
+	"io/fs"
+	"testing"
+)
+
+func TestACLEncodeDerivesBaseEntriesAndMask(t *testing.T) {
+	acl, err := ParseACL([]string{"group:2000:r-x", "user:1001:rwx", "u:1000:6"})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	value, mode := acl.encode(0o750, 0o5)
+	want := "user::rwx,user:1000:rw-,user:1001:rwx,group::r-x,group:2000:r-x,mask::rwx,other::---"
+	if got := formatACL(value); got != want {
+		t.Errorf("acl: got %s, want %s", got, want)
+	}
+	if mode != 0o770 {
+		t.Errorf("mode: got %v, want group bits showing the mask", mode)
+	}
+	if perm, ok := groupObj(value); !ok || perm != 0o5 {
+		t.Errorf("group obj: got %o, %v", perm, ok)
+	}
+
+	masked, err := ParseACL([]string{"user:1001:rwx", "mask::r-x"})
+	if err != nil {
+		t.Fatalf("parse masked: %v", err)
+	}
+	value, mode = masked.encode(fs.ModeSetgid|0o775, 0o7)
+	if got := formatACL(value); got != "user::rwx,user:1001:rwx,group::rwx,mask::r-x,other::r-x" {
+		t.Errorf("masked acl: got %s", got)
+	}
+	if mode != fs.ModeSetgid|0o755 {
+		t.Errorf("masked mode: got %v", mode)
+	}
+}
+
+func TestACLEmptyRemovesNamedEntries(t *testing.T) {
+	acl, err := ParseACL([]string{})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if value, mode := acl.encode(0o644, 0o4); value != nil || mode != 0o644 {
+		t.Errorf("empty acl: got %v, %v", value, mode)
+	}
+}
+
+func TestParseACLErrors(t *testing.T) {
+	for _, spec := range []string{"user::rwx", "user:bob:rwx", "other::r", "mask:1:rwx", "user:1:rwz", "user:1"} {
+		if _, err := ParseACL([]string{spec}); err == nil {
+			t.Errorf("%q: expected error", spec)
+		}
+	}
+}
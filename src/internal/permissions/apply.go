@@ -0,0 +1,555 @@
+package permissions
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// specialBits are the mode bits chmod(2) controls besides the permissions.
+const specialBits = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+
+// batchSize is the number of directory entries a worker fixes per task, so
+// large directories are spread over every worker.
+const batchSize = 64
+
+// Options tunes a single Apply run.
+type Options struct {
+	Audit          bool          // Only report entries that differ from their rules
+	MaxMismatches  int           // Cap on Report.Mismatches; 0 records none, negative records all
+	Exclude        []string      // Globs relative to the root that are skipped with everything below them
+	FollowSymlinks bool          // Also walk the directories that symlinks point to
+	Parallelism    int           // Concurrent workers listing directories and fixing entries; below 1 means 1
+	Progress       time.Duration // Interval between progress log lines; 0 disables them
+	Budget         Budget        // Shared cap on tasks running at once across concurrent Apply calls; nil means none
+}
+
+// Budget caps how many tasks run at once across every Apply call sharing it,
+// so concurrent jobs together stay within one parallelism setting.
+type Budget chan struct{}
+
+// NewBudget returns a Budget of n concurrent tasks; below 1 means 1.
+func NewBudget(n int) Budget {
+	return make(Budget, max(n, 1))
+}
+
+// acquire takes a slot, or reports false once ctx is done. A nil Budget
+// always has room.
+func (b Budget) acquire(ctx context.Context) bool {
+	if b == nil {
+		return true
+	}
+	select {
+	case b <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (b Budget) release() {
+	if b != nil {
+		<-b
+	}
+}
+
+// Report summarizes an Apply run. In audit mode Changed counts the entries
+// that would have been changed.
+type Report struct {
+	Scanned         int        `json:"scanned"`
+	Changed         int        `json:"changed"`
+	OwnerMismatches int        `json:"ownerMismatches"`
+	ModeMismatches  int        `json:"modeMismatches"`
+	ACLMismatches   int        `json:"aclMismatches"`
+	Mismatches      []Mismatch `json:"mismatches,omitempty"`
+	Truncated       bool       `json:"truncated,omitempty"` // More mismatches than MaxMismatches were found
+}
+
+// Mismatch describes an entry whose ownership or mode differs from its rules.
+type Mismatch struct {
+	Path  string `json:"path"`
+	Owner string `json:"owner,omitempty"` // current -> wanted uid:gid
+	Mode  string `json:"mode,omitempty"`  // current -> wanted octal mode
+	ACL   string `json:"acl,omitempty"`   // current -> wanted access/default ACL
+}
+
+// Apply walks root and sets the ownership and mode resolved by rules on every
+// entry, skipping entries that are already correct. Symlinks are chowned
+// themselves and never chmodded, since chmod would follow them; with
+// FollowSymlinks the directories they point to are walked as well, using the
+// link's path for rule matching. Cancelling ctx stops the walk before the
+// next entry.
+func Apply(ctx context.Context, root string, rules Rules, opts Options) (Report, error) {
+	var report Report
+	if err := ctx.Err(); err != nil {
+		return report, err
+	}
+	excludes, err := compileExcludes(opts.Exclude)
+	if err != nil {
+		return report, err
+	}
+	info, err := os.Lstat(root)
+	if err != nil {
+		return report, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := &walker{ctx: ctx, rules: rules, opts: opts, excludes: excludes, report: &report, start: time.Now()}
+	w.queue.cond = sync.NewCond(&w.queue.mu)
+	stopQueue := context.AfterFunc(ctx, w.queue.stop)
+	defer stopQueue()
+	if opts.FollowSymlinks {
+		if real, err := filepath.EvalSymlinks(root); err == nil {
+			w.visited = append(w.visited, real)
+		}
+	}
+	w.discovered.Add(1)
+	w.queue.push(task{entries: []entry{{path: root, rel: ".", dirEntry: fs.FileInfoToDirEntry(info)}}})
+
+	if opts.Progress > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go w.logProgress(root, opts.Progress, done)
+	}
+	workers := opts.Parallelism
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.work()
+		}()
+	}
+	wg.Wait()
+	if w.err == nil {
+		w.err = ctx.Err()
+	}
+	return report, w.err
+}
+
+// task is either a directory to list or a batch of entries to fix.
+type task struct {
+	dir     string // directory to list
+	base    string // its path relative to the job root
+	entries []entry
+}
+
+type entry struct {
+	path     string
+	rel      string
+	dirEntry fs.DirEntry
+}
+
+type walker struct {
+	ctx      context.Context
+	rules    Rules
+	opts     Options
+	excludes []Rule
+	queue    queue
+	start    time.Time
+
+	discovered atomic.Int64 // entries listed so far
+	processed  atomic.Int64 // entries checked so far
+
+	mu      sync.Mutex // guards report, visited and err
+	report  *Report
+	visited []string // real paths of trees already walked, to stop symlink cycles
+	err     error
+}
+
+func (w *walker) work() {
+	for {
+		t, ok := w.queue.pop()
+		if !ok {
+			return
+		}
+		if !w.opts.Budget.acquire(w.ctx) {
+			w.queue.done()
+			continue
+		}
+		var err error
+		if t.dir != "" {
+			err = w.list(t.dir, t.base)
+		} else {
+			for _, e := range t.entries {
+				if err = w.ctx.Err(); err != nil {
+					break
+				}
+				if err = w.visit(e); err != nil {
+					break
+				}
+			}
+		}
+		w.opts.Budget.release()
+		if err != nil {
+			w.fail(err)
+		}
+		w.queue.done()
+	}
+}
+
+// fail records the first error and stops every worker.
+func (w *walker) fail(err error) {
+	w.mu.Lock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.mu.Unlock()
+	w.queue.stop()
+}
+
+// list queues the entries of dir in batches.
+func (w *walker) list(dir, base string) error {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	w.discovered.Add(int64(len(dirEntries)))
+	for start := 0; start < len(dirEntries); start += batchSize {
+		end := min(start+batchSize, len(dirEntries))
+		batch := make([]entry, 0, end-start)
+		for _, d := range dirEntries[start:end] {
+			batch = append(batch, entry{
+				path:     filepath.Join(dir, d.Name()),
+				rel:      filepath.Join(base, d.Name()),
+				dirEntry: d,
+			})
+		}
+		w.queue.push(task{entries: batch})
+	}
+	return nil
+}
+
+// visit fixes a single entry and queues the directory listing below it.
+func (w *walker) visit(e entry) error {
+	defer w.processed.Add(1)
+	d := e.dirEntry
+	if e.rel != "." && w.excluded(e.rel) {
+		return nil
+	}
+	info, err := d.Info()
+	if err != nil {
+		if IgnoreError(err) {
+			return nil
+		}
+		return err
+	}
+	if err := w.fix(e.path, info, w.rules.Resolve(e.rel, d.IsDir())); err != nil {
+		return err
+	}
+	switch {
+	case d.IsDir():
+		w.queue.push(task{dir: e.path, base: e.rel})
+	case w.opts.FollowSymlinks && d.Type()&fs.ModeSymlink != 0:
+		return w.follow(e.path, e.rel)
+	}
+	return nil
+}
+
+// follow queues the directory link points to unless that tree was already visited.
+func (w *walker) follow(link, rel string) error {
+	target, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		if IgnoreError(err) {
+			return nil // dangling link
+		}
+		return err
+	}
+	info, err := os.Stat(target)
+	if err != nil || !info.IsDir() {
+		return nil
+	}
+	w.mu.Lock()
+	for _, seen := range w.visited {
+		if target == seen || strings.HasPrefix(target, seen+string(filepath.Separator)) {
+			w.mu.Unlock()
+			return nil
+		}
+	}
+	w.visited = append(w.visited, target)
+	w.mu.Unlock()
+	w.discovered.Add(1)
+	w.queue.push(task{entries: []entry{{path: target, rel: rel, dirEntry: fs.FileInfoToDirEntry(info)}}})
+	return nil
+}
+
+func (w *walker) excluded(rel string) bool {
+	rel = filepath.ToSlash(rel)
+	for i := range w.excludes {
+		if w.excludes[i].match(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// fix compares info against target and changes what differs, or only records
+// it in audit mode.
+func (w *walker) fix(path string, info fs.FileInfo, target Target) error {
+	var mismatch Mismatch
+	uid, gid, known := owner(info)
+	wantUID, wantGID := target.UID, target.GID
+	if wantUID < 0 {
+		wantUID = uid
+	}
+	if wantGID < 0 {
+		wantGID = gid
+	}
+	chown := (target.UID >= 0 || target.GID >= 0) && (!known || uid != wantUID || gid != wantGID)
+	if chown {
+		mismatch.Owner = fmt.Sprintf("%d:%d -> %d:%d", uid, gid, wantUID, wantGID)
+	}
+
+	current := info.Mode() & specialBits
+	symlink := info.Mode()&fs.ModeSymlink != 0
+	want := current
+	if target.Mode != nil && !symlink {
+		want = target.Mode.Apply(current, info.IsDir())
+	}
+	var acls []aclChange
+	if !symlink && (target.ACL != nil || target.DefaultACL != nil) {
+		var err error
+		want, acls, err = planACLs(path, info.IsDir(), target, want)
+		if err != nil {
+			return err
+		}
+		for _, change := range acls {
+			if mismatch.ACL != "" {
+				mismatch.ACL += "; "
+			}
+			mismatch.ACL += change.describe()
+		}
+	}
+	chmod := false
+	if target.Mode != nil && !symlink {
+		// chown clears setuid/setgid on files, so those need another chmod.
+		chmod = want != current || (chown && !info.IsDir() && want&(fs.ModeSetuid|fs.ModeSetgid) != 0)
+	}
+	if chmod && want != current {
+		mismatch.Mode = fmt.Sprintf("%04o -> %04o", toUnix(current), toUnix(want))
+	}
+
+	w.mu.Lock()
+	w.report.Scanned++
+	if chown || chmod || len(acls) > 0 {
+		w.report.Changed++
+	}
+	if mismatch.Owner != "" {
+		w.report.OwnerMismatches++
+	}
+	if mismatch.Mode != "" {
+		w.report.ModeMismatches++
+	}
+	if mismatch.ACL != "" {
+		w.report.ACLMismatches++
+	}
+	if mismatch.Owner != "" || mismatch.Mode != "" || mismatch.ACL != "" {
+		mismatch.Path = path
+		w.report.record(mismatch, w.opts.MaxMismatches)
+	}
+	w.mu.Unlock()
+
+	if w.opts.Audit {
+		return nil
+	}
+	if chown {
+		if err := os.Lchown(path, target.UID, target.GID); err != nil && !IgnoreError(err) {
+			return fmt.Errorf("chown %s: %w", path, err)
+		}
+	}
+	if chmod {
+		if err := os.Chmod(path, want); err != nil && !IgnoreError(err) {
+			return fmt.Errorf("chmod %s: %w", path, err)
+		}
+	}
+	// Set ACLs last: chmod on an entry with an ACL rewrites its mask.
+	for _, change := range acls {
+		if err := setACL(path, change.name, change.value); err != nil && !IgnoreError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// aclChange is an ACL xattr that differs from the rules.
+type aclChange struct {
+	name    string
+	current []byte
+	value   []byte // nil removes the attribute
+}
+
+func (c aclChange) describe() string {
+	kind := "access"
+	if c.name == xattrDefaultACL {
+		kind = "default"
+	}
+	return fmt.Sprintf("%s %s -> %s", kind, formatACL(c.current), formatACL(c.value))
+}
+
+// planACLs compares the entry's ACLs with target. want is the mode the entry
+// should have; the returned mode carries the ACL mask in its group bits, which
+// is what stat reports once the ACL is set. Without a mode rule the owning
+// group keeps the permissions recorded in its current ACL.
+func planACLs(path string, dir bool, target Target, want fs.FileMode) (fs.FileMode, []aclChange, error) {
+	var changes []aclChange
+	base := want
+	if target.ACL != nil {
+		current, err := getACL(path, xattrAccessACL)
+		if err != nil {
+			return want, nil, err
+		}
+		group := uint16(base.Perm() >> 3 & 7)
+		if target.Mode == nil {
+			if perm, ok := groupObj(current); ok {
+				group = perm
+			}
+		}
+		var value []byte
+		value, want = target.ACL.encode(base, group)
+		if !bytes.Equal(current, value) {
+			changes = append(changes, aclChange{name: xattrAccessACL, current: current, value: value})
+		}
+	}
+	if dir && target.DefaultACL != nil {
+		current, err := getACL(path, xattrDefaultACL)
+		if err != nil {
+			return want, nil, err
+		}
+		value, _ := target.DefaultACL.encode(base, uint16(base.Perm()>>3&7))
+		if !bytes.Equal(current, value) {
+			changes = append(changes, aclChange{name: xattrDefaultACL, current: current, value: value})
+		}
+	}
+	return want, changes, nil
+}
+
+func (r *Report) record(m Mismatch, limit int) {
+	if limit >= 0 && len(r.Mismatches) >= limit {
+		r.Truncated = true
+		return
+	}
+	r.Mismatches = append(r.Mismatches, m)
+}
+
+// logProgress periodically logs the walk rate and an ETA for the entries
+// listed but not yet checked. The ETA grows while directories are still being
+// listed.
+func (w *walker) logProgress(root string, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		processed := w.processed.Load()
+		discovered := w.discovered.Load()
+		elapsed := time.Since(w.start)
+		rate := float64(processed) / elapsed.Seconds()
+		eta := "unknown"
+		if rate > 0 {
+			eta = time.Duration(float64(discovered-processed) / rate * float64(time.Second)).Round(time.Second).String()
+		}
+		scanning := ""
+		if w.queue.listing() {
+			scanning = " (still scanning)"
+		}
+		log.Printf("permissions: %s: %d/%d entries checked, %.0f files/sec, ETA %s%s",
+			root, processed, discovered, rate, eta, scanning)
+	}
+}
+
+// compileExcludes turns exclude globs into non-recursive rules; the walker
+// skips everything below an excluded directory anyway.
+func compileExcludes(patterns []string) ([]Rule, error) {
+	var out []Rule
+	for _, raw := range patterns {
+		pattern := strings.Trim(filepath.ToSlash(strings.TrimSpace(raw)), "/")
+		if pattern == "" || pattern == "." {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("exclude %s: %w", raw, err)
+		}
+		out = append(out, Rule{pattern: pattern})
+	}
+	return out, nil
+}
+
+// queue is a LIFO work list that tracks unfinished tasks, so workers know
+// the walk is over once it is empty and nothing is in flight.
+type queue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	tasks   []task
+	pending int // queued plus in-flight tasks
+	stopped bool
+}
+
+func (q *queue) push(t task) {
+	q.mu.Lock()
+	q.tasks = append(q.tasks, t)
+	q.pending++
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+func (q *queue) pop() (task, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.tasks) == 0 && q.pending > 0 && !q.stopped {
+		q.cond.Wait()
+	}
+	if q.stopped || len(q.tasks) == 0 {
+		return task{}, false
+	}
+	t := q.tasks[len(q.tasks)-1]
+	q.tasks = q.tasks[:len(q.tasks)-1]
+	return t, true
+}
+
+func (q *queue) done() {
+	q.mu.Lock()
+	q.pending--
+	finished := q.pending == 0
+	q.mu.Unlock()
+	if finished {
+		q.cond.Broadcast()
+	}
+}
+
+func (q *queue) stop() {
+	q.mu.Lock()
+	q.stopped = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// listing reports whether directory listings are still queued.
+func (q *queue) listing() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, t := range q.tasks {
+		if t.dir != "" {
+			return true
+		}
+	}
+	return false
+}
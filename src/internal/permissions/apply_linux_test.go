@@ -0,0 +1,109 @@
+package permissions
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/UDL-TF/TF2Chart/src/internal/config"
+)
+
+func TestApplySkipsCorrectEntries(t *testing.T) {
+	root := t.TempDir()
+	file := filepath.Join(root, "server.cfg")
+	if err := os.WriteFile(file, []byte("x"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Chmod(file, 0o600); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+	rules, err := Compile([]config.PermissionRule{{FileMode: "644"}})
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	report, err := Apply(context.Background(), root, rules, Options{})
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if report.Changed != 1 {
+		t.Fatalf("first run: changed %d entries, want 1", report.Changed)
+	}
+
+	// A chmod would bump the ctime; a second run must not touch anything.
+	before := changeTime(t, file)
+	time.Sleep(10 * time.Millisecond)
+	report, err = Apply(context.Background(), root, rules, Options{})
+	if err != nil {
+		t.Fatalf("apply again: %v", err)
+	}
+	if report.Changed != 0 {
+		t.Errorf("second run: changed %d entries, want 0", report.Changed)
+	}
+	if after := changeTime(t, file); !after.Equal(before) {
+		t.Errorf("ctime changed from %v to %v", before, after)
+	}
+}
+
+func changeTime(t *testing.T, path string) time.Time {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat %s: %v", path, err)
+	}
+	st := info.Sys().(*syscall.Stat_t)
+	return time.Unix(int64(st.Ctim.Sec), int64(st.Ctim.Nsec))
+}
+
+func TestApplySetsPosixACLs(t *testing.T) {
+	root := t.TempDir()
+	if err := syscall.Setxattr(root, xattrDefaultACL, []byte{2, 0, 0, 0}, 0); errors.Is(err, syscall.ENOTSUP) {
+		t.Skip("filesystem does not support POSIX ACLs")
+	}
+	file := filepath.Join(root, "databases.cfg")
+	if err := os.WriteFile(file, []byte("x"), 0o640); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	rules, err := Compile([]config.PermissionRule{{
+		FileMode:   "640",
+		DirMode:    "750",
+		ACL:        []string{"user:1001:rw", "group:2000:r"},
+		DefaultACL: []string{"user:1001:rwx"},
+	}})
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	report, err := Apply(context.Background(), root, rules, Options{})
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if report.ACLMismatches != 2 {
+		t.Errorf("first run: %d acl mismatches, want 2", report.ACLMismatches)
+	}
+
+	value, err := getACL(file, xattrAccessACL)
+	if err != nil {
+		t.Fatalf("get acl: %v", err)
+	}
+	if got := formatACL(value); got != "user::rw-,user:1001:rw-,group::r--,group:2000:r--,mask::rw-,other::---" {
+		t.Errorf("file acl: got %s", got)
+	}
+	value, err = getACL(root, xattrDefaultACL)
+	if err != nil {
+		t.Fatalf("get default acl: %v", err)
+	}
+	if got := formatACL(value); got != "user::rwx,user:1001:rwx,group::r-x,mask::rwx,other::---" {
+		t.Errorf("default acl: got %s", got)
+	}
+
+	report, err = Apply(context.Background(), root, rules, Options{Audit: true})
+	if err != nil {
+		t.Fatalf("audit: %v", err)
+	}
+	if report.Changed != 0 {
+		t.Errorf("second run: %+v, want no changes", report)
+	}
+}
@@ -0,0 +1,208 @@
+package permissions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/UDL-TF/TF2Chart/src/internal/config"
+)
+
+func TestApplyAuditReportsWithoutChanging(t *testing.T) {
+	root := t.TempDir()
+	good := filepath.Join(root, "good.cfg")
+	bad := filepath.Join(root, "bad.cfg")
+	for path, mode := range map[string]os.FileMode{good: 0o644, bad: 0o600} {
+		if err := os.WriteFile(path, []byte("x"), mode); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatalf("chmod %s: %v", path, err)
+		}
+	}
+	if err := os.Chmod(root, 0o755); err != nil {
+		t.Fatalf("chmod root: %v", err)
+	}
+	uid, gid := os.Getuid(), os.Getgid()
+	rules, err := Compile([]config.PermissionRule{{User: &uid, Group: &gid, FileMode: "644", DirMode: "755"}})
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+
+	report, err := Apply(context.Background(), root, rules, Options{Audit: true, MaxMismatches: -1})
+	if err != nil {
+		t.Fatalf("audit: %v", err)
+	}
+	if report.Scanned != 3 || report.Changed != 1 || report.ModeMismatches != 1 || report.OwnerMismatches != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if len(report.Mismatches) != 1 || report.Mismatches[0].Path != bad || report.Mismatches[0].Mode != "0600 -> 0644" {
+		t.Errorf("unexpected mismatches %+v", report.Mismatches)
+	}
+	if info, _ := os.Stat(bad); info.Mode().Perm() != 0o600 {
+		t.Errorf("audit changed %s to %v", bad, info.Mode().Perm())
+	}
+
+	report, err = Apply(context.Background(), root, rules, Options{Audit: true})
+	if err != nil {
+		t.Fatalf("audit without list: %v", err)
+	}
+	if len(report.Mismatches) != 0 || !report.Truncated {
+		t.Errorf("expected truncated empty list, got %+v", report)
+	}
+}
+
+func TestApplyExcludeAndFollowSymlinks(t *testing.T) {
+	root := t.TempDir()
+	shared := t.TempDir()
+	for _, path := range []string{
+		filepath.Join(root, "tf", "cfg", "server.cfg"),
+		filepath.Join(root, "tf", "maps", "koth_foo.bsp"),
+		filepath.Join(shared, "plugins", "admin.smx"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte("x"), 0o600); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+	}
+	if err := os.Symlink(shared, filepath.Join(root, "tf", "addons")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	// A link back to the root must not loop.
+	if err := os.Symlink(root, filepath.Join(shared, "loop")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	rules, err := Compile([]config.PermissionRule{
+		{FileMode: "644"},
+		{Path: "tf/addons/plugins", FileMode: "640"},
+	})
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+
+	if _, err := Apply(context.Background(), root, rules, Options{Exclude: []string{"maps"}}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	assertPerm(t, filepath.Join(root, "tf", "cfg", "server.cfg"), 0o644)
+	assertPerm(t, filepath.Join(root, "tf", "maps", "koth_foo.bsp"), 0o600)
+	assertPerm(t, filepath.Join(shared, "plugins", "admin.smx"), 0o600)
+
+	if _, err := Apply(context.Background(), root, rules, Options{FollowSymlinks: true}); err != nil {
+		t.Fatalf("apply following symlinks: %v", err)
+	}
+	assertPerm(t, filepath.Join(root, "tf", "maps", "koth_foo.bsp"), 0o644)
+	assertPerm(t, filepath.Join(shared, "plugins", "admin.smx"), 0o640)
+}
+
+func assertPerm(t *testing.T, path string, want os.FileMode) {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat %s: %v", path, err)
+	}
+	if got := info.Mode().Perm(); got != want {
+		t.Errorf("%s: got %v, want %v", path, got, want)
+	}
+}
+
+func TestApplyParallelMatchesSequential(t *testing.T) {
+	root := t.TempDir()
+	var files []string
+	for d := 0; d < 5; d++ {
+		dir := filepath.Join(root, fmt.Sprintf("dir%d", d), "nested")
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		for f := 0; f < 150; f++ {
+			path := filepath.Join(dir, fmt.Sprintf("file%03d.cfg", f))
+			if err := os.WriteFile(path, []byte("x"), 0o600); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			files = append(files, path)
+		}
+	}
+	rules, err := Compile([]config.PermissionRule{{FileMode: "u+rw,g+rw", DirMode: "2775"}})
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+
+	report, err := Apply(context.Background(), root, rules, Options{Parallelism: 8, Progress: time.Millisecond})
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	// 750 files, 10 directories and the root.
+	if report.Scanned != 761 || report.Changed != 761 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	for _, path := range files {
+		assertPerm(t, path, 0o660)
+	}
+	info, err := os.Stat(filepath.Join(root, "dir3"))
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if info.Mode()&os.ModeSetgid == 0 || info.Mode().Perm() != 0o775 {
+		t.Errorf("dir3: got %v, want setgid 0775", info.Mode())
+	}
+}
+
+func TestApplyStopsWhenCancelled(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "server.cfg"), []byte("x"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	rules, err := Compile([]config.PermissionRule{{FileMode: "644"}})
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Apply(ctx, root, rules, Options{Parallelism: 4}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	assertPerm(t, filepath.Join(root, "server.cfg"), 0o600)
+}
+
+func TestApplySharesBudget(t *testing.T) {
+	rules, err := Compile([]config.PermissionRule{{FileMode: "644"}})
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	budget := NewBudget(1)
+	roots := make([]string, 3)
+	errs := make(chan error, len(roots))
+	for i := range roots {
+		roots[i] = t.TempDir()
+		for f := 0; f < 100; f++ {
+			if err := os.WriteFile(filepath.Join(roots[i], fmt.Sprintf("file%03d.cfg", f)), []byte("x"), 0o600); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+		}
+		go func(root string) {
+			_, err := Apply(context.Background(), root, rules, Options{Parallelism: 4, Budget: budget})
+			errs <- err
+		}(roots[i])
+	}
+	for range roots {
+		if err := <-errs; err != nil {
+			t.Fatalf("apply: %v", err)
+		}
+	}
+	for _, root := range roots {
+		assertPerm(t, filepath.Join(root, "file042.cfg"), 0o644)
+	}
+
+	// Waiting for a slot still honours cancellation
+	budget <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := Apply(ctx, roots[0], rules, Options{Budget: budget}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package permissions
+
+import (
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+)
+
+// Mode is a parsed chmod expression: either an absolute octal mode such as
+// 2775 or comma separated symbolic clauses such as u+rwX,g+w,o-rwx.
+type Mode struct {
+	absolute fs.FileMode
+	clauses  []modeClause
+}
+
+type modeClause struct {
+	who uint32 // affected bits; clauses without a who letter affect everyone
+	ops []modeOp
+}
+
+type modeOp struct {
+	op    byte // '+', '-' or '='
+	perms string
+	copy  byte // 'u', 'g' or 'o' when the permissions are copied from a class
+}
+
+const (
+	whoUser  = 0o4700
+	whoGroup = 0o2070
+	whoOther = 0o1007
+	whoAll   = 0o7777
+)
+
+// ParseMode parses an octal or symbolic mode. An empty string selects 0755.
+// Symbolic clauses follow chmod(1), including X, which grants execute only to
+// directories and files that are already executable by someone. The umask is
+// not consulted for clauses without a who letter.
+func ParseMode(val string) (Mode, error) {
+	val = strings.TrimSpace(val)
+	if val == "" {
+		return Mode{absolute: 0o755}, nil
+	}
+	if val[0] >= '0' && val[0] <= '7' {
+		parsed, err := strconv.ParseUint(val, 8, 32)
+		if err != nil {
+			return Mode{}, err
+		}
+		if parsed > 0o7777 {
+			return Mode{}, fmt.Errorf("mode %s out of range", val)
+		}
+		return Mode{absolute: fromUnix(uint32(parsed))}, nil
+	}
+	var mode Mode
+	for _, raw := range strings.Split(val, ",") {
+		clause, err := parseClause(raw)
+		if err != nil {
+			return Mode{}, fmt.Errorf("mode %q: %w", val, err)
+		}
+		mode.clauses = append(mode.clauses, clause)
+	}
+	return mode, nil
+}
+
+func parseClause(raw string) (modeClause, error) {
+	var clause modeClause
+	i := 0
+	for ; i < len(raw) && strings.IndexByte("ugoa", raw[i]) >= 0; i++ {
+		switch raw[i] {
+		case 'u':
+			clause.who |= whoUser
+		case 'g':
+			clause.who |= whoGroup
+		case 'o':
+			clause.who |= whoOther
+		case 'a':
+			clause.who |= whoAll
+		}
+	}
+	if clause.who == 0 {
+		clause.who = whoAll
+	}
+	if i == len(raw) {
+		return modeClause{}, fmt.Errorf("clause %q has no operator", raw)
+	}
+	for i < len(raw) {
+		op := modeOp{op: raw[i]}
+		if strings.IndexByte("+-=", op.op) < 0 {
+			return modeClause{}, fmt.Errorf("clause %q: unexpected %q", raw, raw[i])
+		}
+		i++
+		start := i
+		for ; i < len(raw) && strings.IndexByte("rwxXst", raw[i]) >= 0; i++ {
+		}
+		op.perms = raw[start:i]
+		if op.perms == "" && i < len(raw) && strings.IndexByte("ugo", raw[i]) >= 0 {
+			op.copy = raw[i]
+			i++
+		}
+		clause.ops = append(clause.ops, op)
+	}
+	return clause, nil
+}
+
+// Apply returns the result of applying m to current, the existing mode of a
+// file or, when dir is set, a directory.
+func (m Mode) Apply(current fs.FileMode, dir bool) fs.FileMode {
+	if m.clauses == nil {
+		return m.absolute
+	}
+	bits := toUnix(current)
+	for _, clause := range m.clauses {
+		for _, op := range clause.ops {
+			perm := op.bits(bits, dir) & clause.who
+			switch op.op {
+			case '+':
+				bits |= perm
+			case '-':
+				bits &^= perm
+			case '=':
+				clear := clause.who
+				if dir {
+					clear &^= 0o6000 // like chmod, = keeps setuid/setgid on directories
+				}
+				bits = bits&^clear | perm
+			}
+		}
+	}
+	return fromUnix(bits)
+}
+
+// bits expands the operation's permission letters to bits for every class;
+// the clause's who mask narrows them down.
+func (op modeOp) bits(current uint32, dir bool) uint32 {
+	switch op.copy {
+	case 'u':
+		return (current >> 6 & 7) * 0o111
+	case 'g':
+		return (current >> 3 & 7) * 0o111
+	case 'o':
+		return (current & 7) * 0o111
+	}
+	var out uint32
+	for _, c := range op.perms {
+		switch c {
+		case 'r':
+			out |= 0o444
+		case 'w':
+			out |= 0o222
+		case 'x':
+			out |= 0o111
+		case 'X':
+			if dir || current&0o111 != 0 {
+				out |= 0o111
+			}
+		case 's':
+			out |= 0o6000
+		case 't':
+			out |= 0o1000
+		}
+	}
+	return out
+}
+
+// toUnix converts the permission and special bits of mode to their chmod(2) values.
+func toUnix(mode fs.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		bits |= 0o4000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		bits |= 0o2000
+	}
+	if mode&fs.ModeSticky != 0 {
+		bits |= 0o1000
+	}
+	return bits
+}
+
+// fromUnix is the inverse of toUnix; os.Chmod ignores raw 07000 bits.
+func fromUnix(bits uint32) fs.FileMode {
+	mode := fs.FileMode(bits & 0o777)
+	if bits&0o4000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if bits&0o2000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if bits&0o1000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
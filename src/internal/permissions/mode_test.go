@@ -0,0 +1,67 @@
+package permissions
+
+import (
+	"io/fs"
+	"testing"
+)
+
+func TestParseModeOctal(t *testing.T) {
+	for input, want := range map[string]fs.FileMode{
+		"":     0o755,
+		"644":  0o644,
+		"0640": 0o640,
+		"2775": fs.ModeSetgid | 0o775,
+		"4755": fs.ModeSetuid | 0o755,
+		"1777": fs.ModeSticky | 0o777,
+	} {
+		mode, err := ParseMode(input)
+		if err != nil {
+			t.Fatalf("%q: %v", input, err)
+		}
+		if got := mode.Apply(0o600, false); got != want {
+			t.Errorf("%q: got %v, want %v", input, got, want)
+		}
+	}
+}
+
+func TestParseModeSymbolic(t *testing.T) {
+	tests := []struct {
+		expr    string
+		current fs.FileMode
+		dir     bool
+		want    fs.FileMode
+	}{
+		{expr: "u+rwX,g+w,o-rwx", current: 0o644, want: 0o660},
+		{expr: "u+rwX,g+w,o-rwx", current: 0o755, want: 0o770},
+		{expr: "u+rwX,g+w,o-rwx", current: 0o700, dir: true, want: 0o720},
+		{expr: "g+rwX", current: 0o600, dir: true, want: 0o670},
+		{expr: "g+rwX", current: 0o744, want: 0o774},
+		{expr: "a+X", current: 0o644, want: 0o644},
+		{expr: "+x", current: 0o644, want: 0o755},
+		{expr: "go=", current: 0o777, want: 0o700},
+		{expr: "g=u", current: 0o750, want: 0o770},
+		{expr: "o=rx,u-w", current: 0o600, want: 0o405},
+		{expr: "g+s", current: 0o775, dir: true, want: fs.ModeSetgid | 0o775},
+		{expr: "u=rwx,go=rx", current: fs.ModeSetgid | 0o700, dir: true, want: fs.ModeSetgid | 0o755},
+		{expr: "u=rwx,go=rx", current: fs.ModeSetuid | 0o700, want: 0o755},
+		{expr: "+t", current: 0o777, dir: true, want: fs.ModeSticky | 0o777},
+		{expr: "u+w-x", current: 0o555, want: 0o655},
+	}
+	for _, tt := range tests {
+		mode, err := ParseMode(tt.expr)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.expr, err)
+		}
+		if got := mode.Apply(tt.current, tt.dir); got != tt.want {
+			t.Errorf("%q on %v (dir=%v): got %v, want %v", tt.expr, tt.current, tt.dir, got, tt.want)
+		}
+	}
+}
+
+func TestParseModeErrors(t *testing.T) {
+	for _, input := range []string{"u", "u+q", "u+rw,", "17777", "889", "uz+x", "rwx"} {
+		if _, err := ParseMode(input); err == nil {
+			t.Errorf("%q: expected error", input)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package permissions
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// owner returns the uid and gid recorded in info.
+func owner(info fs.FileInfo) (int, int, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return -1, -1, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
@@ -0,0 +1,156 @@
+// Package permissions applies ordered ownership and mode rules to directory trees.
+// It backs both the permissions init container and the merger's permission phase.
+package permissions
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/UDL-TF/TF2Chart/src/internal/config"
+)
+
+// Rule is a compiled config.PermissionRule.
+type Rule struct {
+	pattern   string
+	recursive bool
+	uid       *int
+	gid       *int
+	fileMode  *Mode
+	dirMode   *Mode
+	acl       *ACL
+	defACL    *ACL
+}
+
+// Rules is an ordered rule list. Every matching rule overrides the fields it
+// sets, so the last match wins for each of owner, group and mode.
+type Rules []Rule
+
+// Target is the ownership and mode resolved for a single entry. UID and GID
+// are -1 and Mode is nil when no matching rule sets them.
+type Target struct {
+	UID        int
+	GID        int
+	Mode       *Mode
+	ACL        *ACL // nil leaves the access ACL untouched
+	DefaultACL *ACL // only resolved for directories
+}
+
+// Compile validates rules and parses their modes.
+func Compile(rules []config.PermissionRule) (Rules, error) {
+	out := make(Rules, 0, len(rules))
+	for i, rule := range rules {
+		pattern := strings.Trim(filepath.ToSlash(strings.TrimSpace(rule.Path)), "/")
+		if pattern == "." {
+			pattern = ""
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("permission rule %d (%s): %w", i, rule.Path, err)
+		}
+		compiled := Rule{
+			pattern:   pattern,
+			recursive: rule.Recursive == nil || *rule.Recursive,
+			uid:       rule.User,
+			gid:       rule.Group,
+		}
+		if rule.FileMode != "" {
+			mode, err := ParseMode(rule.FileMode)
+			if err != nil {
+				return nil, fmt.Errorf("permission rule %d (%s) fileMode: %w", i, rule.Path, err)
+			}
+			compiled.fileMode = &mode
+		}
+		if rule.DirMode != "" {
+			mode, err := ParseMode(rule.DirMode)
+			if err != nil {
+				return nil, fmt.Errorf("permission rule %d (%s) dirMode: %w", i, rule.Path, err)
+			}
+			compiled.dirMode = &mode
+		}
+		if rule.ACL != nil {
+			acl, err := ParseACL(rule.ACL)
+			if err != nil {
+				return nil, fmt.Errorf("permission rule %d (%s): %w", i, rule.Path, err)
+			}
+			compiled.acl = acl
+		}
+		if rule.DefaultACL != nil {
+			acl, err := ParseACL(rule.DefaultACL)
+			if err != nil {
+				return nil, fmt.Errorf("permission rule %d (%s) defaultAcl: %w", i, rule.Path, err)
+			}
+			compiled.defACL = acl
+		}
+		out = append(out, compiled)
+	}
+	return out, nil
+}
+
+// Resolve returns the target ownership and mode for rel, a path relative to
+// the walked root ("." for the root itself).
+func (r Rules) Resolve(rel string, dir bool) Target {
+	target := Target{UID: -1, GID: -1}
+	rel = filepath.ToSlash(filepath.Clean(rel))
+	for i := range r {
+		rule := &r[i]
+		if !rule.match(rel) {
+			continue
+		}
+		if rule.uid != nil {
+			target.UID = *rule.uid
+		}
+		if rule.gid != nil {
+			target.GID = *rule.gid
+		}
+		if rule.acl != nil {
+			target.ACL = rule.acl
+		}
+		if dir && rule.defACL != nil {
+			target.DefaultACL = rule.defACL
+		}
+		if dir && rule.dirMode != nil {
+			target.Mode = rule.dirMode
+		} else if !dir && rule.fileMode != nil {
+			target.Mode = rule.fileMode
+		}
+	}
+	return target
+}
+
+// match reports whether the rule covers rel. An empty pattern selects the
+// root; patterns without a slash match a single path component at any depth
+// and patterns with a slash are anchored at the root. Recursive rules also
+// cover everything below a matching directory.
+func (r *Rule) match(rel string) bool {
+	if r.pattern == "" {
+		return rel == "." || r.recursive
+	}
+	if rel == "." {
+		return false
+	}
+	parts := strings.Split(rel, "/")
+	last := len(parts) - 1
+	for i := range parts {
+		if !r.recursive && i != last {
+			continue
+		}
+		candidate := parts[i]
+		if strings.Contains(r.pattern, "/") {
+			candidate = strings.Join(parts[:i+1], "/")
+		}
+		if ok, _ := path.Match(r.pattern, candidate); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// IgnoreError reports whether err is an expected failure on read-only or
+// foreign-owned mounts, or a file that vanished during the walk.
+func IgnoreError(err error) bool {
+	return errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EROFS) || errors.Is(err, os.ErrPermission) || errors.Is(err, os.ErrNotExist)
+}
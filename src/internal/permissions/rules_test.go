@@ -0,0 +1,114 @@
+package permissions
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/UDL-TF/TF2Chart/src/internal/config"
+)
+
+func intPtr(v int) *int { return &v }
+
+func TestResolveLastMatchWins(t *testing.T) {
+	noRecurse := false
+	rules, err := Compile([]config.PermissionRule{
+		{User: intPtr(1000), Group: intPtr(1000), FileMode: "664", DirMode: "775"},
+		{Path: "*.sh", FileMode: "775"},
+		{Path: "tf/addons/sourcemod/data", User: intPtr(1001)},
+		{Path: "tf/cfg", DirMode: "750", Recursive: &noRecurse},
+	})
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+
+	tests := []struct {
+		rel      string
+		dir      bool
+		uid, gid int
+		mode     fs.FileMode
+	}{
+		{rel: ".", dir: true, uid: 1000, gid: 1000, mode: 0o775},
+		{rel: "tf/maps/koth_foo.bsp", uid: 1000, gid: 1000, mode: 0o664},
+		{rel: "srcds_run.sh", uid: 1000, gid: 1000, mode: 0o775},
+		{rel: "tf/addons/sourcemod/data", dir: true, uid: 1001, gid: 1000, mode: 0o775},
+		{rel: "tf/addons/sourcemod/data/sqlite/clientprefs.sq3", uid: 1001, gid: 1000, mode: 0o664},
+		{rel: "tf/cfg", dir: true, uid: 1000, gid: 1000, mode: 0o750},
+		{rel: "tf/cfg/motd", dir: true, uid: 1000, gid: 1000, mode: 0o775},
+	}
+	for _, tt := range tests {
+		got := rules.Resolve(tt.rel, tt.dir)
+		if got.UID != tt.uid || got.GID != tt.gid || got.Mode == nil || got.Mode.Apply(0, tt.dir) != tt.mode {
+			mode := "unset"
+			if got.Mode != nil {
+				mode = got.Mode.Apply(0, tt.dir).String()
+			}
+			t.Errorf("%s: got uid=%d gid=%d mode=%s, want uid=%d gid=%d mode=%s",
+				tt.rel, got.UID, got.GID, mode, tt.uid, tt.gid, tt.mode)
+		}
+	}
+}
+
+func TestResolveLeavesUnsetFields(t *testing.T) {
+	rules, err := Compile([]config.PermissionRule{{Path: "maps", FileMode: "644"}})
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	got := rules.Resolve("cfg/server.cfg", false)
+	if got.UID != -1 || got.GID != -1 || got.Mode != nil {
+		t.Errorf("unmatched entry: got %+v, want no changes", got)
+	}
+}
+
+func TestCompileRejectsBadRules(t *testing.T) {
+	for name, rule := range map[string]config.PermissionRule{
+		"bad glob":     {Path: "maps/["},
+		"bad fileMode": {FileMode: "rwx"},
+		"bad dirMode":  {DirMode: "999"},
+	} {
+		if _, err := Compile([]config.PermissionRule{rule}); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestApplySetsFileAndDirModes(t *testing.T) {
+	root := t.TempDir()
+	script := filepath.Join(root, "srcds_run")
+	cfg := filepath.Join(root, "tf", "cfg", "server.cfg")
+	if err := os.MkdirAll(filepath.Dir(cfg), 0o700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	for _, path := range []string{script, cfg} {
+		if err := os.WriteFile(path, []byte("x"), 0o600); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+	}
+	rules, err := Compile([]config.PermissionRule{
+		{FileMode: "644", DirMode: "755"},
+		{Path: "srcds_run", FileMode: "755"},
+	})
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	if _, err := Apply(context.Background(), root, rules, Options{}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+
+	for path, want := range map[string]fs.FileMode{
+		root:              0o755,
+		filepath.Dir(cfg): 0o755,
+		cfg:               0o644,
+		script:            0o755,
+	} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("stat %s: %v", path, err)
+		}
+		if got := info.Mode().Perm(); got != want {
+			t.Errorf("%s: got %v, want %v", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Package testutil holds helpers shared by the tests of the codec packages.
+package testutil
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Sample returns map-list style text lines followed by incompressible noise.
+// The output only depends on its arguments, so it regenerates the content of
+// the codecs' testdata fixtures.
+func Sample(lines int, noise int) []byte {
+	rng := rand.New(rand.NewSource(int64(lines)))
+	words := []string{"koth", "ctf", "pl", "cp", "harvest", "badwater", "upward", "granary", "viaduct", "lumberyard"}
+	var out []byte
+	for i := 0; i < lines; i++ {
+		out = append(out, fmt.Sprintf("%s_%s_b%d %d\n", words[rng.Intn(len(words))], words[rng.Intn(len(words))], rng.Intn(9), rng.Intn(100000))...)
+	}
+	noiseBytes := make([]byte, noise)
+	rng.Read(noiseBytes)
+	return append(out, noiseBytes...)
+}
+
+// NewReaderFunc opens a decompressing reader over r.
+type NewReaderFunc func(r io.Reader) (io.Reader, error)
+
+// Fixture reads a file from the package's testdata directory.
+func Fixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	return data
+}
+
+// Decode decompresses all of data with newReader.
+func Decode(newReader NewReaderFunc, data []byte) ([]byte, error) {
+	r, err := newReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// CheckFixtures decodes every fixture in want and compares it with the
+// content it was made from.
+func CheckFixtures(t *testing.T, newReader NewReaderFunc, want map[string][]byte) {
+	t.Helper()
+	for name, content := range want {
+		got, err := Decode(newReader, Fixture(t, name))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("%s: decoded %d bytes that differ from the %d expected", name, len(got), len(content))
+		}
+	}
+}
+
+// CheckCorruption flips single bytes of fixture, its middle one and those at
+// offsets (negative ones count from the end), and truncates it, expecting
+// newReader to fail each time. foreign, the start of a stream in another
+// format, must be rejected with errFormat.
+func CheckCorruption(t *testing.T, newReader NewReaderFunc, fixture string, offsets []int, foreign []byte, errFormat error) {
+	t.Helper()
+	data := Fixture(t, fixture)
+	for _, offset := range append([]int{len(data) / 2}, offsets...) {
+		if offset < 0 {
+			offset += len(data)
+		}
+		corrupt := append([]byte{}, data...)
+		corrupt[offset] ^= 0x55
+		if _, err := Decode(newReader, corrupt); err == nil {
+			t.Errorf("flipping byte %d: expected an error", offset)
+		}
+	}
+	if _, err := Decode(newReader, data[:len(data)-8]); err == nil {
+		t.Errorf("truncated stream: expected an error")
+	}
+	if _, err := newReader(bytes.NewReader(foreign)); !errors.Is(err, errFormat) {
+		t.Errorf("foreign input %q: got %v, want %v", foreign, err, errFormat)
+	}
+}
+
+// maxFuzzOutput bounds how much FuzzReader decodes per input, so inputs that
+// legitimately expand to gigabytes do not stall the fuzzer.
+const maxFuzzOutput = 4 << 20
+
+// FuzzReader seeds f with the package's testdata fixtures and checks that
+// newReader fails cleanly instead of panicking or hanging on any input.
+func FuzzReader(f *testing.F, newReader NewReaderFunc) {
+	entries, err := os.ReadDir("testdata")
+	if err != nil {
+		f.Fatalf("read testdata: %v", err)
+	}
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) == ".md" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join("testdata", e.Name()))
+		if err != nil {
+			f.Fatalf("read fixture: %v", err)
+		}
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r, err := newReader(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		io.CopyN(io.Discard, r, maxFuzzOutput)
+	})
+}
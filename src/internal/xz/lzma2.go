@@ -0,0 +1,574 @@
+package xz
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// LZMA constants from the LZMA SDK, named after their SDK counterparts.
+const (
+	numStates          = 12
+	numPosStatesMax    = 1 << 4
+	numLenToPosStates  = 4
+	numAlignBits       = 4
+	startPosModelIndex = 4
+	endPosModelIndex   = 14
+	numFullDistances   = 1 << (endPosModelIndex >> 1)
+	matchMinLen        = 2
+	probInit           = 1 << 10
+	literalCoderSize   = 0x300
+)
+
+var errCorrupt = errors.New("xz: corrupt LZMA2 data")
+
+// lzma2Reader decodes a raw LZMA2 stream, one chunk at a time.
+type lzma2Reader struct {
+	r    io.ByteReader
+	src  io.Reader
+	dict window
+	lz   *lzmaState
+
+	needDictReset bool
+	needProps     bool
+	done          bool
+
+	out  []byte // decoded bytes of the current chunk not yet returned
+	buf  []byte // decoded chunk storage, reused between chunks
+	comp []byte // compressed chunk storage, reused between chunks
+}
+
+// newLZMA2Reader returns a reader for an LZMA2 stream with the given
+// dictionary size, as declared by the xz filter properties.
+func newLZMA2Reader(src io.Reader, dictSize uint32) *lzma2Reader {
+	return &lzma2Reader{
+		r:             byteReader(src),
+		src:           src,
+		dict:          window{size: int(dictSize)},
+		needDictReset: true,
+		needProps:     true,
+	}
+}
+
+func (z *lzma2Reader) Read(p []byte) (int, error) {
+	for len(z.out) == 0 {
+		if z.done {
+			return 0, io.EOF
+		}
+		if err := z.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, z.out)
+	z.out = z.out[n:]
+	return n, nil
+}
+
+// nextChunk decodes the next chunk into z.out.
+func (z *lzma2Reader) nextChunk() error {
+	control, err := z.r.ReadByte()
+	if err != nil {
+		return unexpected(err)
+	}
+	switch {
+	case control == 0x00:
+		z.done = true
+		return nil
+	case control == 0x01 || control == 0x02:
+		if control == 0x01 {
+			// A dictionary reset also requires new properties before
+			// the next LZMA chunk.
+			z.dict.reset()
+			z.needDictReset = false
+			z.needProps = true
+		} else if z.needDictReset {
+			return errCorrupt
+		}
+		size, err := z.readUint16()
+		if err != nil {
+			return err
+		}
+		return z.storedChunk(int(size) + 1)
+	case control >= 0x80:
+		reset := (control >> 5) & 3
+		if reset == 3 {
+			z.dict.reset()
+			z.needDictReset = false
+		} else if z.needDictReset {
+			return errCorrupt
+		}
+		hi := int(control&0x1f) << 16
+		lo, err := z.readUint16()
+		if err != nil {
+			return err
+		}
+		unpacked := hi + int(lo) + 1
+		packed, err := z.readUint16()
+		if err != nil {
+			return err
+		}
+		if reset >= 2 {
+			props, err := z.r.ReadByte()
+			if err != nil {
+				return unexpected(err)
+			}
+			lc, lp, pb, err := decodeProps(props)
+			if err != nil {
+				return err
+			}
+			z.lz = newLZMAState(lc, lp, pb)
+			z.needProps = false
+		} else if z.needProps {
+			return errCorrupt
+		} else if reset == 1 {
+			z.lz.reset()
+		}
+		return z.lzmaChunk(unpacked, int(packed)+1)
+	default:
+		return fmt.Errorf("xz: invalid LZMA2 control byte %#x", control)
+	}
+}
+
+func (z *lzma2Reader) readUint16() (uint16, error) {
+	hi, err := z.r.ReadByte()
+	if err != nil {
+		return 0, unexpected(err)
+	}
+	lo, err := z.r.ReadByte()
+	if err != nil {
+		return 0, unexpected(err)
+	}
+	return uint16(hi)<<8 | uint16(lo), nil
+}
+
+func (z *lzma2Reader) storedChunk(size int) error {
+	z.buf = grow(z.buf, size)
+	if _, err := io.ReadFull(z.src, z.buf); err != nil {
+		return unexpected(err)
+	}
+	for _, b := range z.buf {
+		z.dict.put(b)
+	}
+	z.out = z.buf
+	return nil
+}
+
+func (z *lzma2Reader) lzmaChunk(unpacked, packed int) error {
+	z.comp = grow(z.comp, packed)
+	if _, err := io.ReadFull(z.src, z.comp); err != nil {
+		return unexpected(err)
+	}
+	z.buf = grow(z.buf, unpacked)
+	rc, err := newRangeDecoder(z.comp)
+	if err != nil {
+		return err
+	}
+	if err := z.lz.decode(rc, &z.dict, z.buf); err != nil {
+		return err
+	}
+	if !rc.finished() {
+		return errCorrupt
+	}
+	z.out = z.buf
+	return nil
+}
+
+func decodeProps(props byte) (lc, lp, pb int, err error) {
+	if props >= 9*5*5 {
+		return 0, 0, 0, errCorrupt
+	}
+	d := int(props)
+	lc, d = d%9, d/9
+	lp, pb = d%5, d/5
+	if lc+lp > 4 {
+		return 0, 0, 0, errCorrupt
+	}
+	return lc, lp, pb, nil
+}
+
+// window is the LZMA dictionary. It grows up to size and then wraps, so small
+// inputs never allocate the full declared dictionary.
+type window struct {
+	buf  []byte
+	size int
+	pos  int  // next write index
+	full bool // the buffer has wrapped
+	// total counts bytes since the last dictionary reset; its low bits
+	// select the literal and position states.
+	total uint64
+}
+
+func (w *window) reset() {
+	w.buf = w.buf[:0]
+	w.pos = 0
+	w.full = false
+	w.total = 0
+}
+
+func (w *window) put(b byte) {
+	if w.pos == len(w.buf) {
+		if len(w.buf) < w.size {
+			w.buf = append(w.buf, b)
+			w.pos++
+			w.total++
+			return
+		}
+		w.pos = 0
+		w.full = true
+	}
+	w.buf[w.pos] = b
+	w.pos++
+	w.total++
+}
+
+// filled is how far back a match may reach.
+func (w *window) filled() int {
+	if w.full {
+		return len(w.buf)
+	}
+	return w.pos
+}
+
+// get returns the byte dist positions back, 1 being the last byte written.
+func (w *window) get(dist int) byte {
+	i := w.pos - dist
+	if i < 0 {
+		i += len(w.buf)
+	}
+	return w.buf[i]
+}
+
+// rangeDecoder reads the arithmetic-coded bits of one LZMA2 chunk.
+type rangeDecoder struct {
+	data []byte
+	pos  int
+	rng  uint32
+	code uint32
+}
+
+func newRangeDecoder(data []byte) (*rangeDecoder, error) {
+	if len(data) < 5 || data[0] != 0 {
+		return nil, errCorrupt
+	}
+	rc := &rangeDecoder{data: data, pos: 5, rng: 0xffffffff}
+	for _, b := range data[1:5] {
+		rc.code = rc.code<<8 | uint32(b)
+	}
+	if rc.code == rc.rng {
+		return nil, errCorrupt
+	}
+	return rc, nil
+}
+
+func (rc *rangeDecoder) normalize() {
+	if rc.rng < 1<<24 {
+		rc.shift()
+	}
+}
+
+// shift reads the next input byte. Reading past the chunk yields zeros and
+// is caught by finished.
+func (rc *rangeDecoder) shift() {
+	rc.rng <<= 8
+	var b byte
+	if rc.pos < len(rc.data) {
+		b = rc.data[rc.pos]
+	}
+	rc.pos++
+	rc.code = rc.code<<8 | uint32(b)
+}
+
+// finished reports whether the chunk was consumed exactly.
+func (rc *rangeDecoder) finished() bool {
+	rc.normalize()
+	return rc.pos == len(rc.data) && rc.code == 0
+}
+
+// bit decodes one bit with the adaptive probability *prob. It is written
+// without data-dependent branches, which mispredict constantly on poorly
+// compressible input.
+func (rc *rangeDecoder) bit(prob *uint16) uint32 {
+	if rc.rng < 1<<24 {
+		rc.shift()
+	}
+	p := uint32(*prob)
+	bound := (rc.rng >> 11) * p
+	var b uint32
+	if rc.code >= bound {
+		b = 1
+	}
+	mask := -b
+	rc.rng = bound&^mask | (rc.rng-bound)&mask
+	rc.code -= bound & mask
+	*prob = uint16(((p + (1<<11-p)>>5) &^ mask) | ((p - p>>5) & mask))
+	return b
+}
+
+func (rc *rangeDecoder) bitTree(probs []uint16, bits int) uint32 {
+	m := uint32(1)
+	for i := 0; i < bits; i++ {
+		m = m<<1 | rc.bit(&probs[m])
+	}
+	return m - 1<<bits
+}
+
+func (rc *rangeDecoder) reverseBitTree(probs []uint16, bits int) uint32 {
+	m := uint32(1)
+	var sym uint32
+	for i := 0; i < bits; i++ {
+		b := rc.bit(&probs[m])
+		m = m<<1 | b
+		sym |= b << i
+	}
+	return sym
+}
+
+func (rc *rangeDecoder) direct(bits int) uint32 {
+	var v uint32
+	for i := 0; i < bits; i++ {
+		rc.normalize()
+		rc.rng >>= 1
+		b := uint32(0)
+		if rc.code >= rc.rng {
+			rc.code -= rc.rng
+			b = 1
+		}
+		v = v<<1 | b
+	}
+	return v
+}
+
+type lenDecoder struct {
+	choice  uint16
+	choice2 uint16
+	low     [numPosStatesMax][1 << 3]uint16
+	mid     [numPosStatesMax][1 << 3]uint16
+	high    [1 << 8]uint16
+}
+
+func (l *lenDecoder) reset() {
+	l.choice, l.choice2 = probInit, probInit
+	for i := range l.low {
+		fill(l.low[i][:])
+		fill(l.mid[i][:])
+	}
+	fill(l.high[:])
+}
+
+func (l *lenDecoder) decode(rc *rangeDecoder, posState uint32) uint32 {
+	if rc.bit(&l.choice) == 0 {
+		return rc.bitTree(l.low[posState][:], 3)
+	}
+	if rc.bit(&l.choice2) == 0 {
+		return 8 + rc.bitTree(l.mid[posState][:], 3)
+	}
+	return 16 + rc.bitTree(l.high[:], 8)
+}
+
+// lzmaState holds the probability model and match history, which LZMA2
+// chunks carry over unless they request a state reset.
+type lzmaState struct {
+	lc, lp, pb int
+
+	state                  uint32
+	rep0, rep1, rep2, rep3 uint32
+
+	isMatch    [numStates][numPosStatesMax]uint16
+	isRep      [numStates]uint16
+	isRepG0    [numStates]uint16
+	isRepG1    [numStates]uint16
+	isRepG2    [numStates]uint16
+	isRep0Long [numStates][numPosStatesMax]uint16
+	posSlot    [numLenToPosStates][1 << 6]uint16
+	posSpecial [numFullDistances - endPosModelIndex]uint16
+	align      [1 << numAlignBits]uint16
+	matchLen   lenDecoder
+	repLen     lenDecoder
+	literal    []uint16
+}
+
+func newLZMAState(lc, lp, pb int) *lzmaState {
+	s := &lzmaState{lc: lc, lp: lp, pb: pb, literal: make([]uint16, literalCoderSize<<(lc+lp))}
+	s.reset()
+	return s
+}
+
+func (s *lzmaState) reset() {
+	s.state = 0
+	s.rep0, s.rep1, s.rep2, s.rep3 = 0, 0, 0, 0
+	for i := range s.isMatch {
+		fill(s.isMatch[i][:])
+		fill(s.isRep0Long[i][:])
+	}
+	fill(s.isRep[:])
+	fill(s.isRepG0[:])
+	fill(s.isRepG1[:])
+	fill(s.isRepG2[:])
+	for i := range s.posSlot {
+		fill(s.posSlot[i][:])
+	}
+	fill(s.posSpecial[:])
+	fill(s.align[:])
+	s.matchLen.reset()
+	s.repLen.reset()
+	fill(s.literal)
+}
+
+// decode fills out with decoded bytes, appending each to the dictionary.
+func (s *lzmaState) decode(rc *rangeDecoder, dict *window, out []byte) error {
+	pbMask := uint32(1)<<s.pb - 1
+	lpMask := uint32(1)<<s.lp - 1
+	n := 0
+	for n < len(out) {
+		posState := uint32(dict.total) & pbMask
+		if rc.bit(&s.isMatch[s.state][posState]) == 0 {
+			var prev uint32
+			if dict.filled() > 0 {
+				prev = uint32(dict.get(1))
+			}
+			litState := (uint32(dict.total)&lpMask)<<s.lc + prev>>(8-s.lc)
+			probs := s.literal[literalCoderSize*litState:]
+			sym := uint32(1)
+			if s.state >= 7 {
+				if int(s.rep0) >= dict.filled() {
+					return errCorrupt
+				}
+				match := uint32(dict.get(int(s.rep0) + 1))
+				for sym < 0x100 {
+					matchBit := (match >> 7) & 1
+					match <<= 1
+					b := rc.bit(&probs[0x100+matchBit<<8+sym])
+					sym = sym<<1 | b
+					if matchBit != b {
+						break
+					}
+				}
+			}
+			for sym < 0x100 {
+				sym = sym<<1 | rc.bit(&probs[sym])
+			}
+			b := byte(sym)
+			dict.put(b)
+			out[n] = b
+			n++
+			switch {
+			case s.state < 4:
+				s.state = 0
+			case s.state < 10:
+				s.state -= 3
+			default:
+				s.state -= 6
+			}
+			continue
+		}
+
+		var length uint32
+		if rc.bit(&s.isRep[s.state]) == 0 {
+			s.rep3, s.rep2, s.rep1 = s.rep2, s.rep1, s.rep0
+			length = s.matchLen.decode(rc, posState)
+			if s.state < 7 {
+				s.state = 7
+			} else {
+				s.state = 10
+			}
+			s.rep0 = s.distance(rc, length)
+			if s.rep0 == 0xffffffff {
+				// End markers are not allowed in LZMA2 chunks.
+				return errCorrupt
+			}
+		} else {
+			if rc.bit(&s.isRepG0[s.state]) == 0 {
+				if rc.bit(&s.isRep0Long[s.state][posState]) == 0 {
+					if s.state < 7 {
+						s.state = 9
+					} else {
+						s.state = 11
+					}
+					if int(s.rep0) >= dict.filled() {
+						return errCorrupt
+					}
+					b := dict.get(int(s.rep0) + 1)
+					dict.put(b)
+					out[n] = b
+					n++
+					continue
+				}
+			} else {
+				var dist uint32
+				if rc.bit(&s.isRepG1[s.state]) == 0 {
+					dist = s.rep1
+				} else {
+					if rc.bit(&s.isRepG2[s.state]) == 0 {
+						dist = s.rep2
+					} else {
+						dist = s.rep3
+						s.rep3 = s.rep2
+					}
+					s.rep2 = s.rep1
+				}
+				s.rep1 = s.rep0
+				s.rep0 = dist
+			}
+			length = s.repLen.decode(rc, posState)
+			if s.state < 7 {
+				s.state = 8
+			} else {
+				s.state = 11
+			}
+		}
+
+		dist := int(s.rep0) + 1
+		if dist > dict.filled() {
+			return errCorrupt
+		}
+		count := int(length) + matchMinLen
+		if count > len(out)-n {
+			return errCorrupt
+		}
+		for i := 0; i < count; i++ {
+			b := dict.get(dist)
+			dict.put(b)
+			out[n] = b
+			n++
+		}
+	}
+	return nil
+}
+
+// distance decodes the distance of a new match of the given length.
+func (s *lzmaState) distance(rc *rangeDecoder, length uint32) uint32 {
+	lenState := min(length, numLenToPosStates-1)
+	slot := rc.bitTree(s.posSlot[lenState][:], 6)
+	if slot < startPosModelIndex {
+		return slot
+	}
+	bits := int(slot>>1) - 1
+	dist := (2 | slot&1) << bits
+	if slot < endPosModelIndex {
+		// The SDK indexes posSpecial from dist-slot-1 with tree indices
+		// starting at 1; slicing one further keeps the base non-negative.
+		probs := s.posSpecial[dist-slot:]
+		m := uint32(1)
+		for i := 0; i < bits; i++ {
+			b := rc.bit(&probs[m-1])
+			m = m<<1 | b
+			dist |= b << i
+		}
+		return dist
+	}
+	dist += rc.direct(bits-numAlignBits) << numAlignBits
+	return dist + rc.reverseBitTree(s.align[:], numAlignBits)
+}
+
+func fill(probs []uint16) {
+	for i := range probs {
+		probs[i] = probInit
+	}
+}
+
+func grow(b []byte, n int) []byte {
+	if cap(b) < n {
+		return make([]byte, n)
+	}
+	return b[:n]
+}
@@ -0,0 +1,431 @@
+// Package xz decodes .xz files: the xz container format with LZMA2
+// compressed blocks, as produced by xz-utils with its default filter chain.
+// BCJ and delta filters are not supported.
+package xz
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+)
+
+var (
+	headerMagic = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	footerMagic = []byte{'Y', 'Z'}
+
+	crc64Table = crc64.MakeTable(crc64.ECMA)
+)
+
+const (
+	checkNone   = 0x00
+	checkCRC32  = 0x01
+	checkCRC64  = 0x04
+	checkSHA256 = 0x0a
+
+	filterLZMA2 = 0x21
+)
+
+// ErrFormat is returned for input that is not an xz stream.
+var ErrFormat = errors.New("xz: not an xz stream")
+
+// Reader decompresses an xz file. Concatenated streams, as written by
+// `xz` when appending, are decoded one after another.
+type Reader struct {
+	r *bufio.Reader
+
+	check   byte
+	hash    hash.Hash // integrity check of the current block, nil for checkNone
+	block   io.Reader // current block's uncompressed data
+	records []indexRecord
+	counter *countingReader
+
+	blockHeaderSize int64
+	blockPacked     int64 // declared compressed size, or -1
+	blockUnpacked   int64
+
+	err error
+}
+
+type indexRecord struct {
+	unpadded   int64
+	uncompress int64
+}
+
+// NewReader returns a reader decompressing the xz data read from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	z := &Reader{r: bufio.NewReaderSize(r, 64<<10)}
+	if err := z.streamHeader(); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+func (z *Reader) Read(p []byte) (int, error) {
+	for z.err == nil {
+		if z.block == nil {
+			z.err = z.nextBlock()
+			continue
+		}
+		n, err := z.block.Read(p)
+		if n > 0 {
+			z.blockUnpacked += int64(n)
+			if z.hash != nil {
+				z.hash.Write(p[:n])
+			}
+			return n, nil
+		}
+		if err == io.EOF {
+			z.err = z.finishBlock()
+			continue
+		}
+		if err != nil {
+			z.err = err
+		}
+	}
+	return 0, z.err
+}
+
+func (z *Reader) streamHeader() error {
+	var header [12]byte
+	if _, err := io.ReadFull(z.r, header[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrFormat
+		}
+		return err
+	}
+	if !bytes.Equal(header[:6], headerMagic) {
+		return ErrFormat
+	}
+	if crc32.ChecksumIEEE(header[6:8]) != binary.LittleEndian.Uint32(header[8:]) {
+		return errors.New("xz: stream header checksum mismatch")
+	}
+	if header[6] != 0 || header[7]&0xf0 != 0 {
+		return errors.New("xz: unsupported stream flags")
+	}
+	z.check = header[7]
+	z.records = z.records[:0]
+	return nil
+}
+
+// nextBlock starts the next block, or reads the index and footer and moves
+// on to a following stream.
+func (z *Reader) nextBlock() error {
+	size, err := z.r.ReadByte()
+	if err != nil {
+		return unexpected(err)
+	}
+	if size == 0 {
+		if err := z.index(); err != nil {
+			return err
+		}
+		return z.nextStream()
+	}
+	headerSize := (int(size) + 1) * 4
+	header := make([]byte, headerSize)
+	header[0] = size
+	if _, err := io.ReadFull(z.r, header[1:]); err != nil {
+		return unexpected(err)
+	}
+	if crc32.ChecksumIEEE(header[:headerSize-4]) != binary.LittleEndian.Uint32(header[headerSize-4:]) {
+		return errors.New("xz: block header checksum mismatch")
+	}
+	dictSize, compressed, err := parseBlockHeader(header[1 : headerSize-4])
+	if err != nil {
+		return err
+	}
+	z.counter = &countingReader{r: z.r}
+	var src io.Reader = z.counter
+	if compressed >= 0 {
+		src = io.LimitReader(z.counter, compressed)
+	}
+	z.block = newLZMA2Reader(src, dictSize)
+	z.blockHeaderSize = int64(headerSize)
+	z.blockPacked = compressed
+	z.blockUnpacked = 0
+	z.hash = newCheck(z.check)
+	return nil
+}
+
+// parseBlockHeader returns the LZMA2 dictionary size and the compressed
+// size, or -1 when the header does not declare it.
+func parseBlockHeader(h []byte) (uint32, int64, error) {
+	r := bytes.NewReader(h)
+	flags, _ := r.ReadByte()
+	if flags&0x3c != 0 {
+		return 0, 0, errors.New("xz: unsupported block flags")
+	}
+	compressed := int64(-1)
+	if flags&0x40 != 0 {
+		v, err := readVLI(r)
+		if err != nil || v == 0 {
+			return 0, 0, errors.New("xz: invalid compressed size in block header")
+		}
+		compressed = int64(v)
+	}
+	if flags&0x80 != 0 {
+		if _, err := readVLI(r); err != nil {
+			return 0, 0, errors.New("xz: invalid uncompressed size in block header")
+		}
+	}
+	if filters := int(flags&0x03) + 1; filters != 1 {
+		return 0, 0, errors.New("xz: only LZMA2 without BCJ or delta filters is supported")
+	}
+	id, err := readVLI(r)
+	if err != nil {
+		return 0, 0, unexpected(err)
+	}
+	if id != filterLZMA2 {
+		return 0, 0, fmt.Errorf("xz: unsupported filter %#x", id)
+	}
+	propsSize, err := readVLI(r)
+	if err != nil || propsSize != 1 {
+		return 0, 0, errors.New("xz: invalid LZMA2 properties")
+	}
+	props, err := r.ReadByte()
+	if err != nil || props > 40 {
+		return 0, 0, errors.New("xz: invalid LZMA2 dictionary size")
+	}
+	for r.Len() > 0 {
+		if b, _ := r.ReadByte(); b != 0 {
+			return 0, 0, errors.New("xz: non-zero block header padding")
+		}
+	}
+	dictSize := uint32(0xffffffff)
+	if props < 40 {
+		dictSize = (2 | uint32(props)&1) << (props/2 + 11)
+	}
+	return dictSize, compressed, nil
+}
+
+// finishBlock reads the padding and check after a block's LZMA2 data.
+func (z *Reader) finishBlock() error {
+	compressed := z.counter.n
+	if z.blockPacked >= 0 && compressed != z.blockPacked {
+		return errors.New("xz: block size does not match its header")
+	}
+	for pad := (4 - compressed%4) % 4; pad > 0; pad-- {
+		b, err := z.r.ReadByte()
+		if err != nil {
+			return unexpected(err)
+		}
+		if b != 0 {
+			return errors.New("xz: non-zero block padding")
+		}
+	}
+	checkSize := checkLen(z.check)
+	if checkSize > 0 {
+		want := make([]byte, checkSize)
+		if _, err := io.ReadFull(z.r, want); err != nil {
+			return unexpected(err)
+		}
+		if z.hash != nil {
+			got := z.hash.Sum(nil)
+			if z.check != checkSHA256 {
+				// CRCs are stored little endian.
+				reverse(got)
+			}
+			if !bytes.Equal(got, want) {
+				return errors.New("xz: block check mismatch")
+			}
+		}
+	}
+	z.records = append(z.records, indexRecord{
+		unpadded:   z.blockHeaderSize + compressed + int64(checkSize),
+		uncompress: z.blockUnpacked,
+	})
+	z.block = nil
+	return nil
+}
+
+// index verifies the stream index against the blocks just decoded, and
+// the stream footer that follows it.
+func (z *Reader) index() error {
+	crc := crc32.NewIEEE()
+	crc.Write([]byte{0})
+	r := &countingReader{r: io.TeeReader(z.r, crc)}
+	br := byteReader(r)
+	count, err := readVLI(br)
+	if err != nil {
+		return unexpected(err)
+	}
+	if count != uint64(len(z.records)) {
+		return errors.New("xz: index does not match the number of blocks")
+	}
+	for _, rec := range z.records {
+		unpadded, err := readVLI(br)
+		if err != nil {
+			return unexpected(err)
+		}
+		uncompressed, err := readVLI(br)
+		if err != nil {
+			return unexpected(err)
+		}
+		if int64(unpadded) != rec.unpadded || int64(uncompressed) != rec.uncompress {
+			return errors.New("xz: index does not match block sizes")
+		}
+	}
+	size := 1 + r.n
+	for pad := (4 - size%4) % 4; pad > 0; pad-- {
+		b, err := br.ReadByte()
+		if err != nil {
+			return unexpected(err)
+		}
+		if b != 0 {
+			return errors.New("xz: non-zero index padding")
+		}
+	}
+	indexSize := 1 + r.n
+	var sum [4]byte
+	if _, err := io.ReadFull(z.r, sum[:]); err != nil {
+		return unexpected(err)
+	}
+	if crc.Sum32() != binary.LittleEndian.Uint32(sum[:]) {
+		return errors.New("xz: index checksum mismatch")
+	}
+	indexSize += 4
+
+	var footer [12]byte
+	if _, err := io.ReadFull(z.r, footer[:]); err != nil {
+		return unexpected(err)
+	}
+	if !bytes.Equal(footer[10:], footerMagic) {
+		return errors.New("xz: bad stream footer magic")
+	}
+	if crc32.ChecksumIEEE(footer[4:10]) != binary.LittleEndian.Uint32(footer[:4]) {
+		return errors.New("xz: stream footer checksum mismatch")
+	}
+	if backward := (int64(binary.LittleEndian.Uint32(footer[4:8])) + 1) * 4; backward != indexSize {
+		return errors.New("xz: stream footer does not match index size")
+	}
+	if footer[8] != 0 || footer[9] != z.check {
+		return errors.New("xz: stream footer flags do not match header")
+	}
+	return nil
+}
+
+// nextStream skips stream padding and starts the next concatenated stream,
+// returning io.EOF at the end of the input.
+func (z *Reader) nextStream() error {
+	for {
+		var pad [4]byte
+		n, err := io.ReadFull(z.r, pad[:])
+		if n == 0 && err == io.EOF {
+			return io.EOF
+		}
+		if err != nil {
+			return errors.New("xz: trailing garbage after stream")
+		}
+		if pad != [4]byte{} {
+			// Start of another stream: put the bytes back in front.
+			z.r = bufio.NewReaderSize(io.MultiReader(bytes.NewReader(pad[:]), z.r), 64<<10)
+			if err := z.streamHeader(); err != nil {
+				if err == ErrFormat {
+					return errors.New("xz: trailing garbage after stream")
+				}
+				return err
+			}
+			return nil
+		}
+	}
+}
+
+func newCheck(check byte) hash.Hash {
+	switch check {
+	case checkCRC32:
+		return crc32.NewIEEE()
+	case checkCRC64:
+		return crc64.New(crc64Table)
+	case checkSHA256:
+		return sha256.New()
+	}
+	return nil
+}
+
+// checkLen returns the size of the check field for the given check type. Types
+// this package cannot verify are skipped using the sizes from the spec.
+func checkLen(check byte) int {
+	switch {
+	case check == checkNone:
+		return 0
+	case check <= 0x03:
+		return 4
+	case check <= 0x06:
+		return 8
+	case check <= 0x09:
+		return 16
+	case check <= 0x0c:
+		return 32
+	}
+	return 64
+}
+
+// readVLI reads a variable-length integer as used throughout the xz format.
+func readVLI(r io.ByteReader) (uint64, error) {
+	var v uint64
+	for i := 0; i < 9; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		v |= uint64(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			if i > 0 && b == 0 {
+				return 0, errors.New("xz: non-minimal integer encoding")
+			}
+			return v, nil
+		}
+	}
+	return 0, errors.New("xz: integer too large")
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// byteReader adapts r to io.ByteReader without reading ahead, so byte counts
+// and the position in the underlying reader stay exact.
+func byteReader(r io.Reader) io.ByteReader {
+	if br, ok := r.(io.ByteReader); ok {
+		return br
+	}
+	return &singleByteReader{r: r}
+}
+
+type singleByteReader struct {
+	r   io.Reader
+	buf [1]byte
+}
+
+func (s *singleByteReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(s.r, s.buf[:]); err != nil {
+		return 0, err
+	}
+	return s.buf[0], nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func reverse(b []byte) {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+}
@@ -0,0 +1,33 @@
+package xz
+
+import (
+	"io"
+	"testing"
+
+	"github.com/UDL-TF/TF2Chart/src/internal/testutil"
+)
+
+func newReader(r io.Reader) (io.Reader, error) {
+	return NewReader(r)
+}
+
+func TestReaderDecodesFixtures(t *testing.T) {
+	text := testutil.Sample(2000, 0)
+	testutil.CheckFixtures(t, newReader, map[string][]byte{
+		"mixed.xz":       testutil.Sample(1000, 66000), // default preset, CRC64, stored chunks
+		"text-crc32.xz":  text,
+		"text-sha256.xz": text,
+		"text-lclppb.xz": text, // lc=0 lp=2 pb=0, no check
+		"text-blocks.xz": text, // several blocks
+		"concat.xz":      append(append([]byte{}, text...), text...),
+		"empty.xz":       {},
+	})
+}
+
+func TestReaderDetectsCorruption(t *testing.T) {
+	testutil.CheckCorruption(t, newReader, "text-crc32.xz", []int{20, -30}, []byte("BZh91AY&SY"), ErrFormat)
+}
+
+func FuzzReader(f *testing.F) {
+	testutil.FuzzReader(f, newReader)
+}
@@ -0,0 +1,98 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// forwardBits reads little-endian bit fields from the start of a buffer, as
+// used by FSE table descriptions.
+type forwardBits struct {
+	data []byte
+	pos  int // bits consumed
+}
+
+func (f *forwardBits) peek(n int) uint32 {
+	return uint32(load(f.data, f.pos, n))
+}
+
+func (f *forwardBits) skip(n int) {
+	f.pos += n
+}
+
+func (f *forwardBits) read(n int) uint32 {
+	v := f.peek(n)
+	f.skip(n)
+	return v
+}
+
+// consumed returns the number of whole bytes touched so far.
+func (f *forwardBits) consumed() int {
+	return (f.pos + 7) / 8
+}
+
+// backwardBits reads the bitstreams used for Huffman literals and sequences,
+// which are written forwards and read from the end: the last byte holds a
+// marker bit above the final bits written, and fields come out highest bits
+// first.
+type backwardBits struct {
+	data []byte
+	pos  int // bits left to read; negative once the stream is over-read
+}
+
+func newBackwardBits(data []byte) (*backwardBits, error) {
+	if len(data) == 0 || data[len(data)-1] == 0 {
+		return nil, errCorrupt
+	}
+	last := data[len(data)-1]
+	return &backwardBits{data: data, pos: (len(data)-1)*8 + bits.Len8(last) - 1}, nil
+}
+
+// peek returns the next n bits without consuming them. Bits before the start
+// of the stream read as zero.
+func (b *backwardBits) peek(n int) uint32 {
+	start := b.pos - n
+	if start >= 0 {
+		return uint32(load(b.data, start, n))
+	}
+	if n+start <= 0 {
+		return 0
+	}
+	return uint32(load(b.data, 0, n+start)) << -start
+}
+
+func (b *backwardBits) skip(n int) {
+	b.pos -= n
+}
+
+func (b *backwardBits) read(n int) uint32 {
+	if n == 0 {
+		return 0
+	}
+	v := b.peek(n)
+	b.pos -= n
+	return v
+}
+
+// overread reports whether more bits were consumed than the stream holds.
+func (b *backwardBits) overread() bool {
+	return b.pos < 0
+}
+
+// load returns n (at most 32) bits of data starting at bit offset start.
+func load(data []byte, start, n int) uint64 {
+	i := start >> 3
+	var v uint64
+	if i+8 <= len(data) {
+		v = binary.LittleEndian.Uint64(data[i:])
+	} else {
+		for j := len(data) - 1; j >= i; j-- {
+			v = v<<8 | uint64(data[j])
+		}
+	}
+	return v >> (start & 7) & (1<<n - 1)
+}
+
+func highBit(v uint32) int {
+	return bits.Len32(v) - 1
+}
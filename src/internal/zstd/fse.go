@@ -0,0 +1,159 @@
+package zstd
+
+// fseEntry is one state of an FSE decoding table.
+type fseEntry struct {
+	symbol uint8
+	bits   uint8  // bits read to move to the next state
+	base   uint16 // next state before adding those bits
+}
+
+// fseTable decodes symbols with finite state entropy (tANS).
+type fseTable struct {
+	log     int
+	entries []fseEntry
+}
+
+// readFSETable parses an FSE table description from the start of data and
+// returns the table and the number of bytes it occupied.
+func readFSETable(data []byte, maxSymbol, maxLog int) (*fseTable, int, error) {
+	if len(data) < 1 {
+		return nil, 0, errCorrupt
+	}
+	br := &forwardBits{data: data}
+	log := int(br.read(4)) + 5
+	if log > maxLog {
+		return nil, 0, errCorrupt
+	}
+	norm := make([]int16, maxSymbol+1)
+	remaining := 1<<log + 1
+	threshold := 1 << log
+	nbBits := log + 1
+	sym := 0
+	prev0 := false
+	for remaining > 1 && sym <= maxSymbol {
+		if prev0 {
+			// Runs of zero probabilities are coded as 2-bit repeat counts,
+			// continuing while the count is 3.
+			for {
+				repeat := int(br.read(2))
+				sym += repeat
+				if repeat != 3 {
+					break
+				}
+			}
+			if sym > maxSymbol {
+				return nil, 0, errCorrupt
+			}
+		}
+		limit := uint32(2*threshold - 1 - remaining)
+		v := br.peek(nbBits)
+		var count int
+		if low := v & uint32(threshold-1); low < limit {
+			count = int(low)
+			br.skip(nbBits - 1)
+		} else {
+			count = int(v & uint32(2*threshold-1))
+			if count >= threshold {
+				count -= int(limit)
+			}
+			br.skip(nbBits)
+		}
+		count-- // a count of -1 marks a "less than one" probability
+		if count < 0 {
+			remaining--
+		} else {
+			remaining -= count
+		}
+		if remaining < 1 {
+			return nil, 0, errCorrupt
+		}
+		norm[sym] = int16(count)
+		sym++
+		prev0 = count == 0
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+	if remaining != 1 || br.consumed() > len(data) {
+		return nil, 0, errCorrupt
+	}
+	t, err := buildFSETable(norm[:sym], log)
+	if err != nil {
+		return nil, 0, err
+	}
+	return t, br.consumed(), nil
+}
+
+// buildFSETable spreads symbols over the table as the reference encoder does.
+func buildFSETable(norm []int16, log int) (*fseTable, error) {
+	size := 1 << log
+	t := &fseTable{log: log, entries: make([]fseEntry, size)}
+	next := make([]int, len(norm))
+	high := size - 1
+	for s, n := range norm {
+		if n == -1 {
+			t.entries[high].symbol = uint8(s)
+			high--
+			next[s] = 1
+		} else {
+			next[s] = int(n)
+		}
+	}
+	mask := size - 1
+	step := size>>1 + size>>3 + 3
+	pos := 0
+	for s, n := range norm {
+		for i := 0; i < int(n); i++ {
+			t.entries[pos].symbol = uint8(s)
+			pos = (pos + step) & mask
+			for pos > high {
+				pos = (pos + step) & mask
+			}
+		}
+	}
+	if pos != 0 {
+		return nil, errCorrupt
+	}
+	for i := range t.entries {
+		s := t.entries[i].symbol
+		state := next[s]
+		next[s]++
+		nb := log - highBit(uint32(state))
+		t.entries[i].bits = uint8(nb)
+		t.entries[i].base = uint16(state<<nb - size)
+	}
+	return t, nil
+}
+
+// rleTable always yields sym without reading bits.
+func rleTable(sym uint8) *fseTable {
+	return &fseTable{log: 0, entries: []fseEntry{{symbol: sym}}}
+}
+
+func mustFSETable(norm []int16, log int) *fseTable {
+	t, err := buildFSETable(norm, log)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// Predefined distributions from RFC 8878, section 3.1.1.3.2.2.
+var (
+	predefinedLL = mustFSETable([]int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	}, 6)
+	predefinedML = mustFSETable([]int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	}, 6)
+	predefinedOF = mustFSETable([]int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	}, 5)
+)
@@ -0,0 +1,192 @@
+package zstd
+
+import "encoding/binary"
+
+const maxHuffmanBits = 11
+
+type huffEntry struct {
+	symbol uint8
+	bits   uint8
+}
+
+// huffTable decodes literals by looking up maxBits bits at a time.
+type huffTable struct {
+	maxBits int
+	entries []huffEntry
+}
+
+// maxWeightLog is the largest accuracy log of FSE-compressed Huffman weights.
+const maxWeightLog = 6
+
+// readHuffmanTable parses a Huffman tree description and returns the table
+// and the number of bytes it occupied.
+func readHuffmanTable(data []byte) (*huffTable, int, error) {
+	if len(data) < 1 {
+		return nil, 0, errCorrupt
+	}
+	var weights []uint8
+	header := int(data[0])
+	size := 1
+	if header < 128 {
+		// FSE-compressed weights, decoded with two interleaved states.
+		size += header
+		if len(data) < size {
+			return nil, 0, errCorrupt
+		}
+		table, n, err := readFSETable(data[1:size], maxHuffmanBits, maxWeightLog)
+		if err != nil {
+			return nil, 0, err
+		}
+		br, err := newBackwardBits(data[1+n : size])
+		if err != nil {
+			return nil, 0, err
+		}
+		s1 := br.read(table.log)
+		s2 := br.read(table.log)
+		for {
+			if len(weights) > 254 {
+				return nil, 0, errCorrupt
+			}
+			e := table.entries[s1]
+			weights = append(weights, e.symbol)
+			s1 = uint32(e.base) + br.read(int(e.bits))
+			if br.overread() {
+				weights = append(weights, table.entries[s2].symbol)
+				break
+			}
+			e = table.entries[s2]
+			weights = append(weights, e.symbol)
+			s2 = uint32(e.base) + br.read(int(e.bits))
+			if br.overread() {
+				weights = append(weights, table.entries[s1].symbol)
+				break
+			}
+		}
+		if len(weights) > 255 {
+			return nil, 0, errCorrupt
+		}
+	} else {
+		// Weights stored directly, two per byte.
+		count := header - 127
+		size += (count + 1) / 2
+		if len(data) < size {
+			return nil, 0, errCorrupt
+		}
+		weights = make([]uint8, count)
+		for i := range weights {
+			b := data[1+i/2]
+			if i%2 == 0 {
+				weights[i] = b >> 4
+			} else {
+				weights[i] = b & 0x0f
+			}
+		}
+	}
+	t, err := buildHuffmanTable(weights)
+	if err != nil {
+		return nil, 0, err
+	}
+	return t, size, nil
+}
+
+// buildHuffmanTable completes the weights with the implied last symbol and
+// lays out the canonical code: lower weights (longer codes) first, symbols in
+// ascending order within a weight.
+func buildHuffmanTable(weights []uint8) (*huffTable, error) {
+	var sum uint32
+	for _, w := range weights {
+		if w > maxHuffmanBits {
+			return nil, errCorrupt
+		}
+		if w > 0 {
+			sum += 1 << (w - 1)
+		}
+	}
+	if sum == 0 {
+		return nil, errCorrupt
+	}
+	maxBits := highBit(sum) + 1
+	rest := uint32(1)<<maxBits - sum
+	if maxBits > maxHuffmanBits || rest&(rest-1) != 0 {
+		return nil, errCorrupt
+	}
+	weights = append(weights, uint8(highBit(rest)+1))
+
+	var rankCount [maxHuffmanBits + 2]int
+	for _, w := range weights {
+		rankCount[w]++
+	}
+	var rankStart [maxHuffmanBits + 2]int
+	next := 0
+	for w := 1; w <= maxBits; w++ {
+		rankStart[w] = next
+		next += rankCount[w] << (w - 1)
+	}
+	t := &huffTable{maxBits: maxBits, entries: make([]huffEntry, 1<<maxBits)}
+	for sym, w := range weights {
+		if w == 0 {
+			continue
+		}
+		length := 1 << (w - 1)
+		e := huffEntry{symbol: uint8(sym), bits: uint8(maxBits + 1 - int(w))}
+		start := rankStart[w]
+		for i := start; i < start+length; i++ {
+			t.entries[i] = e
+		}
+		rankStart[w] += length
+	}
+	return t, nil
+}
+
+// decodeStream appends n literals decoded from one Huffman stream.
+func (t *huffTable) decodeStream(dst, stream []byte, n int) ([]byte, error) {
+	br, err := newBackwardBits(stream)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < n; i++ {
+		e := t.entries[br.peek(t.maxBits)]
+		dst = append(dst, e.symbol)
+		br.skip(int(e.bits))
+	}
+	if br.pos != 0 {
+		return nil, errCorrupt
+	}
+	return dst, nil
+}
+
+// decodeLiterals decodes regenerated literals from one or four streams.
+func (t *huffTable) decodeLiterals(dst, data []byte, regenerated int, fourStreams bool) ([]byte, error) {
+	if !fourStreams {
+		return t.decodeStream(dst, data, regenerated)
+	}
+	if len(data) < 6 {
+		return nil, errCorrupt
+	}
+	sizes := [4]int{
+		int(binary.LittleEndian.Uint16(data[0:])),
+		int(binary.LittleEndian.Uint16(data[2:])),
+		int(binary.LittleEndian.Uint16(data[4:])),
+	}
+	data = data[6:]
+	sizes[3] = len(data) - sizes[0] - sizes[1] - sizes[2]
+	if sizes[3] < 1 {
+		return nil, errCorrupt
+	}
+	segment := (regenerated + 3) / 4
+	if 3*segment > regenerated {
+		return nil, errCorrupt
+	}
+	var err error
+	for i, size := range sizes {
+		n := segment
+		if i == 3 {
+			n = regenerated - 3*segment
+		}
+		if dst, err = t.decodeStream(dst, data[:size], n); err != nil {
+			return nil, err
+		}
+		data = data[size:]
+	}
+	return dst, nil
+}
@@ -0,0 +1,210 @@
+package zstd
+
+const (
+	maxLLSymbol = 35
+	maxMLSymbol = 52
+	maxOFSymbol = 31
+	maxLLLog    = 9
+	maxMLLog    = 9
+	maxOFLog    = 8
+)
+
+// Compression modes of the sequence tables.
+const (
+	modePredefined = iota
+	modeRLE
+	modeCompressed
+	modeRepeat
+)
+
+type code struct {
+	base uint32
+	bits uint8
+}
+
+// Literal and match length codes from RFC 8878, section 3.1.1.3.2.1.1.
+var (
+	llCodes = [maxLLSymbol + 1]code{
+		{0, 0}, {1, 0}, {2, 0}, {3, 0}, {4, 0}, {5, 0}, {6, 0}, {7, 0},
+		{8, 0}, {9, 0}, {10, 0}, {11, 0}, {12, 0}, {13, 0}, {14, 0}, {15, 0},
+		{16, 1}, {18, 1}, {20, 1}, {22, 1}, {24, 2}, {28, 2}, {32, 3}, {40, 3},
+		{48, 4}, {64, 6}, {128, 7}, {256, 8}, {512, 9}, {1024, 10}, {2048, 11}, {4096, 12},
+		{8192, 13}, {16384, 14}, {32768, 15}, {65536, 16},
+	}
+	mlCodes = func() [maxMLSymbol + 1]code {
+		var c [maxMLSymbol + 1]code
+		for i := 0; i < 32; i++ {
+			c[i] = code{uint32(i) + 3, 0}
+		}
+		copy(c[32:], []code{
+			{35, 1}, {37, 1}, {39, 1}, {41, 1}, {43, 2}, {47, 2}, {51, 3}, {59, 3},
+			{67, 4}, {83, 4}, {99, 5}, {131, 7}, {259, 8}, {515, 9}, {1027, 10}, {2051, 11},
+			{4099, 12}, {8195, 13}, {16387, 14}, {32771, 15}, {65539, 16},
+		})
+		return c
+	}()
+)
+
+// sequenceTable selects the table for one of the three sequence fields
+// according to its compression mode, and returns the bytes consumed.
+func sequenceTable(mode int, data []byte, prev *fseTable, predefined *fseTable, maxSymbol, maxLog int) (*fseTable, int, error) {
+	switch mode {
+	case modePredefined:
+		return predefined, 0, nil
+	case modeRLE:
+		if len(data) < 1 || int(data[0]) > maxSymbol {
+			return nil, 0, errCorrupt
+		}
+		return rleTable(data[0]), 1, nil
+	case modeCompressed:
+		return readFSETable(data, maxSymbol, maxLog)
+	default:
+		if prev == nil {
+			return nil, 0, errCorrupt
+		}
+		return prev, 0, nil
+	}
+}
+
+// decodeSequences parses the sequences section of a compressed block and
+// executes it against literals, appending the block's output to z.hist.
+func (z *Reader) decodeSequences(data, literals []byte) error {
+	if len(data) < 1 {
+		return errCorrupt
+	}
+	count := int(data[0])
+	switch {
+	case count == 0:
+		if len(data) != 1 {
+			return errCorrupt
+		}
+		z.hist = append(z.hist, literals...)
+		return nil
+	case count < 128:
+		data = data[1:]
+	case count < 255:
+		if len(data) < 2 {
+			return errCorrupt
+		}
+		count = (count-128)<<8 + int(data[1])
+		data = data[2:]
+	default:
+		if len(data) < 3 {
+			return errCorrupt
+		}
+		count = int(data[1]) + int(data[2])<<8 + 0x7f00
+		data = data[3:]
+	}
+	if len(data) < 1 || data[0]&3 != 0 {
+		return errCorrupt
+	}
+	modes := data[0]
+	data = data[1:]
+	var err error
+	var n int
+	if z.llTable, n, err = sequenceTable(int(modes>>6), data, z.llTable, predefinedLL, maxLLSymbol, maxLLLog); err != nil {
+		return err
+	}
+	data = data[n:]
+	if z.ofTable, n, err = sequenceTable(int(modes>>4&3), data, z.ofTable, predefinedOF, maxOFSymbol, maxOFLog); err != nil {
+		return err
+	}
+	data = data[n:]
+	if z.mlTable, n, err = sequenceTable(int(modes>>2&3), data, z.mlTable, predefinedML, maxMLSymbol, maxMLLog); err != nil {
+		return err
+	}
+	data = data[n:]
+
+	br, err := newBackwardBits(data)
+	if err != nil {
+		return err
+	}
+	llState := br.read(z.llTable.log)
+	ofState := br.read(z.ofTable.log)
+	mlState := br.read(z.mlTable.log)
+	for i := 0; i < count; i++ {
+		ll := z.llTable.entries[llState]
+		of := z.ofTable.entries[ofState]
+		ml := z.mlTable.entries[mlState]
+		if int(ll.symbol) > maxLLSymbol || int(ml.symbol) > maxMLSymbol || int(of.symbol) > maxOFSymbol {
+			return errCorrupt
+		}
+
+		offsetValue := uint32(1)<<of.symbol + br.read(int(of.symbol))
+		mc := mlCodes[ml.symbol]
+		matchLen := mc.base + br.read(int(mc.bits))
+		lc := llCodes[ll.symbol]
+		litLen := lc.base + br.read(int(lc.bits))
+
+		if i != count-1 {
+			llState = uint32(ll.base) + br.read(int(ll.bits))
+			mlState = uint32(ml.base) + br.read(int(ml.bits))
+			ofState = uint32(of.base) + br.read(int(of.bits))
+		}
+		if br.overread() {
+			return errCorrupt
+		}
+
+		offset := z.resolveOffset(offsetValue, litLen)
+		if int(litLen) > len(literals) {
+			return errCorrupt
+		}
+		z.hist = append(z.hist, literals[:litLen]...)
+		literals = literals[litLen:]
+		if err := z.copyMatch(int(offset), int(matchLen)); err != nil {
+			return err
+		}
+	}
+	if br.pos != 0 {
+		return errCorrupt
+	}
+	z.hist = append(z.hist, literals...)
+	return nil
+}
+
+// resolveOffset turns an offset value into a distance, maintaining the three
+// repeat offsets.
+func (z *Reader) resolveOffset(value, litLen uint32) uint32 {
+	if value > 3 {
+		offset := value - 3
+		z.reps[2], z.reps[1], z.reps[0] = z.reps[1], z.reps[0], offset
+		return offset
+	}
+	if litLen == 0 {
+		value++
+	}
+	var offset uint32
+	switch value {
+	case 1:
+		return z.reps[0]
+	case 2:
+		offset = z.reps[1]
+		z.reps[1] = z.reps[0]
+	case 3:
+		offset = z.reps[2]
+		z.reps[2], z.reps[1] = z.reps[1], z.reps[0]
+	default:
+		// An offset of 0 is invalid and caught by copyMatch.
+		offset = z.reps[0] - 1
+		z.reps[2], z.reps[1] = z.reps[1], z.reps[0]
+	}
+	z.reps[0] = offset
+	return offset
+}
+
+// copyMatch appends length bytes starting offset bytes back in the window.
+func (z *Reader) copyMatch(offset, length int) error {
+	if offset == 0 || offset > len(z.hist) || offset > z.windowSize {
+		return errCorrupt
+	}
+	start := len(z.hist) - offset
+	if offset >= length {
+		z.hist = append(z.hist, z.hist[start:start+length]...)
+		return nil
+	}
+	// Overlapping matches repeat the last offset bytes.
+	for i := 0; i < length; i++ {
+		z.hist = append(z.hist, z.hist[start+i])
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// The primes are variables so that the seed arithmetic below wraps.
+var (
+	prime64_1 uint64 = 11400714785074694791
+	prime64_2 uint64 = 14029467366897019727
+	prime64_3 uint64 = 1609587929392839161
+	prime64_4 uint64 = 9650029242287828579
+	prime64_5 uint64 = 2870177450012600261
+)
+
+// xxh64 computes XXH64 with seed 0, which zstd uses for content checksums.
+type xxh64 struct {
+	v     [4]uint64
+	total uint64
+	buf   [32]byte
+	n     int // bytes buffered in buf
+}
+
+func newXXH64() *xxh64 {
+	h := &xxh64{}
+	h.reset()
+	return h
+}
+
+func (h *xxh64) reset() {
+	h.v = [4]uint64{prime64_1 + prime64_2, prime64_2, 0, -prime64_1}
+	h.total = 0
+	h.n = 0
+}
+
+func xxhRound(acc, lane uint64) uint64 {
+	acc += lane * prime64_2
+	return bits.RotateLeft64(acc, 31) * prime64_1
+}
+
+func xxhMerge(acc, v uint64) uint64 {
+	acc ^= xxhRound(0, v)
+	return acc*prime64_1 + prime64_4
+}
+
+func (h *xxh64) stripe(p []byte) {
+	h.v[0] = xxhRound(h.v[0], binary.LittleEndian.Uint64(p[0:]))
+	h.v[1] = xxhRound(h.v[1], binary.LittleEndian.Uint64(p[8:]))
+	h.v[2] = xxhRound(h.v[2], binary.LittleEndian.Uint64(p[16:]))
+	h.v[3] = xxhRound(h.v[3], binary.LittleEndian.Uint64(p[24:]))
+}
+
+func (h *xxh64) Write(p []byte) (int, error) {
+	n := len(p)
+	h.total += uint64(n)
+	if h.n > 0 {
+		c := copy(h.buf[h.n:], p)
+		h.n += c
+		p = p[c:]
+		if h.n < 32 {
+			return n, nil
+		}
+		h.stripe(h.buf[:])
+		h.n = 0
+	}
+	for len(p) >= 32 {
+		h.stripe(p)
+		p = p[32:]
+	}
+	h.n = copy(h.buf[:], p)
+	return n, nil
+}
+
+func (h *xxh64) Sum64() uint64 {
+	var acc uint64
+	if h.total >= 32 {
+		acc = bits.RotateLeft64(h.v[0], 1) + bits.RotateLeft64(h.v[1], 7) +
+			bits.RotateLeft64(h.v[2], 12) + bits.RotateLeft64(h.v[3], 18)
+		for _, v := range h.v {
+			acc = xxhMerge(acc, v)
+		}
+	} else {
+		acc = prime64_5
+	}
+	acc += h.total
+	p := h.buf[:h.n]
+	for ; len(p) >= 8; p = p[8:] {
+		acc ^= xxhRound(0, binary.LittleEndian.Uint64(p))
+		acc = bits.RotateLeft64(acc, 27)*prime64_1 + prime64_4
+	}
+	if len(p) >= 4 {
+		acc ^= uint64(binary.LittleEndian.Uint32(p)) * prime64_1
+		acc = bits.RotateLeft64(acc, 23)*prime64_2 + prime64_3
+		p = p[4:]
+	}
+	for _, b := range p {
+		acc ^= uint64(b) * prime64_5
+		acc = bits.RotateLeft64(acc, 11) * prime64_1
+	}
+	acc ^= acc >> 33
+	acc *= prime64_2
+	acc ^= acc >> 29
+	acc *= prime64_3
+	acc ^= acc >> 32
+	return acc
+}
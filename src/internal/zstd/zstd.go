@@ -0,0 +1,388 @@
+// Package zstd decodes Zstandard (.zst) files as specified in RFC 8878.
+// Frames using dictionaries are not supported.
+package zstd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	frameMagic         = 0xfd2fb528
+	skippableMagicMask = 0xfffffff0
+	skippableMagic     = 0x184d2a50
+
+	maxBlockSize = 128 << 10
+
+	// MaxWindowSize is the largest window a frame may ask for, matching the
+	// default memory limit of the reference decoder.
+	MaxWindowSize = 1 << 27
+)
+
+var (
+	// ErrFormat is returned for input that does not start with a zstd frame.
+	ErrFormat = errors.New("zstd: not a zstd stream")
+
+	errCorrupt = errors.New("zstd: corrupt input")
+)
+
+// Reader decompresses a sequence of zstd frames.
+type Reader struct {
+	r *bufio.Reader
+
+	inFrame     bool
+	lastBlock   bool
+	windowSize  int
+	contentSize int64 // -1 when the frame does not declare it
+	produced    int64
+	checksum    *xxh64 // nil when the frame has no checksum
+
+	hist  []byte // decoded data, of which at least the last windowSize bytes are kept
+	out   []byte // decoded data not yet returned by Read
+	block []byte
+
+	literals []byte
+	huff     *huffTable
+	llTable  *fseTable
+	ofTable  *fseTable
+	mlTable  *fseTable
+	reps     [3]uint32
+
+	err error
+}
+
+// NewReader returns a reader decompressing the zstd data read from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	z := &Reader{r: bufio.NewReaderSize(r, 64<<10)}
+	magic, err := z.r.Peek(4)
+	if err != nil || !isFrame(binary.LittleEndian.Uint32(magic)) {
+		return nil, ErrFormat
+	}
+	return z, nil
+}
+
+func isFrame(magic uint32) bool {
+	return magic == frameMagic || magic&skippableMagicMask == skippableMagic
+}
+
+func (z *Reader) Read(p []byte) (int, error) {
+	for len(z.out) == 0 {
+		if z.err != nil {
+			return 0, z.err
+		}
+		z.err = z.next()
+	}
+	n := copy(p, z.out)
+	z.out = z.out[n:]
+	return n, nil
+}
+
+// next decodes the next block, starting or finishing frames as needed.
+func (z *Reader) next() error {
+	if !z.inFrame {
+		return z.frameHeader()
+	}
+	if z.lastBlock {
+		return z.finishFrame()
+	}
+	return z.nextBlock()
+}
+
+// frameHeader starts the next frame, skipping skippable frames, or returns
+// io.EOF at the end of the input.
+func (z *Reader) frameHeader() error {
+	var magic [4]byte
+	if n, err := io.ReadFull(z.r, magic[:]); err != nil {
+		if n == 0 && err == io.EOF {
+			return io.EOF
+		}
+		return io.ErrUnexpectedEOF
+	}
+	m := binary.LittleEndian.Uint32(magic[:])
+	if m&skippableMagicMask == skippableMagic {
+		var size [4]byte
+		if _, err := io.ReadFull(z.r, size[:]); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		if _, err := z.r.Discard(int(binary.LittleEndian.Uint32(size[:]))); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	}
+	if m != frameMagic {
+		return errors.New("zstd: trailing garbage after frame")
+	}
+
+	desc, err := z.r.ReadByte()
+	if err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	fcsFlag := desc >> 6
+	singleSegment := desc&0x20 != 0
+	if desc&0x08 != 0 {
+		return errCorrupt
+	}
+	hasChecksum := desc&0x04 != 0
+	dictIDSize := [4]int{0, 1, 2, 4}[desc&3]
+
+	headerSize := dictIDSize + [4]int{0, 2, 4, 8}[fcsFlag]
+	if !singleSegment {
+		headerSize++
+	} else if fcsFlag == 0 {
+		headerSize++
+	}
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(z.r, header); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	window := 0
+	if !singleSegment {
+		exp := int(header[0] >> 3)
+		base := 1 << (10 + exp)
+		window = base + base/8*int(header[0]&7)
+		header = header[1:]
+	}
+	dictID := uint32(0)
+	for i := dictIDSize - 1; i >= 0; i-- {
+		dictID = dictID<<8 | uint32(header[i])
+	}
+	if dictID != 0 {
+		return fmt.Errorf("zstd: frame requires dictionary %d", dictID)
+	}
+	header = header[dictIDSize:]
+	z.contentSize = -1
+	switch len(header) {
+	case 1:
+		z.contentSize = int64(header[0])
+	case 2:
+		z.contentSize = int64(binary.LittleEndian.Uint16(header)) + 256
+	case 4:
+		z.contentSize = int64(binary.LittleEndian.Uint32(header))
+	case 8:
+		z.contentSize = int64(binary.LittleEndian.Uint64(header))
+		if z.contentSize < 0 {
+			return errCorrupt
+		}
+	}
+	if singleSegment {
+		if z.contentSize > MaxWindowSize {
+			return fmt.Errorf("zstd: frame content size %d exceeds the %d byte window limit", z.contentSize, MaxWindowSize)
+		}
+		window = int(z.contentSize)
+	}
+	if window > MaxWindowSize {
+		return fmt.Errorf("zstd: window size %d exceeds the %d byte limit", window, MaxWindowSize)
+	}
+
+	z.inFrame = true
+	z.lastBlock = false
+	z.windowSize = window
+	z.produced = 0
+	z.checksum = nil
+	if hasChecksum {
+		z.checksum = newXXH64()
+	}
+	z.hist = z.hist[:0]
+	z.huff = nil
+	z.llTable, z.ofTable, z.mlTable = nil, nil, nil
+	z.reps = [3]uint32{1, 4, 8}
+	return nil
+}
+
+// nextBlock decodes one block into z.out.
+func (z *Reader) nextBlock() error {
+	var header [3]byte
+	if _, err := io.ReadFull(z.r, header[:]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	h := uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16
+	z.lastBlock = h&1 != 0
+	blockType := h >> 1 & 3
+	size := int(h >> 3)
+	limit := min(z.windowSize, maxBlockSize)
+	if z.windowSize == 0 {
+		// A single-segment frame with no content can only hold empty blocks.
+		limit = 0
+	}
+
+	// Keep at least the window, compacting once twice that has accumulated.
+	if keep := max(z.windowSize, maxBlockSize); len(z.hist) > 2*keep {
+		n := copy(z.hist, z.hist[len(z.hist)-keep:])
+		z.hist = z.hist[:n]
+	}
+	start := len(z.hist)
+
+	switch blockType {
+	case 0: // raw
+		if size > limit {
+			return errCorrupt
+		}
+		z.block = grow(z.block, size)
+		if _, err := io.ReadFull(z.r, z.block); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		z.hist = append(z.hist, z.block...)
+	case 1: // RLE: size is the regenerated size of one repeated byte
+		if size > limit {
+			return errCorrupt
+		}
+		b, err := z.r.ReadByte()
+		if err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		for i := 0; i < size; i++ {
+			z.hist = append(z.hist, b)
+		}
+	case 2: // compressed
+		if size > limit {
+			return errCorrupt
+		}
+		z.block = grow(z.block, size)
+		if _, err := io.ReadFull(z.r, z.block); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		if err := z.compressedBlock(z.block); err != nil {
+			return err
+		}
+		if len(z.hist)-start > limit {
+			return errCorrupt
+		}
+	default:
+		return errCorrupt
+	}
+
+	z.out = z.hist[start:]
+	z.produced += int64(len(z.out))
+	if z.contentSize >= 0 && z.produced > z.contentSize {
+		return errCorrupt
+	}
+	if z.checksum != nil {
+		z.checksum.Write(z.out)
+	}
+	return nil
+}
+
+// compressedBlock decodes the literals and sequences sections of a block.
+func (z *Reader) compressedBlock(data []byte) error {
+	if len(data) < 1 {
+		return errCorrupt
+	}
+	litType := data[0] & 3
+	sizeFormat := data[0] >> 2 & 3
+
+	var regenerated, compressed, headerSize int
+	switch {
+	case litType < 2: // raw or RLE
+		switch sizeFormat {
+		case 0, 2:
+			headerSize = 1
+			regenerated = int(data[0] >> 3)
+		case 1:
+			headerSize = 2
+			if len(data) < 2 {
+				return errCorrupt
+			}
+			regenerated = int(data[0]>>4) | int(data[1])<<4
+		case 3:
+			headerSize = 3
+			if len(data) < 3 {
+				return errCorrupt
+			}
+			regenerated = int(data[0]>>4) | int(data[1])<<4 | int(data[2])<<12
+		}
+	default: // Huffman compressed, with a new or repeated table
+		var h uint64
+		switch sizeFormat {
+		case 0, 1:
+			headerSize = 3
+		case 2:
+			headerSize = 4
+		case 3:
+			headerSize = 5
+		}
+		if len(data) < headerSize {
+			return errCorrupt
+		}
+		for i := headerSize - 1; i >= 0; i-- {
+			h = h<<8 | uint64(data[i])
+		}
+		sizeBits := [4]uint{10, 10, 14, 18}[sizeFormat]
+		regenerated = int(h >> 4 & (1<<sizeBits - 1))
+		compressed = int(h >> (4 + sizeBits) & (1<<sizeBits - 1))
+	}
+	if regenerated > maxBlockSize {
+		return errCorrupt
+	}
+	data = data[headerSize:]
+
+	var literals []byte
+	switch litType {
+	case 0:
+		if len(data) < regenerated {
+			return errCorrupt
+		}
+		literals = data[:regenerated]
+		data = data[regenerated:]
+	case 1:
+		if len(data) < 1 {
+			return errCorrupt
+		}
+		z.literals = z.literals[:0]
+		for i := 0; i < regenerated; i++ {
+			z.literals = append(z.literals, data[0])
+		}
+		literals = z.literals
+		data = data[1:]
+	default:
+		if len(data) < compressed {
+			return errCorrupt
+		}
+		streams := data[:compressed]
+		data = data[compressed:]
+		if litType == 2 {
+			huff, n, err := readHuffmanTable(streams)
+			if err != nil {
+				return err
+			}
+			z.huff = huff
+			streams = streams[n:]
+		} else if z.huff == nil {
+			return errCorrupt
+		}
+		var err error
+		z.literals, err = z.huff.decodeLiterals(z.literals[:0], streams, regenerated, sizeFormat != 0)
+		if err != nil {
+			return err
+		}
+		literals = z.literals
+	}
+	return z.decodeSequences(data, literals)
+}
+
+// finishFrame verifies the content size and checksum at the end of a frame.
+func (z *Reader) finishFrame() error {
+	if z.contentSize >= 0 && z.produced != z.contentSize {
+		return errors.New("zstd: frame content size mismatch")
+	}
+	if z.checksum != nil {
+		var sum [4]byte
+		if _, err := io.ReadFull(z.r, sum[:]); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		if uint32(z.checksum.Sum64()) != binary.LittleEndian.Uint32(sum[:]) {
+			return errors.New("zstd: checksum mismatch")
+		}
+	}
+	z.inFrame = false
+	return nil
+}
+
+func grow(b []byte, n int) []byte {
+	if cap(b) < n {
+		return make([]byte, n)
+	}
+	return b[:n]
+}
@@ -0,0 +1,51 @@
+package zstd
+
+import (
+	"io"
+	"testing"
+
+	"github.com/UDL-TF/TF2Chart/src/internal/testutil"
+)
+
+func newReader(r io.Reader) (io.Reader, error) {
+	return NewReader(r)
+}
+
+func TestReaderDecodesFixtures(t *testing.T) {
+	text := testutil.Sample(2000, 0)
+	large := testutil.Sample(8000, 0)
+	testutil.CheckFixtures(t, newReader, map[string][]byte{
+		"text-1.zst":       text,
+		"text-19.zst":      text,
+		"text-nocheck.zst": text,
+		"mixed.zst":        testutil.Sample(1000, 66000), // raw literals and blocks for the noise
+		"large-long.zst":   large,                        // several blocks, long-distance matching
+		"large-stream.zst": large,                        // no content size
+		"zeros.zst":        make([]byte, 300000),
+		"concat.zst":       append(append([]byte{}, text...), text...), // two frames around a skippable frame
+		"empty.zst":        {},
+	})
+}
+
+func TestReaderDetectsCorruption(t *testing.T) {
+	testutil.CheckCorruption(t, newReader, "text-19.zst", []int{12, -2}, []byte("\xfd7zXZ\x00\x00\x04"), ErrFormat)
+}
+
+func FuzzReader(f *testing.F) {
+	testutil.FuzzReader(f, newReader)
+}
+
+func TestXXH64(t *testing.T) {
+	for input, want := range map[string]uint64{
+		"":    0xef46db3751d8e999,
+		"a":   0xd24ec4f1a98c6e5b,
+		"abc": 0x44bc2cf5ad770999,
+		"Nobody inspects the spammish repetition": 0xfbcea83c8a378bf1,
+	} {
+		h := newXXH64()
+		h.Write([]byte(input))
+		if got := h.Sum64(); got != want {
+			t.Errorf("xxh64(%q) = %#x, want %#x", input, got, want)
+		}
+	}
+}
@@ -50,7 +50,17 @@ app.kubernetes.io/instance: {{ .Release.Name }}
     runAsNonRoot: false
   env:
     - name: PERMISSIONS_CONFIG
-      value: {{ dict "path" $ctx.path "user" $ctx.user "group" $ctx.group "mode" $ctx.mode | toJson | quote }}
+      {{- $permConfig := dict "path" $ctx.path "rules" $ctx.rules "exclude" (default (list) $ctx.exclude) "followSymlinks" (default false $ctx.followSymlinks) }}
+      {{- with $ctx.parallelism }}
+        {{- $_ := set $permConfig "parallelism" . }}
+      {{- end }}
+      {{- with $ctx.progressSeconds }}
+        {{- $_ := set $permConfig "progressSeconds" . }}
+      {{- end }}
+      {{- with $ctx.jobs }}
+        {{- $_ := set $permConfig "jobs" . }}
+      {{- end }}
+      value: {{ $permConfig | toJson | quote }}
   volumeMounts:
     - name: {{ $ctx.volumeName }}
       mountPath: {{ $ctx.mountPath }}
@@ -53,6 +53,26 @@ spec:
   {{- $permUser := default 1000 $permissionsInit.user }}
   {{- $permGroup := default 1000 $permissionsInit.group }}
   {{- $permMode := default "775" $permissionsInit.chmod }}
+  {{- $permDefaultRule := dict "user" (int $permUser) "group" (int $permGroup) "fileMode" (toString (default $permMode $permissionsInit.fileMode)) "dirMode" (toString (default $permMode $permissionsInit.dirMode)) }}
+  {{- $permRules := prepend (default (list) $permissionsInit.rules) $permDefaultRule }}
+  {{- $permExclude := default (list) $permissionsInit.exclude }}
+  {{- $permParallelism := int (default 8 $permissionsInit.parallelism) }}
+  {{- $permProgress := int (default 10 $permissionsInit.progressSeconds) }}
+  {{- $permFollow := ne (default false $permissionsInit.followSymlinks) false }}
+  {{- $permExtraJobs := list }}
+  {{- $permMountPrefix := printf "%s/" (trimSuffix "/" $permMountPath) }}
+  {{- range $job := default (list) $permissionsInit.extraJobs }}
+    {{- if $permEnabled }}
+      {{- if not $permRunFirst }}
+        {{- fail "permissionsInit.extraJobs run in the runFirst container; enable permissionsInit.runFirst or move the jobs elsewhere" }}
+      {{- end }}
+      {{- if not (or (eq (trimSuffix "/" (toString $job.path)) (trimSuffix "/" $permMountPath)) (hasPrefix $permMountPrefix (toString $job.path))) }}
+        {{- fail (printf "permissionsInit.extraJobs path %q must be inside permissionsInit.mountPath %q" (toString $job.path) $permMountPath) }}
+      {{- end }}
+    {{- end }}
+    {{- $jobDict := dict "path" $job.path "rules" (default $permRules $job.rules) "exclude" (default (list) $job.exclude) "followSymlinks" (ne (default false $job.followSymlinks) false) }}
+    {{- $permExtraJobs = append $permExtraJobs $jobDict }}
+  {{- end }}
   {{- $permImage := default "busybox" $permissionsInit.image }}
   {{- $permImagePullPolicy := default "Always" $permissionsInit.imagePullPolicy }}
   {{- $fixViewLayer := ne (default false $permissionsInit.applyDuringMerge) false }}
@@ -131,6 +151,30 @@ spec:
         {{- $templateSourcePath := trimPrefix "/" (default $pathClean $entry.template.sourcePath) }}
         {{- $templateClean := ne (default true $entry.template.clean) false }}
         {{- $templateDict := dict "sourceMount" $templateSourceMount "sourcePath" $templateSourcePath "clean" $templateClean }}
+        {{- with $entry.template.preserve }}
+          {{- $_ := set $templateDict "preserve" . }}
+        {{- end }}
+        {{- with $entry.template.exclude }}
+          {{- $_ := set $templateDict "exclude" . }}
+        {{- end }}
+        {{- with $entry.template.backup }}
+          {{- $_ := set $templateDict "backup" . }}
+        {{- end }}
+        {{- with $entry.template.render }}
+          {{- $_ := set $templateDict "render" . }}
+        {{- end }}
+        {{- with $entry.template.mode }}
+          {{- $_ := set $templateDict "mode" (toString .) }}
+        {{- end }}
+        {{- if hasKey $entry.template "user" }}
+          {{- $_ := set $templateDict "user" (int $entry.template.user) }}
+        {{- end }}
+        {{- if hasKey $entry.template "group" }}
+          {{- $_ := set $templateDict "group" (int $entry.template.group) }}
+        {{- end }}
+        {{- with $entry.template.preserveAttributes }}
+          {{- $_ := set $templateDict "preserveAttributes" . }}
+        {{- end }}
         {{- $_ := set $dict "template" $templateDict }}
       {{- end }}
       {{- $writableList = append $writableList $dict }}
@@ -151,8 +195,38 @@ spec:
     {{- $cleanTarget := ne (default true $entry.cleanTarget) false }}
     {{- $targetMode := lower (default "view" $entry.targetMode) }}
     {{- $onlyOnInit := ne (default false $entry.onlyOnInit) false }}
-    {{- if and $targetPath $sourcePath $sourceMount }}
+    {{- if and $targetPath (or $sourcePath $entry.sources) $sourceMount }}
       {{- $dict := dict "targetPath" $targetPath "sourcePath" $sourcePath "sourceMount" $sourceMount "clean" $cleanTarget "targetMode" $targetMode "onlyOnInit" $onlyOnInit }}
+      {{- with $entry.preserve }}
+        {{- $_ := set $dict "preserve" . }}
+      {{- end }}
+      {{- with $entry.exclude }}
+        {{- $_ := set $dict "exclude" . }}
+      {{- end }}
+      {{- with $entry.backup }}
+        {{- $_ := set $dict "backup" . }}
+      {{- end }}
+      {{- with $entry.render }}
+        {{- $_ := set $dict "render" . }}
+      {{- end }}
+      {{- with $entry.sources }}
+        {{- $_ := set $dict "sources" . }}
+      {{- end }}
+      {{- with $entry.rename }}
+        {{- $_ := set $dict "rename" . }}
+      {{- end }}
+      {{- with $entry.mode }}
+        {{- $_ := set $dict "mode" (toString .) }}
+      {{- end }}
+      {{- if hasKey $entry "user" }}
+        {{- $_ := set $dict "user" (int $entry.user) }}
+      {{- end }}
+      {{- if hasKey $entry "group" }}
+        {{- $_ := set $dict "group" (int $entry.group) }}
+      {{- end }}
+      {{- with $entry.preserveAttributes }}
+        {{- $_ := set $dict "preserveAttributes" . }}
+      {{- end }}
       {{- $templateCopyList = append $templateCopyList $dict }}
     {{- end }}
   {{- end }}
@@ -233,7 +307,7 @@ spec:
       {{- end }}
     {{- end }}
   {{- end }}
-  {{- $mergePermissions := dict "applyDuringMerge" $fixViewLayer "applyPaths" $applyPaths "user" $permUser "group" $permGroup "mode" $permMode }}
+  {{- $mergePermissions := dict "applyDuringMerge" $fixViewLayer "applyPaths" $applyPaths "rules" $permRules "parallelism" $permParallelism "progressSeconds" $permProgress }}
   {{- $decompressPaths := default (list) .Values.merger.decompressPaths }}
   {{- /* Build a set of overlay names that need write access for decompression */ -}}
   {{- $decompWritableOverlays := dict }}
@@ -249,6 +323,62 @@ spec:
     {{- end }}
   {{- end }}
   {{- $mergeConfig := dict "basePath" "/mnt/base" "targetBase" $targetBasePath "targetContent" $targetContentPath "overlays" $overlayConfigs "writablePaths" $writablePaths "copyTemplates" $templateCopies "permissions" $mergePermissions "excludePaths" $excludePaths "decompressPaths" $decompressPaths }}
+  {{- with .Values.merger.backupRoot }}
+    {{- $_ := set $mergeConfig "backupRoot" . }}
+  {{- end }}
+  {{- with .Values.merger.secretDirs }}
+    {{- $_ := set $mergeConfig "secretDirs" . }}
+  {{- end }}
+  {{- with .Values.fileMerges }}
+    {{- $_ := set $mergeConfig "fileMerges" . }}
+  {{- end }}
+  {{- with .Values.merger.transforms }}
+    {{- $_ := set $mergeConfig "transforms" . }}
+  {{- end }}
+  {{- with .Values.merger.decompression }}
+    {{- $_ := set $mergeConfig "decompression" . }}
+  {{- end }}
+  {{- $fastdl := default (dict) .Values.fastdl }}
+  {{- $fastdlEnabled := and $mergerEnabled (ne (default false $fastdl.enabled) false) }}
+  {{- $fastdlPath := default "/mnt/fastdl" $fastdl.path }}
+  {{- $fastdlVolume := default (dict) $fastdl.volume }}
+  {{- $fastdlOnInit := and $fastdlEnabled (ne (default false $fastdl.onInit) false) }}
+  {{- $fastdlServer := default (dict) $fastdl.server }}
+  {{- $fastdlServing := and $fastdlEnabled $watcherEnabled (ne (default false $fastdlServer.enabled) false) }}
+  {{- $fastdlPort := default 27020 $fastdlServer.port }}
+  {{- $watcherMergeConfig := $mergeConfig }}
+  {{- if $fastdlEnabled }}
+    {{- $fastdlConfig := dict "outputDir" $fastdlPath }}
+    {{- with $fastdl.dirs }}
+      {{- $_ := set $fastdlConfig "dirs" . }}
+    {{- end }}
+    {{- with $fastdl.level }}
+      {{- $_ := set $fastdlConfig "level" . }}
+    {{- end }}
+    {{- with $fastdl.workers }}
+      {{- $_ := set $fastdlConfig "workers" . }}
+    {{- end }}
+    {{- if $fastdlServing }}
+      {{- $serverConfig := dict "listen" (printf ":%v" $fastdlPort) }}
+      {{- with $fastdlServer.prefix }}
+        {{- $_ := set $serverConfig "prefix" . }}
+      {{- end }}
+      {{- with $fastdlServer.maxKBPerSecond }}
+        {{- $_ := set $serverConfig "maxKBPerSecond" . }}
+      {{- end }}
+      {{- with $fastdlServer.maxConnsPerIP }}
+        {{- $_ := set $serverConfig "maxConnsPerIP" . }}
+      {{- end }}
+      {{- if $fastdlServer.trustForwardedFor }}
+        {{- $_ := set $serverConfig "trustForwardedFor" true }}
+      {{- end }}
+      {{- $_ := set $fastdlConfig "server" $serverConfig }}
+    {{- end }}
+    {{- $watcherMergeConfig = merge (dict "fastdl" $fastdlConfig) $mergeConfig }}
+    {{- if $fastdlOnInit }}
+      {{- $mergeConfig = $watcherMergeConfig }}
+    {{- end }}
+  {{- end }}
   {{- $watcherConfig := dict "watchPaths" $watchPaths "events" $watchEvents "debounceSeconds" $debounceSeconds "pollIntervalSeconds" $pollInterval }}
   {{- with .Values.podSecurityContext }}
   securityContext:
@@ -290,6 +420,20 @@ spec:
         type: {{ $decompCacheHostPathType }}
       {{- end }}
     {{- end }}
+    {{- if $fastdlEnabled }}
+    {{- $fastdlVolumeType := default "emptyDir" $fastdlVolume.type }}
+    - name: fastdl
+      {{- if eq $fastdlVolumeType "pvc" }}
+      persistentVolumeClaim:
+        claimName: {{ required "fastdl.volume.claimName is required for type pvc" $fastdlVolume.claimName }}
+      {{- else if eq $fastdlVolumeType "hostPath" }}
+      hostPath:
+        path: {{ required "fastdl.volume.hostPath is required for type hostPath" $fastdlVolume.hostPath }}
+        type: {{ default "DirectoryOrCreate" $fastdlVolume.hostPathType }}
+      {{- else }}
+      emptyDir: {}
+      {{- end }}
+    {{- end }}
     {{- with .Values.extraVolumes }}
     {{- toYaml . | nindent 4 }}
     {{- end }}
@@ -298,7 +442,7 @@ spec:
   {{- if or $mergerEnabled $permActive $decompEnabled (gt (len $pre) 0) (gt (len $post) 0) }}
   initContainers:
     {{- if and $permEnabled $permRunFirst }}
-    {{- include "tf2chart.permissionsInitContainer" (dict "name" $permName "image" $permImage "pullPolicy" $permImagePullPolicy "path" $permPath "user" $permUser "group" $permGroup "mode" $permMode "volumeName" $permVolumeName "mountPath" $permMountPath) | nindent 4 }}
+    {{- include "tf2chart.permissionsInitContainer" (dict "name" $permName "image" $permImage "pullPolicy" $permImagePullPolicy "path" $permPath "rules" $permRules "exclude" $permExclude "followSymlinks" $permFollow "parallelism" $permParallelism "progressSeconds" $permProgress "jobs" $permExtraJobs "volumeName" $permVolumeName "mountPath" $permMountPath) | nindent 4 }}
     {{- end }}
     {{- range $pre }}
     {{- toYaml (list .) | nindent 4 }}
@@ -334,6 +478,39 @@ spec:
         {{- if $decompCacheEnabled }}
         - -output=/mnt/decomp-cache
         {{- end }}
+        {{- if $decompressor.verifyContent }}
+        - -verify
+        {{- end }}
+        {{- if $decompressor.hashSources }}
+        - -hash-sources
+        {{- end }}
+        {{- if hasKey $decompressor "workers" }}
+        - {{ printf "-workers=%v" $decompressor.workers }}
+        {{- end }}
+        {{- with $decompressor.maxMBPerSecond }}
+        - {{ printf "-max-mbps=%v" . }}
+        {{- end }}
+        {{- with $decompressor.nice }}
+        - {{ printf "-nice=%v" . }}
+        {{- end }}
+        {{- with $decompressor.ioClass }}
+        - {{ printf "-ionice-class=%s" . }}
+        {{- if hasKey $decompressor "ioLevel" }}
+        - {{ printf "-ionice-level=%v" $decompressor.ioLevel }}
+        {{- end }}
+        {{- end }}
+        {{- with $decompressor.maxFileMB }}
+        - {{ printf "-max-file-mb=%v" . }}
+        {{- end }}
+        {{- with $decompressor.maxRatio }}
+        - {{ printf "-max-ratio=%v" . }}
+        {{- end }}
+        {{- with $decompressor.maxTotalMB }}
+        - {{ printf "-max-total-mb=%v" . }}
+        {{- end }}
+        {{- with $decompressor.minFreeMB }}
+        - {{ printf "-min-free-mb=%v" . }}
+        {{- end }}
       {{- with $decompressor.resources }}
       resources:
         {{- toYaml . | nindent 8 }}
@@ -366,6 +543,14 @@ spec:
       env:
         - name: MERGER_CONFIG
           value: {{ $mergeConfig | toJson | quote }}
+        - name: POD_NAME
+          valueFrom:
+            fieldRef:
+              fieldPath: metadata.name
+        - name: POD_NAMESPACE
+          valueFrom:
+            fieldRef:
+              fieldPath: metadata.namespace
         {{- with .Values.merger.extraEnv }}
         {{- toYaml . | nindent 8 }}
         {{- end }}
@@ -394,6 +579,10 @@ spec:
           subPath: {{ .subPath }}
           {{- end }}
         {{- end }}
+        {{- if $fastdlOnInit }}
+        - name: fastdl
+          mountPath: {{ $fastdlPath }}
+        {{- end }}
         {{- with .Values.merger.extraVolumeMounts }}
         {{- toYaml . | nindent 8 }}
         {{- end }}
@@ -431,7 +620,7 @@ spec:
     {{- toYaml (list .) | nindent 4 }}
     {{- end }}
     {{- if and $permEnabled $permRunLast }}
-    {{- include "tf2chart.permissionsInitContainer" (dict "name" $permPostName "image" $permImage "pullPolicy" $permImagePullPolicy "path" $permPostPath "user" $permUser "group" $permGroup "mode" $permMode "volumeName" $permPostVolume "mountPath" $permPostMount) | nindent 4 }}
+    {{- include "tf2chart.permissionsInitContainer" (dict "name" $permPostName "image" $permImage "pullPolicy" $permImagePullPolicy "path" $permPostPath "rules" $permRules "exclude" $permExclude "followSymlinks" $permFollow "parallelism" $permParallelism "progressSeconds" $permProgress "volumeName" $permPostVolume "mountPath" $permPostMount) | nindent 4 }}
     {{- end }}
   {{- end }}
   containers:
@@ -546,11 +735,25 @@ spec:
       args:
         {{- toYaml . | nindent 8 }}
       {{- end }}
+      {{- if $fastdlServing }}
+      ports:
+        - name: fastdl
+          containerPort: {{ $fastdlPort }}
+          protocol: TCP
+      {{- end }}
       env:
         - name: MERGER_CONFIG
-          value: {{ $mergeConfig | toJson | quote }}
+          value: {{ $watcherMergeConfig | toJson | quote }}
         - name: WATCHER_CONFIG
           value: {{ $watcherConfig | toJson | quote }}
+        - name: POD_NAME
+          valueFrom:
+            fieldRef:
+              fieldPath: metadata.name
+        - name: POD_NAMESPACE
+          valueFrom:
+            fieldRef:
+              fieldPath: metadata.namespace
         {{- with $watcherValues.env }}
         {{- toYaml . | nindent 8 }}
         {{- end }}
@@ -580,6 +783,10 @@ spec:
           readOnly: true
           {{- end }}
         {{- end }}
+        {{- if $fastdlEnabled }}
+        - name: fastdl
+          mountPath: {{ $fastdlPath }}
+        {{- end }}
         {{- with $watcherValues.extraVolumeMounts }}
         {{- toYaml . | nindent 8 }}
         {{- end }}